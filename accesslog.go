@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var accessLogPath = flag.String("accessLog", "",
+	"Where to write the HTTP access log (- for stdout)")
+var accessLogFormat = flag.String("accessLogFormat", "combined",
+	"Access log format: combined or json")
+var accessLogMaxSize = flag.String("accessLogMaxSize", "100MB",
+	"Rotate the access log when it reaches this size (0 to never rotate)")
+var accessLogKeep = flag.Int("accessLogKeep", 5,
+	"Number of rotated access logs to keep")
+var accessLogInternode = flag.Bool("accessLogInternode", true,
+	"Include requests from other nodes in the access log")
+
+// Names the node an internode request came from.
+const internodeHeader = "X-CBFS-Node"
+
+// Where a served blob came from.
+const (
+	blobLocal    = "local"
+	blobRemote   = "remote"
+	blobRedirect = "redirect"
+)
+
+var accessLogger *accessLog
+
+// Marks requests from this node so others can tell internode traffic
+// from client traffic.
+type nodeTransport struct {
+	http.RoundTripper
+}
+
+func (t nodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(internodeHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(internodeHeader, serverId)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Only other nodes talk frames.
+func frameHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(internodeHeader) == "" {
+		req.Header.Set(internodeHeader, "frames")
+	}
+	httpHandler(w, req)
+}
+
+type recorderKey struct{}
+
+func withRecorder(req *http.Request, sr *statusRecorder) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), recorderKey{}, sr))
+}
+
+// Note where the blob served for a request came from.
+func noteBlobSource(req *http.Request, src string) {
+	if sr, ok := req.Context().Value(recorderKey{}).(*statusRecorder); ok {
+		sr.blob = src
+	}
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Blob      string    `json:"blob,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	RequestID string    `json:"requestID,omitempty"`
+}
+
+func newAccessEntry(req *http.Request, sr *statusRecorder,
+	start time.Time, took time.Duration) accessEntry {
+
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	return accessEntry{
+		Time:      start,
+		Remote:    remote,
+		Method:    req.Method,
+		Path:      req.URL.RequestURI(),
+		Proto:     req.Proto,
+		Status:    sr.code(),
+		Bytes:     sr.written,
+		Duration:  took.Seconds(),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+		Blob:      sr.blob,
+		Node:      req.Header.Get(internodeHeader),
+		RequestID: requestID(req),
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Apache combined format, followed by the duration, blob source and
+// request ID.
+func (e accessEntry) combined() string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf(`%v - - [%v] %v %v %v %q %q %.6f %v %v`,
+		orDash(e.Remote), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, size,
+		orDash(e.Referer), orDash(e.UserAgent), e.Duration,
+		orDash(e.Blob), orDash(e.RequestID))
+}
+
+// An access log, rotated by size.
+type accessLog struct {
+	path    string
+	format  string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	w    io.Writer
+	f    *os.File
+	size int64
+}
+
+func openAccessLog(path, format string, maxSize int64,
+	keep int) (*accessLog, error) {
+
+	if format != "combined" && format != "json" {
+		return nil, fmt.Errorf("unknown access log format: %q", format)
+	}
+	a := &accessLog{path: path, format: format, maxSize: maxSize, keep: keep}
+	if path == "-" {
+		a.w = os.Stdout
+		return a, nil
+	}
+	return a, a.openLocked()
+}
+
+func (a *accessLog) openLocked() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.w, a.size = f, f, st.Size()
+	return nil
+}
+
+// Shift path.1 to path.2 and so on, dropping the oldest, then start
+// over.
+func (a *accessLog) rotateLocked() error {
+	a.f.Close()
+	os.Remove(fmt.Sprintf("%v.%v", a.path, a.keep))
+	for i := a.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%v.%v", a.path, i),
+			fmt.Sprintf("%v.%v", a.path, i+1))
+	}
+	if a.keep > 0 {
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return a.openLocked()
+}
+
+func (a *accessLog) log(e accessEntry) error {
+	var line []byte
+	if a.format == "json" {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			return err
+		}
+	} else {
+		line = []byte(e.combined())
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.w == nil {
+		// Rotation failed before; try again.
+		if err := a.openLocked(); err != nil {
+			return err
+		}
+	}
+	if a.f != nil && a.maxSize > 0 && a.size > 0 &&
+		a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotateLocked(); err != nil {
+			a.f, a.w = nil, nil
+			return fmt.Errorf("rotating %v: %v", a.path, err)
+		}
+	}
+	n, err := a.w.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *accessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+func logAccess(req *http.Request, sr *statusRecorder, start time.Time,
+	took time.Duration) {
+
+	if accessLogger == nil {
+		return
+	}
+	if !*accessLogInternode && req.Header.Get(internodeHeader) != "" {
+		return
+	}
+	if err := accessLogger.log(newAccessEntry(req, sr, start, took)); err != nil {
+		httpLog.Errorf("Error writing access log: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessEntry() accessEntry {
+	req := httptest.NewRequest("GET", "/some/file.txt?rev=2", nil)
+	req.RemoteAddr = "10.0.0.7:51234"
+	req.Header.Set("User-Agent", `curl/8 "test"`)
+	req.Header.Set(requestIDHeader, "abc123")
+	sr := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	noteBlobSource(withRecorder(req, sr), blobRemote)
+	sr.Write([]byte("hello"))
+
+	start := time.Date(2026, 10, 18, 13, 55, 36, 0, time.UTC)
+	return newAccessEntry(req, sr, start, 1500*time.Microsecond)
+}
+
+func TestAccessEntryCombined(t *testing.T) {
+	exp := `10.0.0.7 - - [18/Oct/2026:13:55:36 +0000] "GET /some/file.txt?rev=2 HTTP/1.1" ` +
+		`200 5 "-" "curl/8 \"test\"" 0.001500 remote abc123`
+	if got := testAccessEntry().combined(); got != exp {
+		t.Errorf("Expected\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func TestAccessLogJSONAndRotation(t *testing.T) {
+	d, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "access.log")
+
+	e := testAccessEntry()
+	line, _ := json.Marshal(e)
+	// Room for two lines per file.
+	a, err := openAccessLog(fn, "json", int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatalf("Error opening access log: %v", err)
+	}
+	defer a.Close()
+	for i := 0; i < 7; i++ {
+		if err := a.log(e); err != nil {
+			t.Fatalf("Error logging: %v", err)
+		}
+	}
+
+	for suffix, lines := range map[string]int{"": 1, ".1": 2, ".2": 2} {
+		b, err := ioutil.ReadFile(fn + suffix)
+		if err != nil {
+			t.Errorf("Error reading %v%v: %v", fn, suffix, err)
+			continue
+		}
+		got := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(got) != lines {
+			t.Errorf("Expected %v lines in %v%v, got %v", lines, fn, suffix, got)
+		}
+		rec := accessEntry{}
+		if err := json.Unmarshal([]byte(got[0]), &rec); err != nil ||
+			rec.Blob != blobRemote || rec.Status != 200 || rec.Bytes != 5 {
+			t.Errorf("Bad record in %v%v: %+v/%v", fn, suffix, rec, err)
+		}
+	}
+	if _, err := os.Stat(fn + ".3"); err == nil {
+		t.Errorf("Expected only two rotated logs kept")
+	}
+
+	if _, err := openAccessLog(fn, "xml", 0, 0); err == nil {
+		t.Errorf("Expected an error opening an unknown format")
+	}
+}
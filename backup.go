@@ -2,6 +2,7 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -19,16 +20,21 @@ import (
 	"github.com/dustin/go-hashset"
 	"github.com/couchbase/gomemcached"
 
+	"github.com/couchbaselabs/cbfs/backupstore"
 	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/trace"
 )
 
 const backupKey = "/@backup"
 
 type backupItem struct {
-	Fn   string                `json:"filename"`
-	Oid  string                `json:"oid"`
-	When time.Time             `json:"when"`
-	Conf cbfsconfig.CBFSConfig `json:"conf"`
+	Fn      string                `json:"filename"`
+	Oid     string                `json:"oid"`
+	When    time.Time             `json:"when"`
+	Conf    cbfsconfig.CBFSConfig `json:"conf"`
+	Started time.Time             `json:"started"`
+	// The backup an incremental backup builds on
+	Base string `json:"base,omitempty"`
 }
 
 type backups struct {
@@ -67,7 +73,21 @@ func streamFileMeta(w io.Writer,
 	}
 }
 
-func backupTo(w io.Writer) (err error) {
+// Back up everything, or only what changed since the base started.
+func backupTo(w io.Writer, base *backupItem) (err error) {
+	gz := gzip.NewWriter(w)
+	defer func() {
+		e := gz.Close()
+		if err != nil {
+			err = e
+		}
+	}()
+
+	if base != nil {
+		defer logDuration("incremental backup", time.Now())
+		return streamChanges(gz, base.Started)
+	}
+
 	fch := make(chan *namedFile)
 	ech := make(chan error)
 	qch := make(chan bool)
@@ -78,14 +98,6 @@ func backupTo(w io.Writer) (err error) {
 
 	go pathGenerator("", fch, ech, qch)
 
-	gz := gzip.NewWriter(w)
-	defer func() {
-		e := gz.Close()
-		if err != nil {
-			err = e
-		}
-	}()
-
 	return streamFileMeta(gz, fch, ech)
 }
 
@@ -110,7 +122,7 @@ func recordBackupObject() error {
 func recordRemoteBackupObjects() {
 	rn, err := findRemoteNodes()
 	if err != nil {
-		log.Printf("Error getting remote nodes for recording backup: %v",
+		mainLog.Errorf("Error getting remote nodes for recording backup: %v",
 			err)
 		return
 	}
@@ -120,12 +132,12 @@ func recordRemoteBackupObjects() {
 		c := n.Client()
 		res, err := c.Post(u, "application/octet-stream", nil)
 		if err != nil {
-			log.Printf("Error posting to %v: %v", u, err)
+			mainLog.Errorf("Error posting to %v: %v", u, err)
 			continue
 		}
 		res.Body.Close()
 		if res.StatusCode != 204 {
-			log.Printf("HTTP Error posting to %v: %v", u, res.Status)
+			mainLog.Errorf("HTTP Error posting to %v: %v", u, res.Status)
 		}
 	}
 }
@@ -147,43 +159,56 @@ func removeDeadBackups(b *backups) {
 
 }
 
-func storeBackupObject(fn, h string) error {
+func storeBackupObject(ctx context.Context, fn, h string, started time.Time,
+	base *backupItem) (backupItem, error) {
+
+	if err := checkFence(ctx); err != nil {
+		return backupItem{}, err
+	}
+
 	b := backups{}
 	err := couchbase.Get(backupKey, &b)
 	if err != nil && !gomemcached.IsNotFound(err) {
-		log.Printf("Weird: %v", err)
+		mainLog.Warnf("Weird: %v", err)
 		// return err
 	}
 
 	removeDeadBackups(&b)
 
-	ob := backupItem{fn, h, time.Now().UTC(), *globalConfig}
+	ob := backupItem{fn, h, time.Now().UTC(), *globalConfig, started, ""}
+	if base != nil {
+		ob.Base = base.Fn
+	}
 
 	b.Latest = ob
 	b.Backups = append(b.Backups, ob)
 
-	return couchbase.Set(backupKey, 0, &b)
+	return ob, couchbase.Set(backupKey, 0, &b)
 }
 
-func backupToCBFS(fn string) error {
+func backupToCBFS(ctx context.Context, fn string, base *backupItem) (backupItem, error) {
 	f, err := NewHashRecord(*root, "")
 	if err != nil {
-		return err
+		return backupItem{}, err
 	}
 	defer f.Close()
 
+	started := time.Now().UTC()
 	pr, pw := io.Pipe()
 
-	go func() { pw.CloseWithError(backupTo(pw)) }()
+	go func() { pw.CloseWithError(backupTo(pw, base)) }()
 
+	tr := cbfstrace.FromContext(ctx)
+	sp := tr.Start("stream")
 	h, length, err := f.Process(pr)
+	sp.End()
 	if err != nil {
-		return err
+		return backupItem{}, err
 	}
 
 	err = recordBlobOwnership(h, length, true)
 	if err != nil {
-		return err
+		return backupItem{}, err
 	}
 
 	fm := fileMeta{
@@ -192,27 +217,44 @@ func backupToCBFS(fn string) error {
 		Modified: time.Now().UTC(),
 	}
 
-	err = storeMeta(fn, 0, fm, 1, nil)
+	err = storeMeta(ctx, fn, 0, fm, 1, nil)
 	if err != nil {
-		return err
+		return backupItem{}, err
 	}
 
-	err = storeBackupObject(fn, h)
+	sp = tr.Start("record")
+	defer sp.End()
+	bi, err := storeBackupObject(ctx, fn, h, started, base)
 	if err != nil {
-		return err
+		return bi, err
 	}
 
 	err = recordBackupObject()
 	if err != nil {
-		log.Printf("Failed to record backup OID: %v", err)
+		mainLog.Errorf("Failed to record backup OID: %v", err)
 	}
 
 	go recordRemoteBackupObjects()
 
 	log.Printf("Replicating backup %v.", h)
-	go increaseReplicaCount(h, length, globalConfig.MinReplicas-1)
+	go increaseReplicaCount(h, length, globalConfig.MinReplicas-1, "")
 
-	return nil
+	return bi, nil
+}
+
+// Back up to cbfs, then copy the backup and its blobs to the target
+// if there is one.
+func runBackup(ctx context.Context, fn string, base *backupItem,
+	t cbfsbackupstore.Target) error {
+
+	bi, err := backupToCBFS(ctx, fn, base)
+	if err != nil || t == nil {
+		return err
+	}
+	sp := cbfstrace.FromContext(ctx).Start("data")
+	defer sp.End()
+	_, err = backupData(t, bi)
+	return err
 }
 
 func doMarkBackup(w http.ResponseWriter, req *http.Request) {
@@ -234,18 +276,39 @@ func doBackupDocs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	var base *backupItem
+	incr, _ := strconv.ParseBool(req.FormValue("incremental"))
+	if basefn := req.FormValue("base"); incr || basefn != "" {
+		var err error
+		base, err = findBackupBase(basefn)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	var target cbfsbackupstore.Target
+	if spec := req.FormValue("target"); spec != "" {
+		var err error
+		target, err = openDataTarget(spec, base)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
 	if bg, _ := strconv.ParseBool(req.FormValue("bg")); bg {
 		go func() {
-			err := backupToCBFS(fn)
+			err := runBackup(context.Background(), fn, base, target)
 			if err != nil {
-				log.Printf("Error performing bg backup: %v", err)
+				mainLog.Errorf("Error performing bg backup: %v", err)
 			}
 		}()
 		w.WriteHeader(202)
 		return
 	}
 
-	err := backupToCBFS(fn)
+	err := runBackup(context.Background(), fn, base, target)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error performing backup: %v", err), 500)
 		return
@@ -268,11 +331,27 @@ func doGetBackupInfo(w http.ResponseWriter, req *http.Request) {
 
 	removeDeadBackups(&b)
 
-	sendJson(w, req, &b)
+	age, stale := backupAge(b)
+	sendJson(w, req, struct {
+		backups
+		AgeSeconds int64 `json:"latestAgeSeconds"`
+		Stale      bool  `json:"stale"`
+	}{b, int64(age.Seconds()), stale})
 }
 
 var errExists = errors.New("item exists")
 
+// The key a file's meta is stored under and the meta to store there,
+// named the way storeMeta names it.
+func metaFor(fn string, fm fileMeta) (string, fileMeta) {
+	k := shortName(fn)
+	fm.Name = ""
+	if k != fn {
+		fm.Name = fn
+	}
+	return k, fm
+}
+
 func maybeStoreMeta(k string, fm fileMeta, exp int, force bool) error {
 	if force {
 		return couchbase.Set(k, exp, fm)
@@ -308,13 +387,145 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 		return
 	}
 
-	_, err = referenceBlob(fm.OID)
+	policy := restoreConflict(req.FormValue("conflict"))
+	newer, _ := strconv.ParseBool(req.FormValue("newer"))
+	if policy == restoreNewer {
+		policy, newer = restoreSkip, true
+	}
+	if !policy.valid() {
+		http.Error(w, fmt.Sprintf("Invalid conflict policy: %q", policy), 400)
+		return
+	}
+
+	if s := req.FormValue("revno"); s != "" {
+		revno, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid revno", 400)
+			return
+		}
+		fm, err = pickRevision(fm, revno)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+	}
+
+	as, err := restoreMeta(fn, fm, getExpiration(req.Header), policy, newer)
+	switch err {
+	case errExists:
+		http.Error(w, err.Error(), 409)
+		return
+	case nil:
+	default:
+		http.Error(w,
+			fmt.Sprintf("Error recording file meta: %v", err), 500)
+		return
+	}
+
+	if as != fn {
+		w.Header().Set("X-CBFS-Restored-As", as)
+	}
+	w.WriteHeader(201)
+}
+
+// What to do when a restored file already exists.
+type restoreConflict string
+
+const (
+	restoreSkip      = restoreConflict("skip")
+	restoreOverwrite = restoreConflict("overwrite")
+	restoreRename    = restoreConflict("rename")
+	// Skip, but replace older files; the same as skip with newer
+	restoreNewer = restoreConflict("newer")
+)
+
+// How many names rename tries before giving up.
+const maxRestoreRenames = 100
+
+func (c restoreConflict) valid() bool {
+	switch c {
+	case "", restoreSkip, restoreOverwrite, restoreRename, restoreNewer:
+		return true
+	}
+	return false
+}
+
+// The name the nth rename of a restored file gets.
+func restoredName(fn string, n int) string {
+	if n == 1 {
+		return fn + ".restored"
+	}
+	return fmt.Sprintf("%v.restored.%v", fn, n)
+}
+
+// Make an older revision of a file current, keeping only the
+// revisions before it.
+func pickRevision(fm fileMeta, revno int) (fileMeta, error) {
+	if revno == fm.Revno {
+		return fm, nil
+	}
+	for _, p := range fm.Previous {
+		if p.Revno != revno {
+			continue
+		}
+		rv := fm
+		rv.Headers = p.Headers
+		rv.OID = p.OID
+		rv.Length = p.Length
+		rv.Modified = p.Modified
+		rv.Revno = p.Revno
+		rv.Previous = nil
+		for _, o := range fm.Previous {
+			if o.Revno < revno {
+				rv.Previous = append(rv.Previous, o)
+			}
+		}
+		return rv, nil
+	}
+	return fm, fmt.Errorf("no revision %v of %v", revno, fm.Name)
+}
+
+// Store a restored file under fn or, if the policy says so, another
+// name.  With newer, an older existing file isn't a conflict and is
+// replaced; the policy decides what happens to the rest.
+func resolveRestore(fn string, policy restoreConflict, newer bool,
+	storeNewer func(k string) error,
+	store func(k string, force bool) error) (string, error) {
+
+	if newer {
+		err := storeNewer(fn)
+		if err != errExists ||
+			(policy != restoreOverwrite && policy != restoreRename) {
+			return fn, err
+		}
+	}
+
+	switch policy {
+	case restoreOverwrite:
+		return fn, store(fn, true)
+	case restoreRename:
+		as := fn
+		err := store(as, false)
+		for n := 1; err == errExists && n <= maxRestoreRenames; n++ {
+			as = restoredName(fn, n)
+			err = store(as, false)
+		}
+		return as, err
+	}
+	return fn, store(fn, false)
+}
+
+// Restore a file from a backup, returning the name it was stored
+// under.  An expiration of -1 uses the one the file was stored with.
+func restoreMeta(fn string, fm fileMeta, exp int,
+	policy restoreConflict, newer bool) (string, error) {
+
+	_, err := referenceBlob(fm.OID)
 	if err != nil {
 		log.Printf("Missing blob %v while restoring %v - restoring anyway",
 			fm.OID, fn)
 	}
 
-	exp := getExpiration(req.Header)
 	if exp == -1 {
 		exp = getExpiration(fm.Headers)
 		if exp > 0 && exp < 60*60*24*30 {
@@ -324,28 +535,27 @@ func doRestoreDocument(w http.ResponseWriter, req *http.Request, fn string) {
 
 	if exp < 0 {
 		log.Printf("Attempt to restore expired file: %v", fn)
-		w.WriteHeader(201)
-		return
-	}
-
-	force := false
-	err = maybeStoreMeta(fn, fm, exp, force)
+		return fn, nil
+	}
+
+	as, err := resolveRestore(fn, policy, newer,
+		func(fn string) error {
+			k, m := metaFor(fn, fm)
+			return storeNewerMeta(k, m, exp)
+		},
+		func(fn string, force bool) error {
+			k, m := metaFor(fn, fm)
+			return maybeStoreMeta(k, m, exp, force)
+		})
 	switch err {
 	case errExists:
-		http.Error(w, err.Error(), 409)
-		return
 	case nil:
+		log.Printf("Restored %v -> %v (exp=%v)", as, fm.OID, exp)
 	default:
-		log.Printf("Error storing file meta of %v -> %v: %v",
-			fn, fm.OID, err)
-		http.Error(w,
-			fmt.Sprintf("Error recording file meta: %v", err), 500)
-		return
+		mainLog.Errorf("Error storing file meta of %v -> %v: %v",
+			as, fm.OID, err)
 	}
-
-	log.Printf("Restored %v -> %v (exp=%v)", fn, fm.OID, exp)
-
-	w.WriteHeader(201)
+	return as, err
 }
 
 func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
@@ -375,8 +585,10 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 		}{}
 
 		err := d.Decode(&ob)
-		switch err {
-		case nil:
+		switch {
+		case err == nil && ob.Meta.OID == "":
+			// A deletion in an incremental backup
+		case err == nil:
 			oid, err := hex.DecodeString(ob.Meta.OID)
 			if err != nil {
 				return nil, visited, err
@@ -395,7 +607,7 @@ func loadBackupHashes(oid string) (*hashset.Hashset, int, error) {
 				rv.Add(oid)
 				visited++
 			}
-		case io.EOF:
+		case err == io.EOF:
 			return rv, visited, nil
 		default:
 			return nil, visited, err
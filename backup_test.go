@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickRevision(t *testing.T) {
+	t0 := time.Unix(1000000, 0)
+	fm := fileMeta{
+		Name:     "f",
+		OID:      "c3",
+		Length:   3,
+		Modified: t0.Add(3 * time.Hour),
+		Revno:    3,
+		Previous: []prevMeta{
+			{OID: "c1", Length: 1, Modified: t0.Add(time.Hour), Revno: 1},
+			{OID: "c2", Length: 2, Modified: t0.Add(2 * time.Hour), Revno: 2},
+		},
+	}
+
+	got, err := pickRevision(fm, 3)
+	if err != nil || got.OID != "c3" || len(got.Previous) != 2 {
+		t.Errorf("Expected the current revision unchanged, got %+v/%v", got, err)
+	}
+
+	got, err = pickRevision(fm, 2)
+	if err != nil {
+		t.Fatalf("Error picking revision 2: %v", err)
+	}
+	if got.OID != "c2" || got.Length != 2 || got.Revno != 2 ||
+		!got.Modified.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("Expected revision 2 current, got %+v", got)
+	}
+	if len(got.Previous) != 1 || got.Previous[0].Revno != 1 {
+		t.Errorf("Expected only revision 1 before it, got %+v", got.Previous)
+	}
+
+	if _, err := pickRevision(fm, 7); err == nil {
+		t.Errorf("Expected an error picking a missing revision")
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	for _, c := range []string{"", "skip", "overwrite", "rename", "newer"} {
+		if !restoreConflict(c).valid() {
+			t.Errorf("Expected %q to be a valid policy", c)
+		}
+	}
+	if restoreConflict("clobber").valid() {
+		t.Errorf("Expected clobber to be invalid")
+	}
+
+	if got := restoredName("a/b.txt", 1); got != "a/b.txt.restored" {
+		t.Errorf("First rename = %v", got)
+	}
+	if got := restoredName("a/b.txt", 2); got != "a/b.txt.restored.2" {
+		t.Errorf("Second rename = %v", got)
+	}
+}
+
+func TestResolveRestore(t *testing.T) {
+	tests := []struct {
+		policy  restoreConflict
+		newer   bool
+		exists  bool
+		isNewer bool // the existing file is newer than the restored one
+		as      string
+		err     error
+	}{
+		{restoreSkip, false, false, false, "f", nil},
+		{restoreSkip, false, true, false, "f", errExists},
+		{restoreSkip, true, true, false, "f", nil},
+		{restoreSkip, true, true, true, "f", errExists},
+		{restoreOverwrite, false, true, true, "f", nil},
+		{restoreOverwrite, true, true, true, "f", nil},
+		{restoreRename, false, true, false, "f.restored", nil},
+		{restoreRename, true, true, false, "f", nil},
+		{restoreRename, true, true, true, "f.restored", nil},
+	}
+	for _, test := range tests {
+		stored := map[string]bool{}
+		if test.exists {
+			stored["f"] = false
+		}
+		storeNewer := func(k string) error {
+			if _, ok := stored[k]; ok && test.isNewer {
+				return errExists
+			}
+			stored[k] = true
+			return nil
+		}
+		store := func(k string, force bool) error {
+			if _, ok := stored[k]; ok && !force {
+				return errExists
+			}
+			stored[k] = true
+			return nil
+		}
+
+		as, err := resolveRestore("f", test.policy, test.newer, storeNewer, store)
+		if as != test.as || err != test.err {
+			t.Errorf("%v newer=%v exists=%v isNewer=%v: expected %v/%v, got %v/%v",
+				test.policy, test.newer, test.exists, test.isNewer,
+				test.as, test.err, as, err)
+		}
+		if err == nil && !stored[as] {
+			t.Errorf("%v newer=%v: expected %v to be stored",
+				test.policy, test.newer, as)
+		}
+	}
+}
+
+func TestMetaFor(t *testing.T) {
+	long := strings.Repeat("d/", 130) + "f"
+	tests := []struct {
+		fn, name string
+		long     bool
+	}{
+		{"a/b", "", false},
+		{long, long, true},
+		{"restored/" + long[:245], "restored/" + long[:245], true},
+	}
+	for _, test := range tests {
+		// Meta from a backup may carry the name it was stored under.
+		k, fm := metaFor(test.fn, fileMeta{Name: "old/" + long, OID: "x"})
+		if test.long != (k != test.fn) || k != shortName(test.fn) ||
+			len(k) > maxFilename {
+			t.Errorf("Unexpected key for %q: %q", test.fn, k)
+		}
+		if fm.Name != test.name || fm.OID != "x" {
+			t.Errorf("Expected name %q for %q, got %q",
+				test.name, test.fn, fm.Name)
+		}
+	}
+}
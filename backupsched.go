@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/cbfs/backupstore"
+	"github.com/couchbaselabs/cbfs/trace"
+)
+
+// Name a scheduled backup taken at t.
+func scheduledBackupName(prefix string, t time.Time) string {
+	return path.Join(strings.TrimLeft(prefix, "/"),
+		"cbfs-"+t.UTC().Format("20060102T150405Z")+".json.gz")
+}
+
+// Take a backup and prune old ones, if scheduled backups are on.
+func scheduledBackup(ctx context.Context) error {
+	if globalConfig.BackupPrefix == "" {
+		return nil
+	}
+
+	var t cbfsbackupstore.Target
+	if spec := globalConfig.BackupTarget; spec != "" {
+		var err error
+		t, err = openDataTarget(spec, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	fn := scheduledBackupName(globalConfig.BackupPrefix, time.Now())
+	if err := runBackup(ctx, fn, nil, t); err != nil {
+		return fmt.Errorf("backing up to %v: %v", fn, err)
+	}
+
+	sp := cbfstrace.FromContext(ctx).Start("prune")
+	removed, err := pruneBackups(ctx, t)
+	sp.End()
+	progressOf(ctx).acted(removed)
+	progressOf(ctx).summarize("backed up to %v, removed %v old backups",
+		fn, removed)
+	return err
+}
+
+// Pick the backups a grandfather-father-son policy keeps: the newest
+// in each of the latest daily days, weekly weeks and monthly months
+// that have any, the latest backup, and whatever those build on.
+func gfsKeep(bs []backupItem, daily, weekly, monthly int) map[string]bool {
+	sorted := append([]backupItem{}, bs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].When.After(sorted[j].When)
+	})
+
+	keep := map[string]bool{}
+	if len(sorted) > 0 {
+		keep[sorted[0].Fn] = true
+	}
+	period := func(n int, key func(time.Time) string) {
+		seen := map[string]bool{}
+		for _, b := range sorted {
+			k := key(b.When.UTC())
+			if seen[k] {
+				continue
+			}
+			if len(seen) >= n {
+				break
+			}
+			seen[k] = true
+			keep[b.Fn] = true
+		}
+	}
+	period(daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	period(weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%v-W%v", y, w)
+	})
+	period(monthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	byName := map[string]backupItem{}
+	for _, b := range bs {
+		byName[b.Fn] = b
+	}
+	kept := []string{}
+	for fn := range keep {
+		kept = append(kept, fn)
+	}
+	for _, fn := range kept {
+		for base := byName[fn].Base; base != "" && !keep[base]; base = byName[base].Base {
+			keep[base] = true
+		}
+	}
+	return keep
+}
+
+// Remove the backups the retention policy doesn't keep, from the
+// cluster and from the data target if there is one.
+func pruneBackups(ctx context.Context, t cbfsbackupstore.Target) (int, error) {
+	c := globalConfig
+	if c.BackupKeepDaily+c.BackupKeepWeekly+c.BackupKeepMonthly == 0 {
+		return 0, nil
+	}
+
+	b := backups{}
+	err := couchbase.Get(backupKey, &b)
+	if err != nil {
+		if gomemcached.IsNotFound(err) {
+			err = nil
+		}
+		return 0, err
+	}
+	removeDeadBackups(&b)
+
+	keep := gfsKeep(b.Backups, c.BackupKeepDaily, c.BackupKeepWeekly,
+		c.BackupKeepMonthly)
+	removed := map[string]bool{}
+	for _, bi := range b.Backups {
+		if keep[bi.Fn] {
+			continue
+		}
+		if err := checkFence(ctx); err != nil {
+			return len(removed), err
+		}
+		err := couchbase.Delete(shortName(bi.Fn))
+		if err != nil && !gomemcached.IsNotFound(err) {
+			log.Printf("Error removing old backup %v: %v", bi.Fn, err)
+			continue
+		}
+		if err := recordTombstone(bi.Fn); err != nil {
+			log.Printf("Error recording deletion of %v: %v", bi.Fn, err)
+		}
+		log.Printf("Removed old backup %v from %v", bi.Fn, bi.When)
+		removed[bi.Fn] = true
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	err = couchbase.Update(backupKey, 0, func(in []byte) ([]byte, error) {
+		current := backups{}
+		if err := json.Unmarshal(in, &current); err != nil {
+			return nil, cb.UpdateCancel
+		}
+		kept := current.Backups[:0]
+		for _, bi := range current.Backups {
+			if !removed[bi.Fn] {
+				kept = append(kept, bi)
+			}
+		}
+		current.Backups = kept
+		return json.Marshal(current)
+	})
+	if err != nil && err != cb.UpdateCancel {
+		return len(removed), err
+	}
+
+	// Let garbage collection have what only they referred to.
+	if err := recordBackupObject(); err != nil {
+		log.Printf("Failed to record backup OID: %v", err)
+	}
+	go recordRemoteBackupObjects()
+
+	if t != nil {
+		if err := checkFence(ctx); err != nil {
+			return len(removed), err
+		}
+		names := []string{}
+		for fn := range removed {
+			names = append(names, fn)
+		}
+		pruned, err := cbfsbackupstore.Prune(t, names)
+		if err != nil {
+			return len(removed), fmt.Errorf("pruning %v: %v", t, err)
+		}
+		log.Printf("Removed %v old backups from %v", len(pruned), t)
+	}
+
+	return len(removed), nil
+}
+
+// How long ago the latest backup was taken, and whether that's too
+// long ago for scheduled backups.
+func backupAge(b backups) (time.Duration, bool) {
+	var age time.Duration
+	if !b.Latest.When.IsZero() {
+		age = time.Since(b.Latest.When)
+	}
+	stale := globalConfig.BackupPrefix != "" && globalConfig.BackupMaxAge > 0 &&
+		(b.Latest.When.IsZero() || age > globalConfig.BackupMaxAge)
+	return age, stale
+}
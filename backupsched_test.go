@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestScheduledBackupName(t *testing.T) {
+	at := time.Date(2026, 10, 1, 2, 30, 0, 0, time.UTC)
+	for _, prefix := range []string{"backups", "/backups/", "backups/"} {
+		got := scheduledBackupName(prefix, at)
+		if got != "backups/cbfs-20261001T023000Z.json.gz" {
+			t.Errorf("Name under %q = %v", prefix, got)
+		}
+	}
+}
+
+func TestGFSKeep(t *testing.T) {
+	// Daily backups at 02:00 for 90 days up to Sunday 2026-10-18,
+	// plus an extra one on the last day.
+	end := time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC)
+	bs := []backupItem{}
+	for i := 0; i < 90; i++ {
+		when := end.AddDate(0, 0, -i)
+		bs = append(bs, backupItem{Fn: when.Format("2006-01-02"), When: when})
+	}
+	bs = append(bs, backupItem{Fn: "extra", When: end.Add(time.Hour)})
+
+	keep := gfsKeep(bs, 7, 4, 3)
+
+	exp := []string{
+		"extra",
+		// Daily, besides the 18th, whose newest is extra
+		"2026-10-17", "2026-10-16", "2026-10-15", "2026-10-14",
+		"2026-10-13", "2026-10-12",
+		// The Sundays ending the three weeks before
+		"2026-10-11", "2026-10-04", "2026-09-27",
+		// Month ends
+		"2026-09-30", "2026-08-31",
+	}
+	for _, fn := range exp {
+		if !keep[fn] {
+			t.Errorf("Expected to keep %v", fn)
+		}
+	}
+	if len(keep) != len(exp) {
+		t.Errorf("Expected to keep %v backups, kept %v: %v",
+			len(exp), len(keep), keep)
+	}
+}
+
+func TestGFSKeepBases(t *testing.T) {
+	t0 := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	bs := []backupItem{{Fn: "full", When: t0}}
+	for i := 1; i <= 5; i++ {
+		bs = append(bs, backupItem{Fn: fmt.Sprintf("incr%v", i),
+			When: t0.AddDate(0, 0, i), Base: bs[i-1].Fn})
+	}
+
+	keep := gfsKeep(bs, 1, 0, 0)
+	for _, b := range bs {
+		if !keep[b.Fn] {
+			t.Errorf("Expected %v to be kept for the latest increment", b.Fn)
+		}
+	}
+
+	if keep := gfsKeep(nil, 7, 4, 12); len(keep) != 0 {
+		t.Errorf("Expected nothing to keep from nothing, got %v", keep)
+	}
+}
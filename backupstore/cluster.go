@@ -0,0 +1,134 @@
+package cbfsbackupstore
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/dustin/httputil"
+)
+
+type clusterTarget struct {
+	c      *cbfsclient.Client
+	u      string
+	prefix string
+}
+
+// A target under a path in another cbfs cluster.  Blobs are stored
+// as files named by their hash, so the other cluster keeps them
+// referenced.
+func NewCluster(u string) (Target, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cbfsclient.New(u)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(pu.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return clusterTarget{c, u, prefix}, nil
+}
+
+func (c clusterTarget) blobName(oid string) string {
+	return c.prefix + "blobs/" + oid
+}
+
+// Names are used as paths as they are, so escape anything that
+// isn't a path separator.
+func escapePath(name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+func (c clusterTarget) HasBlob(oid string) (bool, error) {
+	res, err := http.Head(c.c.URLFor(escapePath(c.blobName(oid))))
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, httputil.HTTPErrorf(res, "checking for %v - %S", oid)
+}
+
+func (c clusterTarget) PutBlob(oid string, r io.Reader) error {
+	return c.c.Put("", escapePath(c.blobName(oid)), r, cbfsclient.PutOptions{
+		Hash:        oid,
+		ContentType: "application/octet-stream",
+	})
+}
+
+func (c clusterTarget) get(name string) (io.ReadCloser, error) {
+	res, err := http.Get(c.c.URLFor(escapePath(name)))
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case 200:
+		return res.Body, nil
+	case 404:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, httputil.HTTPErrorf(res, "fetching %v - %S\n%B", name)
+}
+
+func (c clusterTarget) GetBlob(oid string) (io.ReadCloser, error) {
+	return c.get(c.blobName(oid))
+}
+
+func (c clusterTarget) Put(name string, r io.Reader) error {
+	return c.c.Put(name, escapePath(c.prefix+name), r, cbfsclient.PutOptions{})
+}
+
+func (c clusterTarget) Get(name string) (io.ReadCloser, error) {
+	return c.get(c.prefix + name)
+}
+
+func (c clusterTarget) List(dir string) ([]string, error) {
+	l, err := c.c.ListOrEmpty(c.prefix + dir)
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for fn := range l.Files {
+		rv = append(rv, fn)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func (c clusterTarget) remove(name string) error {
+	err := c.c.Rm(escapePath(name))
+	if err == cbfsclient.Missing {
+		err = nil
+	}
+	return err
+}
+
+func (c clusterTarget) Remove(name string) error {
+	return c.remove(c.prefix + name)
+}
+
+func (c clusterTarget) RemoveBlob(oid string) error {
+	return c.remove(c.blobName(oid))
+}
+
+func (c clusterTarget) String() string {
+	return c.u
+}
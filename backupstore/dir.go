@@ -0,0 +1,120 @@
+package cbfsbackupstore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type dirTarget struct {
+	root string
+}
+
+// A target in a local directory.  Blobs are spread over
+// subdirectories by the first two characters of their hash.
+func NewDir(root string) (Target, error) {
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return nil, err
+	}
+	return dirTarget{root}, nil
+}
+
+func (d dirTarget) blobPath(oid string) string {
+	if len(oid) < 3 {
+		return filepath.Join(d.root, "blobs", oid)
+	}
+	return filepath.Join(d.root, "blobs", oid[:2], oid)
+}
+
+func notFound(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Write to a temp file and rename it into place, so partial writes
+// are never seen.
+func (d dirTarget) write(fn string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0777); err != nil {
+		return err
+	}
+	tmpf, err := ioutil.TempFile(filepath.Dir(fn), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmpf, r)
+	if e := tmpf.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpf.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(tmpf.Name())
+	}
+	return err
+}
+
+func (d dirTarget) HasBlob(oid string) (bool, error) {
+	_, err := os.Stat(d.blobPath(oid))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d dirTarget) PutBlob(oid string, r io.Reader) error {
+	return d.write(d.blobPath(oid), r)
+}
+
+func (d dirTarget) GetBlob(oid string) (io.ReadCloser, error) {
+	f, err := os.Open(d.blobPath(oid))
+	return f, notFound(err)
+}
+
+func (d dirTarget) Put(name string, r io.Reader) error {
+	return d.write(filepath.Join(d.root, filepath.FromSlash(name)), r)
+}
+
+func (d dirTarget) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+	return f, notFound(err)
+}
+
+func (d dirTarget) List(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(d.root, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && fi.Name()[0] != '.' {
+			rv = append(rv, fi.Name())
+		}
+	}
+	return rv, nil
+}
+
+func ignoreMissing(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d dirTarget) Remove(name string) error {
+	return ignoreMissing(os.Remove(filepath.Join(d.root, filepath.FromSlash(name))))
+}
+
+func (d dirTarget) RemoveBlob(oid string) error {
+	return ignoreMissing(os.Remove(d.blobPath(oid)))
+}
+
+func (d dirTarget) String() string {
+	return "file://" + d.root
+}
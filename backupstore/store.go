@@ -0,0 +1,254 @@
+// Package cbfsbackupstore keeps full backups of a cbfs cluster, blob
+// contents included, somewhere outside the cluster.
+package cbfsbackupstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returned when something isn't in a target.
+var ErrNotFound = errors.New("not found")
+
+// A place to keep backups.
+//
+// Blobs are named by their hash, so a blob already stored by an
+// earlier backup is never copied again.  Other files (metadata
+// dumps, manifests) are stored by name.
+type Target interface {
+	// Whether the blob is already stored.
+	HasBlob(oid string) (bool, error)
+	// Store a blob.  Nothing is kept if reading r fails.
+	PutBlob(oid string, r io.Reader) error
+	// Read a blob back.
+	GetBlob(oid string) (io.ReadCloser, error)
+	// Store a named file.
+	Put(name string, r io.Reader) error
+	// Read a named file back.
+	Get(name string) (io.ReadCloser, error)
+	// List the files in the named directory.
+	List(dir string) ([]string, error)
+	// Remove a named file.  It's not an error if it isn't there.
+	Remove(name string) error
+	// Remove a blob, likewise.
+	RemoveBlob(oid string) error
+	// Describe the target.
+	String() string
+}
+
+// Open a target from a spec: a local directory (an absolute path or
+// a file:// URL), or an http:// URL into another cbfs cluster.
+func Open(spec string) (Target, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://"),
+		strings.HasPrefix(spec, "https://"):
+		return NewCluster(spec)
+	case strings.HasPrefix(spec, "file://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return NewDir(u.Path)
+	case strings.HasPrefix(spec, "/"):
+		return NewDir(spec)
+	}
+	return nil, fmt.Errorf("unrecognized backup target: %q", spec)
+}
+
+// A blob referred to by a backup.
+type Blob struct {
+	OID    string `json:"oid"`
+	Length int64  `json:"length"`
+}
+
+// Describes one backup in a target.  It's written once everything
+// it mentions is stored, so a backup without a manifest is
+// incomplete.
+type Manifest struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Hash algorithm the blobs are named with
+	Hash string `json:"hash"`
+	// The metadata backup, itself stored as a blob
+	Meta Blob `json:"meta"`
+	// The backup an incremental backup builds on
+	Base  string `json:"base,omitempty"`
+	Blobs []Blob `json:"blobs"`
+	Bytes int64  `json:"bytes"`
+	// Blobs this backup had to copy (the rest were already there)
+	Copied int `json:"copied"`
+}
+
+const manifestDir = "manifests"
+
+func manifestName(name string) string {
+	return manifestDir + "/" + url.QueryEscape(name) + ".json"
+}
+
+// Record a completed backup.
+func PutManifest(t Target, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return t.Put(manifestName(m.Name), strings.NewReader(string(data)))
+}
+
+// Read the manifest of the named backup.
+func GetManifest(t Target, name string) (Manifest, error) {
+	m := Manifest{}
+	r, err := t.Get(manifestName(name))
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(&m)
+	return m, err
+}
+
+// List the completed backups in a target.
+func Manifests(t Target) ([]string, error) {
+	files, err := t.List(manifestDir)
+	if err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".json") {
+			continue
+		}
+		n, err := url.QueryUnescape(strings.TrimSuffix(f, ".json"))
+		if err == nil {
+			rv = append(rv, n)
+		}
+	}
+	return rv, nil
+}
+
+// Remove the named backups and the blobs nothing else uses.  Backups
+// another backup still builds on are kept.  Returns the backups
+// removed.
+func Prune(t Target, names []string) ([]string, error) {
+	all, err := Manifests(t)
+	if err != nil {
+		return nil, err
+	}
+	ms := map[string]Manifest{}
+	for _, n := range all {
+		// Missing a manifest could mean removing a blob it needs.
+		if ms[n], err = GetManifest(t, n); err != nil {
+			return nil, fmt.Errorf("reading manifest of %v: %v", n, err)
+		}
+	}
+
+	drop := map[string]bool{}
+	for _, n := range names {
+		if _, ok := ms[n]; ok {
+			drop[n] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for n, m := range ms {
+			if !drop[n] && drop[m.Base] {
+				delete(drop, m.Base)
+				changed = true
+			}
+		}
+	}
+
+	used := map[string]bool{}
+	for n, m := range ms {
+		if !drop[n] {
+			used[m.Meta.OID] = true
+			for _, b := range m.Blobs {
+				used[b.OID] = true
+			}
+		}
+	}
+
+	removed := []string{}
+	for n := range drop {
+		removed = append(removed, n)
+	}
+	sort.Strings(removed)
+
+	// Manifests go first so no backup is ever missing blobs.
+	for _, n := range removed {
+		if err := t.Remove(manifestName(n)); err != nil {
+			return nil, err
+		}
+	}
+	for _, n := range removed {
+		m := ms[n]
+		for _, b := range append(m.Blobs, m.Meta) {
+			if b.OID == "" || used[b.OID] {
+				continue
+			}
+			if err := t.RemoveBlob(b.OID); err != nil {
+				return removed, err
+			}
+			used[b.OID] = true
+		}
+	}
+	return removed, nil
+}
+
+// Find the manifests a backup builds on, oldest first.
+func Chain(t Target, name string) ([]Manifest, error) {
+	rv := []Manifest{}
+	seen := map[string]bool{}
+	for name != "" {
+		if seen[name] {
+			return nil, fmt.Errorf("backup %v builds on itself", name)
+		}
+		seen[name] = true
+		m, err := GetManifest(t, name)
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest of %v: %v", name, err)
+		}
+		rv = append([]Manifest{m}, rv...)
+		name = m.Base
+	}
+	return rv, nil
+}
+
+// Returned when content doesn't match its hash.
+type ErrCorrupt struct {
+	OID, Got string
+}
+
+func (e ErrCorrupt) Error() string {
+	return fmt.Sprintf("content of %v hashes to %v", e.OID, e.Got)
+}
+
+type verifier struct {
+	r   io.Reader
+	h   hash.Hash
+	oid string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); got != v.oid {
+			return n, ErrCorrupt{v.oid, got}
+		}
+	}
+	return n, err
+}
+
+// Wrap a reader so it fails at the end unless what was read hashes
+// to oid.
+func NewVerifier(r io.Reader, h hash.Hash, oid string) io.Reader {
+	return &verifier{r, h, oid}
+}
@@ -0,0 +1,182 @@
+package cbfsbackupstore
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func sha1hex(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"http://cbfs2:8484/backups/", true},
+		{"https://cbfs2/", true},
+		{"backups", false},
+		{"ftp://x/", false},
+	}
+	for _, test := range tests {
+		_, err := Open(test.spec)
+		if (err == nil) != test.ok {
+			t.Errorf("Opening %q: %v", test.spec, err)
+		}
+	}
+}
+
+func TestDirTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backupstore")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tg, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatalf("Error opening target: %v", err)
+	}
+
+	const content = "some content"
+	oid := sha1hex(content)
+
+	if has, err := tg.HasBlob(oid); has || err != nil {
+		t.Fatalf("Expected no blob yet, got %v/%v", has, err)
+	}
+
+	// A corrupt blob isn't kept.
+	err = tg.PutBlob(oid, NewVerifier(strings.NewReader("other content"),
+		sha1.New(), oid))
+	if _, ok := err.(ErrCorrupt); !ok {
+		t.Fatalf("Expected a corrupt blob to fail, got %v", err)
+	}
+	if has, _ := tg.HasBlob(oid); has {
+		t.Fatalf("Expected the corrupt blob to be discarded")
+	}
+
+	err = tg.PutBlob(oid, NewVerifier(strings.NewReader(content),
+		sha1.New(), oid))
+	if err != nil {
+		t.Fatalf("Error storing blob: %v", err)
+	}
+	if has, err := tg.HasBlob(oid); !has || err != nil {
+		t.Fatalf("Expected the blob, got %v/%v", has, err)
+	}
+	r, err := tg.GetBlob(oid)
+	if err != nil {
+		t.Fatalf("Error reading blob: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(got) != content {
+		t.Errorf("Expected %q, got %q/%v", content, got, err)
+	}
+
+	if _, err := tg.GetBlob(sha1hex("missing")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestManifests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backupstore")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tg, err := NewDir(dir)
+	if err != nil {
+		t.Fatalf("Error opening target: %v", err)
+	}
+
+	for _, m := range []Manifest{
+		{Name: "backups/full.json.gz", Hash: "sha1"},
+		{Name: "backups/incr1.json.gz", Base: "backups/full.json.gz"},
+		{Name: "backups/incr2.json.gz", Base: "backups/incr1.json.gz"},
+	} {
+		if err := PutManifest(tg, m); err != nil {
+			t.Fatalf("Error storing manifest: %v", err)
+		}
+	}
+
+	names, err := Manifests(tg)
+	if err != nil || len(names) != 3 {
+		t.Fatalf("Expected three manifests, got %v/%v", names, err)
+	}
+
+	chain, err := Chain(tg, "backups/incr2.json.gz")
+	if err != nil {
+		t.Fatalf("Error finding chain: %v", err)
+	}
+	exp := []string{"backups/full.json.gz", "backups/incr1.json.gz",
+		"backups/incr2.json.gz"}
+	if len(chain) != len(exp) {
+		t.Fatalf("Expected %v, got %+v", exp, chain)
+	}
+	for i, m := range chain {
+		if m.Name != exp[i] {
+			t.Errorf("Expected %v at %v, got %v", exp[i], i, m.Name)
+		}
+	}
+
+	if _, err := Chain(tg, "backups/missing"); err == nil {
+		t.Errorf("Expected an error finding a missing chain")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backupstore")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tg, err := NewDir(dir)
+	if err != nil {
+		t.Fatalf("Error opening target: %v", err)
+	}
+
+	blob := func(s string) Blob { return Blob{OID: sha1hex(s)} }
+	for _, s := range []string{"ma", "mb", "mc", "x", "y", "z", "w"} {
+		if err := tg.PutBlob(sha1hex(s), strings.NewReader(s)); err != nil {
+			t.Fatalf("Error storing blob: %v", err)
+		}
+	}
+	for _, m := range []Manifest{
+		{Name: "a", Meta: blob("ma"), Blobs: []Blob{blob("x"), blob("y")}},
+		{Name: "b", Base: "a", Meta: blob("mb"), Blobs: []Blob{blob("y"), blob("z")}},
+		{Name: "c", Meta: blob("mc"), Blobs: []Blob{blob("w")}},
+	} {
+		if err := PutManifest(tg, m); err != nil {
+			t.Fatalf("Error storing manifest: %v", err)
+		}
+	}
+
+	has := func(s string) bool {
+		ok, _ := tg.HasBlob(sha1hex(s))
+		return ok
+	}
+
+	// a stays, since b builds on it.
+	removed, err := Prune(tg, []string{"a", "c", "missing"})
+	if err != nil || strings.Join(removed, ",") != "c" {
+		t.Fatalf("Expected to remove c, got %v/%v", removed, err)
+	}
+	if has("w") || has("mc") || !has("x") || !has("y") || !has("z") {
+		t.Errorf("Expected only c's blobs to be removed")
+	}
+
+	removed, err = Prune(tg, []string{"a", "b"})
+	if err != nil || strings.Join(removed, ",") != "a,b" {
+		t.Fatalf("Expected to remove a and b, got %v/%v", removed, err)
+	}
+	names, _ := Manifests(tg)
+	if len(names) != 0 || has("x") || has("y") || has("z") || has("ma") {
+		t.Errorf("Expected everything to be removed, left %v", names)
+	}
+}
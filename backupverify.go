@@ -0,0 +1,283 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// One line of a backup file.
+type backupRecord struct {
+	Path    string    `json:"path"`
+	Meta    *fileMeta `json:"meta"`
+	Deleted string    `json:"deleted"`
+}
+
+// Something wrong with a backup.  Record is the line it was found on.
+type backupProblem struct {
+	Record  int    `json:"record"`
+	Path    string `json:"path,omitempty"`
+	OID     string `json:"oid,omitempty"`
+	Problem string `json:"problem"`
+}
+
+type backupVerifySummary struct {
+	Backup    string `json:"backup"`
+	OID       string `json:"oid"`
+	Records   int    `json:"records"`
+	Files     int    `json:"files"`
+	Deletions int    `json:"deletions"`
+	Blobs     int    `json:"blobs"`
+	Hashed    int    `json:"hashed"`
+	Problems  int    `json:"problems"`
+	OK        bool   `json:"ok"`
+}
+
+func validOID(oid string) bool {
+	h := getHash()
+	return validHash(oid) && (h == nil || len(oid) == 2*h.Size())
+}
+
+// Find what's structurally wrong with a backup record.
+func checkBackupRecord(r backupRecord) string {
+	switch {
+	case r.Path == "":
+		return "missing path"
+	case r.Meta != nil && r.Deleted != "":
+		return "both file and deletion"
+	case r.Deleted != "":
+		if _, err := time.Parse(time.RFC3339Nano, r.Deleted); err != nil {
+			return "invalid deletion time"
+		}
+		return ""
+	case r.Meta == nil:
+		return "neither file nor deletion"
+	case !validOID(r.Meta.OID):
+		return "invalid oid"
+	case r.Meta.Length < 0:
+		return "negative length"
+	case r.Meta.Modified.IsZero():
+		return "missing modification time"
+	}
+	for i, o := range r.Meta.Previous {
+		if !validOID(o.OID) {
+			return fmt.Sprintf("invalid oid in older revision %v", i)
+		}
+	}
+	return ""
+}
+
+// Find what's wrong with a blob a backup refers to.
+func checkBackupBlob(own BlobOwnership, found bool, length int64,
+	replicas int) string {
+
+	switch {
+	case !found:
+		return "blob missing"
+	case own.Garbage:
+		return "blob condemned by garbage collection"
+	case len(own.Nodes) < replicas:
+		return fmt.Sprintf("only %v of %v replicas", len(own.Nodes), replicas)
+	case own.Length != length:
+		return fmt.Sprintf("blob is %v bytes, backup says %v", own.Length, length)
+	}
+	return ""
+}
+
+// Read a blob from wherever it is and return what it hashes to.
+func hashBlob(oid string) (string, error) {
+	r, err := openBlob(oid, false, "")
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sh := getHash()
+	if _, err := io.Copy(sh, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sh.Sum(nil)), nil
+}
+
+type backupBlobRef struct {
+	record int
+	path   string
+	oid    string
+	length int64
+}
+
+// Check a backup's records and the blobs they refer to, passing each
+// problem found to report.  A fraction of the blobs (sample) are
+// read back and rehashed.
+func verifyBackup(bi backupItem, replicas int, sample float64,
+	report func(backupProblem)) (backupVerifySummary, error) {
+
+	sum := backupVerifySummary{Backup: bi.Fn, OID: bi.Oid}
+	problem := func(p backupProblem) {
+		sum.Problems++
+		report(p)
+	}
+
+	r := blobReader(bi.Oid)
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return sum, err
+	}
+	defer gz.Close()
+
+	// Each blob is only looked up and hashed once.
+	checked := map[string]string{}
+	pending := []backupBlobRef{}
+	flush := func() error {
+		oids := []string{}
+		for _, ref := range pending {
+			if _, ok := checked[ref.oid]; !ok {
+				oids = append(oids, ref.oid)
+			}
+		}
+		owners, err := getBlobs(oids)
+		if err != nil {
+			return err
+		}
+		for _, ref := range pending {
+			p, ok := checked[ref.oid]
+			if !ok {
+				own, found := owners[ref.oid]
+				p = checkBackupBlob(own, found, ref.length, replicas)
+				if p == "" && rand.Float64() < sample {
+					sum.Hashed++
+					h, err := hashBlob(ref.oid)
+					switch {
+					case err != nil:
+						p = fmt.Sprintf("error reading blob: %v", err)
+					case h != ref.oid:
+						p = fmt.Sprintf("blob content hashes to %v", h)
+					}
+				}
+				checked[ref.oid] = p
+				sum.Blobs++
+			}
+			if p != "" {
+				problem(backupProblem{ref.record, ref.path, ref.oid, p})
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	d := json.NewDecoder(gz)
+	for {
+		rec := backupRecord{}
+		err := d.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		sum.Records++
+		if err != nil {
+			// There's no finding the next record after this.
+			problem(backupProblem{Record: sum.Records,
+				Problem: fmt.Sprintf("corrupt record: %v", err)})
+			break
+		}
+		if p := checkBackupRecord(rec); p != "" {
+			problem(backupProblem{Record: sum.Records, Path: rec.Path,
+				Problem: p})
+			continue
+		}
+		if rec.Meta == nil {
+			sum.Deletions++
+			continue
+		}
+		sum.Files++
+		pending = append(pending, backupBlobRef{sum.Records, rec.Path,
+			rec.Meta.OID, rec.Meta.Length})
+		for _, o := range rec.Meta.Previous {
+			pending = append(pending, backupBlobRef{sum.Records, rec.Path,
+				o.OID, o.Length})
+		}
+		if len(pending) >= keysPerBatch {
+			if err := flush(); err != nil {
+				return sum, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return sum, err
+	}
+
+	sum.OK = sum.Problems == 0
+	return sum, nil
+}
+
+func findBackup(fn string) (backupItem, bool, error) {
+	b := backups{}
+	err := couchbase.Get(backupKey, &b)
+	if err != nil {
+		if gomemcached.IsNotFound(err) {
+			err = nil
+		}
+		return backupItem{}, false, err
+	}
+	removeDeadBackups(&b)
+	for _, bi := range b.Backups {
+		if bi.Fn == fn {
+			return bi, true, nil
+		}
+	}
+	return backupItem{}, false, nil
+}
+
+// Stream the problems with a backup as JSON lines, ending with a
+// summary.
+func doVerifyBackup(w http.ResponseWriter, req *http.Request) {
+	bi, found, err := findBackup(req.FormValue("fn"))
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+		return
+	case !found:
+		http.Error(w, "No such backup", 404)
+		return
+	}
+
+	replicas := globalConfig.MinReplicas
+	if s := req.FormValue("replicas"); s != "" {
+		replicas, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid replicas parameter", 400)
+			return
+		}
+	}
+	sample := 0.0
+	if s := req.FormValue("sample"); s != "" {
+		sample, err = strconv.ParseFloat(s, 64)
+		if err != nil || sample < 0 || sample > 1 {
+			http.Error(w, "sample must be between 0 and 1", 400)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+
+	e := json.NewEncoder(w)
+	sum, err := verifyBackup(bi, replicas, sample, func(p backupProblem) {
+		e.Encode(p)
+	})
+	if err != nil {
+		log.Printf("Error verifying backup %v: %v", bi.Fn, err)
+		e.Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("Verified backup %v: %+v", bi.Fn, sum)
+	e.Encode(map[string]interface{}{"summary": sum})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBackupRecord(t *testing.T) {
+	const oid = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	now := time.Now()
+	tests := []struct {
+		rec backupRecord
+		ok  bool
+	}{
+		{backupRecord{Path: "a", Meta: &fileMeta{OID: oid, Modified: now}}, true},
+		{backupRecord{Path: "a", Deleted: "2026-10-01T12:00:00Z"}, true},
+		{backupRecord{Meta: &fileMeta{OID: oid, Modified: now}}, false},
+		{backupRecord{Path: "a"}, false},
+		{backupRecord{Path: "a", Deleted: "yesterday"}, false},
+		{backupRecord{Path: "a", Deleted: "2026-10-01T12:00:00Z",
+			Meta: &fileMeta{OID: oid, Modified: now}}, false},
+		{backupRecord{Path: "a", Meta: &fileMeta{OID: "da39", Modified: now}}, false},
+		{backupRecord{Path: "a", Meta: &fileMeta{OID: oid}}, false},
+		{backupRecord{Path: "a", Meta: &fileMeta{OID: oid, Modified: now,
+			Length: -1}}, false},
+		{backupRecord{Path: "a", Meta: &fileMeta{OID: oid, Modified: now,
+			Previous: []prevMeta{{OID: "xyz"}}}}, false},
+	}
+	for _, test := range tests {
+		p := checkBackupRecord(test.rec)
+		if (p == "") != test.ok {
+			t.Errorf("Expected ok=%v for %+v, got %q", test.ok, test.rec, p)
+		}
+	}
+}
+
+func TestCheckBackupBlob(t *testing.T) {
+	nodes := map[string]time.Time{"n1": time.Now(), "n2": time.Now()}
+	tests := []struct {
+		own      BlobOwnership
+		found    bool
+		replicas int
+		ok       bool
+	}{
+		{BlobOwnership{Nodes: nodes, Length: 10}, true, 2, true},
+		{BlobOwnership{Nodes: nodes, Length: 10}, true, 3, false},
+		{BlobOwnership{}, false, 1, false},
+		{BlobOwnership{Nodes: nodes, Length: 10, Garbage: true}, true, 1, false},
+		{BlobOwnership{Nodes: nodes, Length: 11}, true, 1, false},
+	}
+	for _, test := range tests {
+		p := checkBackupBlob(test.own, test.found, 10, test.replicas)
+		if (p == "") != test.ok {
+			t.Errorf("Expected ok=%v for %+v/%v, got %q",
+				test.ok, test.own, test.replicas, p)
+		}
+	}
+}
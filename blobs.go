@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -27,6 +28,8 @@ type BlobOwnership struct {
 	Type       string               `json:"type"`
 	Garbage    bool                 `json:"garbage"`
 	Referenced time.Time            `json:"referenced"`
+	// Set while garbage collection finds nothing referring to it
+	Unreferenced *gcMark `json:"unreferenced,omitempty"`
 }
 
 type internodeCommand uint8
@@ -42,6 +45,10 @@ type internodeTask struct {
 	cmd      internodeCommand
 	oid      string
 	prevNode string
+	// The request that led to this, if any
+	reqID string
+	// The lease of the global task that queued this, if any
+	fence *lease
 }
 
 var taskWorkers = flag.Int("taskWorkers", 4,
@@ -162,7 +169,8 @@ func copyBlob(w io.Writer, oid string) error {
 	} else {
 		// Doing it remotely
 		c := captureResponseWriter{w: w, hdr: http.Header{}}
-		return getBlobFromRemote(&c, oid, http.Header{}, *cachePercentage)
+		return getBlobFromRemote(&c, oid, http.Header{}, *cachePercentage,
+			false, "")
 	}
 }
 
@@ -186,6 +194,7 @@ func recordBlobOwnership(h string, l int64, force bool) error {
 		ownership.OID = h
 		ownership.Length = l
 		ownership.Garbage = false
+		ownership.Unreferenced = nil
 		ownership.Type = "blob"
 		return json.Marshal(ownership)
 	})
@@ -213,6 +222,7 @@ func referenceBlob(h string) (rv BlobOwnership, err error) {
 		}
 		ownership.Referenced = time.Now()
 		ownership.Garbage = false
+		ownership.Unreferenced = nil
 		rv = ownership
 		req := &gomemcached.MCRequest{
 			Opcode:  gomemcached.SET,
@@ -228,45 +238,15 @@ func referenceBlob(h string) (rv BlobOwnership, err error) {
 	return
 }
 
-func markGarbage(h string) error {
-	k := "/" + h
-	return couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
-		res, err := mc.Get(vb, k)
-		if err != nil {
-			return err
-		}
-		ownership := BlobOwnership{}
-		err = json.Unmarshal(res.Body, &ownership)
-		if err != nil {
-			return err
-		}
-		t := ownership.latestReference()
-		if time.Since(t) < time.Minute*15 {
-			return errors.New("too soon")
-		}
-		ownership.Garbage = true
-		req := &gomemcached.MCRequest{
-			Opcode:  gomemcached.SET,
-			VBucket: vb,
-			Key:     []byte(k),
-			Cas:     res.Cas,
-			Opaque:  0,
-			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-			Body:    mustEncode(&ownership)}
-		_, err = mc.Send(req)
-		return err
-	})
-}
-
 func recordBlobAccess(h string) {
 	_, err := couchbase.Incr("/"+h+"/r", 1, 1, 0)
 	if err != nil {
-		log.Printf("Error incrementing counter for %v: %v", h, err)
+		replLog.Errorf("Error incrementing counter for %v: %v", h, err)
 	}
 
 	_, err = couchbase.Incr("/"+serverId+"/r", 1, 1, 0)
 	if err != nil {
-		log.Printf("Error incrementing node identifier: %v", err)
+		replLog.Errorf("Error incrementing node identifier: %v", err)
 	}
 }
 
@@ -287,7 +267,7 @@ func removeBlobOwnershipRecord(h, node string) int {
 		if err == nil {
 			delete(ownership.Nodes, node)
 		} else {
-			log.Printf("Error unmarhaling blob removal from %s for %v: %v",
+			replLog.Errorf("Error unmarhaling blob removal from %s for %v: %v",
 				in, h, err)
 			return nil, cb.UpdateCancel
 		}
@@ -344,7 +324,7 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 			}
 			delete(ownership.Nodes, serverId)
 		} else {
-			log.Printf("Error unmarhaling blob removal of %v from %s: %v",
+			replLog.Errorf("Error unmarhaling blob removal of %v from %s: %v",
 				h, in, err)
 			rv = err
 			return nil, cb.UpdateCancel
@@ -368,7 +348,9 @@ func maybeRemoveBlobOwnership(h string) (rv error) {
 	return
 }
 
-func increaseReplicaCount(oid string, length int64, by int) error {
+func increaseReplicaCount(oid string, length int64, by int,
+	reqID string) error {
+
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -378,13 +360,13 @@ func increaseReplicaCount(oid string, length int64, by int) error {
 		onto = onto[:by]
 	}
 	for _, n := range onto {
-		log.Printf("Asking %v to acquire %v", n, oid)
-		queueBlobAcquire(n, oid, "")
+		reqLog(replLog, reqID).Infof("Asking %v to acquire %v", n, oid)
+		queueBlobAcquire(n, oid, "", reqID)
 	}
 	return nil
 }
 
-func ensureMinimumReplicaCount() error {
+func ensureMinimumReplicaCount(ctx context.Context) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -429,16 +411,27 @@ func ensureMinimumReplicaCount() error {
 		return nil
 	}
 
+	progress := progressOf(ctx)
+	progress.setTotal(len(viewRes.Rows))
 	did := 0
 	for _, r := range viewRes.Rows {
+		if ctx.Err() != nil {
+			log.Printf("Stopped increasing replica count after %v items",
+				did)
+			return ctx.Err()
+		}
+		progress.scanned(1)
 		todo := globalConfig.MinReplicas - r.Key
 		if !salvageBlob(r.Id[1:], "", todo, nl) {
 			log.Printf("Queue is full ensuring min repl count")
 			break
 		}
+		progress.acted(1)
 		did++
 	}
 	log.Printf("Increased the replica count of %v items", did)
+	progress.summarize("Increased the replica count of %v of %v items",
+		did, len(viewRes.Rows))
 	return nil
 }
 
@@ -463,13 +456,13 @@ func pruneBlob(oid string, nodemap map[string]string, nl NodeList) {
 		}
 		remaining--
 		if sn, ok := nm[n]; ok {
-			queueBlobRemoval(sn, oid)
+			queueBlobRemoval(sn, oid, "")
 		}
 	}
 
 }
 
-func pruneExcessiveReplicas() error {
+func pruneExcessiveReplicas(ctx context.Context) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -510,8 +503,15 @@ func pruneExcessiveReplicas() error {
 			len(viewRes.Rows))
 	}
 
+	progress := progressOf(ctx)
+	progress.setTotal(len(viewRes.Rows))
 	for _, r := range viewRes.Rows {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		pruneBlob(r.Id[1:], r.Doc.Json.Nodes, nl)
+		progress.scanned(1)
+		progress.acted(1)
 	}
 	return nil
 }
@@ -523,46 +523,53 @@ func hasBlob(oid string) bool {
 
 var fetchLocks namedLock
 
-func performFetch(oid, prev string) {
+func performFetch(oid, prev, reqID string) error {
 	c := captureResponseWriter{w: ioutil.Discard, hdr: http.Header{}}
+	rlog := reqLog(replLog, reqID)
 
 	// If we already have it, we don't need it more.
 	st, err := os.Stat(hashFilename(*root, oid))
 	if err == nil {
 		err = recordBlobOwnership(oid, st.Size(), false)
 		if err != nil {
-			log.Printf("Error recording fetched blob %v: %v",
+			rlog.Errorf("Error recording fetched blob %v: %v",
 				oid, err)
 		}
-		return
+		return err
 	}
 
 	if fetchLocks.Lock(oid) {
 		defer fetchLocks.Unlock(oid)
-		err = getBlobFromRemote(&c, oid, http.Header{}, 100)
+		err = getBlobFromRemote(&c, oid, http.Header{}, 100, true, reqID)
 	} else {
-		log.Printf("Not fetching remote, already in progress.")
-		return
+		rlog.Debugf("Not fetching remote, already in progress.")
+		return nil
 	}
 
 	if err == nil && c.statusCode == 200 {
 		if prev != "" {
-			log.Printf("Removing ownership of %v from %v after takeover",
+			rlog.Infof("Removing ownership of %v from %v after takeover",
 				oid, prev)
 			n, err := findNode(prev)
 			if err != nil {
-				log.Printf("Error finding old node of %v: %v", oid, err)
+				rlog.Warnf("Error finding old node of %v: %v", oid, err)
 				removeBlobOwnershipRecord(oid, prev)
 			} else {
-				log.Printf("Requesting post-move blob removal of %v from %v",
+				rlog.Infof("Requesting post-move blob removal of %v from %v",
 					oid, n)
-				go queueBlobRemoval(n, oid)
+				n.name = prev
+				go queueBlobRemoval(n, oid, reqID)
 			}
 		}
-	} else {
-		log.Printf("Error grabbing remote object %v, got %v/%v",
-			oid, c.statusCode, err)
+		return nil
+	}
+
+	rlog.Errorf("Error grabbing remote object %v, got %v/%v",
+		oid, c.statusCode, err)
+	if err == nil {
+		err = fmt.Errorf("HTTP error fetching %v: %v", oid, c.statusCode)
 	}
+	return err
 }
 
 // Return false on unrecoverable errors (i.e. the internode queue is
@@ -572,7 +579,7 @@ func salvageBlob(oid, deadNode string, todo int, nl NodeList) bool {
 		NodeList{nl.named(deadNode)})
 
 	if len(candidates) == 0 {
-		log.Printf("Couldn't find a candidate for %v!", oid)
+		replLog.Warnf("Couldn't find a candidate for %v!", oid)
 	} else {
 		rv := true
 		for _, n := range candidates {
@@ -590,32 +597,54 @@ func salvageBlob(oid, deadNode string, todo int, nl NodeList) bool {
 	return true
 }
 
-var internodeTaskQueue chan internodeTask
+var internodeTaskQueue *taskQueue
 
-func internodeTaskWorker() {
-	for c := range internodeTaskQueue {
-		switch c.cmd {
-		case removeObjectCmd:
-			if err := c.node.deleteBlob(c.oid); err != nil {
-				log.Printf("Error deleting %v from %v: %v",
-					c.oid, c.node, err)
-				if c.node.IsDead() {
-					log.Printf("Node is dead, cleaning %v",
-						c.oid)
-					removeBlobOwnershipRecord(c.oid,
-						c.node.name)
-				}
-			}
-		case acquireObjectCmd:
-			if err := c.node.acquireBlob(c.oid, c.prevNode); err != nil {
-				log.Printf("Error requesting acquisition of %v from %v: %v",
-					c.oid, c.node, err)
+func runInternodeTask(c internodeTask) error {
+	rlog := reqLog(queueLog, c.reqID)
+	if err := c.fence.check(); err != nil {
+		if err == errLeaseFenced {
+			// Whoever holds the lease now decides what to do.
+			rlog.Warnf("Dropping %v of %v on %v: %v",
+				c.cmd, c.oid, c.node, err)
+		}
+		return err
+	}
+	switch c.cmd {
+	case removeObjectCmd:
+		err := c.node.deleteBlob(c.oid, c.reqID)
+		if err != nil {
+			rlog.Warnf("Error deleting %v from %v: %v",
+				c.oid, c.node, err)
+			if c.node.IsDead() {
+				rlog.Infof("Node is dead, cleaning %v",
+					c.oid)
+				removeBlobOwnershipRecord(c.oid,
+					c.node.name)
+				return nil
 			}
-		case fetchObjectCmd:
-			performFetch(c.oid, c.prevNode)
-		default:
-			log.Fatalf("Unhandled worker task: %v", c)
 		}
+		return err
+	case acquireObjectCmd:
+		err := c.node.acquireBlob(c.oid, c.prevNode, c.reqID)
+		if err != nil {
+			rlog.Warnf("Error requesting acquisition of %v from %v: %v",
+				c.oid, c.node, err)
+		}
+		return err
+	case fetchObjectCmd:
+		return performFetch(c.oid, c.prevNode, c.reqID)
+	}
+	log.Fatalf("Unhandled worker task: %v", c)
+	return nil
+}
+
+func internodeTaskWorker() {
+	for {
+		qt := internodeTaskQueue.next()
+		if qt == nil {
+			return
+		}
+		internodeTaskQueue.done(qt, runInternodeTask(qt.internodeTask))
 	}
 }
 
@@ -625,53 +654,72 @@ func initTaskQueueWorkers() {
 	}
 }
 
-func queueBlobRemoval(n StorageNode, oid string) {
-	internodeTaskQueue <- internodeTask{
-		node: n,
-		cmd:  removeObjectCmd,
-		oid:  oid,
-	}
+func queueBlobRemoval(n StorageNode, oid, reqID string) {
+	internodeTaskQueue.add(internodeTask{
+		node:  n,
+		cmd:   removeObjectCmd,
+		oid:   oid,
+		reqID: reqID,
+	}, true)
+}
+
+// Queue a removal for the global task running under ctx.  It's
+// dropped if the task's lease has since gone to a newer holder.
+func queueTaskBlobRemoval(ctx context.Context, n StorageNode, oid string) {
+	internodeTaskQueue.add(internodeTask{
+		node:  n,
+		cmd:   removeObjectCmd,
+		oid:   oid,
+		fence: leaseOf(ctx),
+	}, true)
+}
+
+// Queue a move for the global task running under ctx, like
+// queueTaskBlobRemoval.  Returns false if the queue is full and block
+// is false.
+func queueTaskBlobAcquire(ctx context.Context, n StorageNode, oid, prev string,
+	block bool) bool {
+
+	return internodeTaskQueue.add(internodeTask{
+		node:     n,
+		cmd:      acquireObjectCmd,
+		oid:      oid,
+		prevNode: prev,
+		fence:    leaseOf(ctx),
+	}, block)
 }
 
 // Ask a remote node to go get a blob
-func queueBlobAcquire(n StorageNode, oid string, prev string) {
-	internodeTaskQueue <- internodeTask{
+func queueBlobAcquire(n StorageNode, oid, prev, reqID string) {
+	internodeTaskQueue.add(internodeTask{
 		node:     n,
 		cmd:      acquireObjectCmd,
 		oid:      oid,
 		prevNode: prev,
-	}
+		reqID:    reqID,
+	}, true)
 }
 
 // Ask a remote node to go get a blob, return false if the queue is full
 func maybeQueueBlobAcquire(n StorageNode, oid string, prev string) bool {
-	select {
-	case internodeTaskQueue <- internodeTask{
+	return internodeTaskQueue.add(internodeTask{
 		node:     n,
 		cmd:      acquireObjectCmd,
 		oid:      oid,
 		prevNode: prev,
-	}:
-		return true
-	default:
-		return false
-	}
+	}, false)
 }
 
 // Ask this node to go get a blob.
 //
 // Returns false if queue is full and the request could not be queued.
-func maybeQueueBlobFetch(oid, prev string) bool {
-	select {
-	case internodeTaskQueue <- internodeTask{
+func maybeQueueBlobFetch(oid, prev, reqID string) bool {
+	return internodeTaskQueue.add(internodeTask{
 		cmd:      fetchObjectCmd,
 		oid:      oid,
 		prevNode: prev,
-	}:
-		return true
-	default:
-		return false
-	}
+		reqID:    reqID,
+	}, false)
 }
 
 type errNotLocal struct {
@@ -682,7 +730,7 @@ func (e errNotLocal) Error() string {
 	return fmt.Sprintf("non-local, try one of these: %v", e.urls)
 }
 
-func openBlob(oid string, localOnly bool) (io.ReadCloser, error) {
+func openBlob(oid string, localOnly bool, reqID string) (io.ReadCloser, error) {
 	f, err := openLocalBlob(oid)
 	if err == nil {
 		return f, err
@@ -702,7 +750,7 @@ func openBlob(oid string, localOnly bool) (io.ReadCloser, error) {
 		return nil, errNotLocal{nl.BlobURLs(oid)}
 	}
 
-	return openRemote(oid, bo.Length, *cachePercentage, nl)
+	return openRemote(oid, bo.Length, *cachePercentage, nl, false, reqID)
 }
 
 type readerClosers struct {
@@ -721,31 +769,55 @@ func (r *readerClosers) Close() (err error) {
 	return
 }
 
-func openRemote(oid string, l int64, cachePerc int, nl NodeList) (io.ReadCloser, error) {
-	for _, sid := range nl {
-		resp, err := sid.ClientForTransfer(l).Get(sid.BlobURL(oid))
+// Open a blob from the first remote node that can serve it.
+//
+// Background reads are throttled on both ends so replication doesn't
+// starve user requests.
+func openRemote(oid string, l int64, cachePerc int, nl NodeList,
+	background bool, reqID string) (io.ReadCloser, error) {
+
+	rlog := reqLog(replLog, reqID)
+
+	for _, sid := range nl.ranked() {
+		req, err := http.NewRequest("GET", sid.BlobURL(oid), nil)
 		if err != nil {
-			log.Printf("Error reading %s from node %v: %v",
+			return nil, err
+		}
+		if background {
+			req.Header.Set(backgroundHeader, "true")
+		}
+		setRequestID(req, reqID)
+
+		resp, err := nodeScorer.Do(sid.name, sid.ClientForTransfer(l),
+			req, globalConfig.ReadStallTimeout)
+		if err != nil {
+			rlog.Warnf("Error reading %s from node %v: %v",
 				oid, sid, err)
 			continue
 		}
 
 		if resp.StatusCode != 200 {
-			log.Printf("Error response %v from node %v getting %v",
+			rlog.Warnf("Error response %v from node %v getting %v",
 				resp.Status, sid, oid)
 			resp.Body.Close()
 			continue
 		}
 
+		body := io.ReadCloser(resp.Body)
+		if background {
+			body = &readerClosers{&throttledReader{resp.Body, bgRecvThrottle},
+				[]io.Closer{resp.Body}}
+		}
+
 		shouldCache := cachePerc == 100 || (cachePerc > rand.Intn(100) &&
 			availableSpace() > l)
 
 		if !shouldCache {
-			return resp.Body, nil
+			return body, nil
 		}
 
 		hw, err := NewHashRecord(*root, oid)
-		r := io.TeeReader(resp.Body, hw)
+		r := io.TeeReader(body, hw)
 		rv := &hwFinisher{r, hw, oid, l}
 		return &readerClosers{rv, []io.Closer{rv, resp.Body}}, nil
 	}
@@ -9,15 +9,23 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/couchbaselabs/cbfs/nodescore"
 	"github.com/dustin/httputil"
 )
 
+// How long to wait for a node to start responding before trying
+// another replica.
+const defaultStallTimeout = 5 * time.Second
+
 // A cbfs client.
 type Client struct {
-	u     string
-	pu    *url.URL
-	nodes map[string]StorageNode
+	u      string
+	pu     *url.URL
+	nodes  map[string]StorageNode
+	scorer *cbfsnodescore.Scorer
+	stall  time.Duration
 }
 
 // Construct a new cbfs client.
@@ -27,7 +35,24 @@ func New(u string) (*Client, error) {
 		return nil, err
 	}
 	uc.Path = "/"
-	return &Client{u: uc.String(), pu: uc}, nil
+	return &Client{u: uc.String(), pu: uc,
+		scorer: cbfsnodescore.New(""), stall: defaultStallTimeout}, nil
+}
+
+// Prefer nodes in the given zone when choosing where to read from.
+func (c *Client) SetZone(zone string) {
+	c.scorer.SetZone(zone)
+}
+
+// Set how long a read may wait for a node to respond before moving on
+// to another replica (0 waits forever).
+func (c *Client) SetStallTimeout(d time.Duration) {
+	c.stall = d
+}
+
+// The scorer tracking how well each node has been serving this client.
+func (c *Client) Scorer() *cbfsnodescore.Scorer {
+	return c.scorer
 }
 
 // Get the full URL for the given filename.
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"os"
 
 	"github.com/couchbaselabs/cbfs/config"
 	"github.com/dustin/httputil"
@@ -31,18 +32,44 @@ func (c Client) SetConfigParam(key, val string) error {
 		return err
 	}
 
-	data, err := json.Marshal(&conf)
+	return c.SetConfig(conf, "")
+}
+
+// Who's changing the config, for its history.
+func configUser() string {
+	u := os.Getenv("USER")
+	if u == "" {
+		u = "unknown"
+	}
+	if h, err := os.Hostname(); err == nil {
+		u += "@" + h
+	}
+	return u
+}
+
+// Replace the whole configuration.  The note is kept in the config
+// history.
+func (c Client) SetConfig(conf cbfsconfig.CBFSConfig, note string) error {
+	return putConfigDoc(c.confURL(), &conf, note)
+}
+
+// PUT some config, noting who's changing it.
+func putConfigDoc(u string, ob interface{}, note string) error {
+	data, err := json.Marshal(ob)
 	if err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", c.confURL(),
-		bytes.NewBuffer(data))
+	req, err := http.NewRequest("PUT", u, bytes.NewBuffer(data))
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CBFS-User", configUser())
+	if note != "" {
+		req.Header.Set("X-CBFS-Config-Note", note)
+	}
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -54,3 +81,21 @@ func (c Client) SetConfigParam(key, val string) error {
 	}
 	return nil
 }
+
+func (c Client) nodeConfURL(node string) string {
+	return c.URLFor(".cbfs/config/node/" + node)
+}
+
+// Get the parameters overridden for one node.
+func (c Client) GetNodeConfig(node string) (rv map[string]interface{}, err error) {
+	err = getJsonData(c.nodeConfURL(node), &rv)
+	return
+}
+
+// Replace the parameters overridden for one node.  The note is kept
+// in the config history.
+func (c Client) SetNodeConfig(node string, overrides map[string]interface{},
+	note string) error {
+
+	return putConfigDoc(c.nodeConfURL(node), overrides, note)
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/couchbaselabs/cbfs/nodescore"
 	"github.com/dustin/go-saturate"
 	"github.com/dustin/httputil"
 )
@@ -184,20 +184,64 @@ func (f *FileHandle) Meta() FileMeta {
 	return f.meta
 }
 
-func (f *FileHandle) randomUrl() (string, error) {
+// The nodes holding this file, best first.
+func (f *FileHandle) rankedNodes() ([]cbfsnodescore.Candidate, error) {
 	allnodes, err := f.c.Nodes()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	nodelist := []StorageNode{}
+	cands := []cbfsnodescore.Candidate{}
 	for k := range f.nodes {
 		if n, ok := allnodes[k]; ok {
-			nodelist = append(nodelist, n)
+			cands = append(cands,
+				cbfsnodescore.Candidate{Name: k, Zone: n.Zone})
 		}
 	}
+	if len(cands) == 0 {
+		return nil, fmt.Errorf("No known nodes hold %v", f.oid)
+	}
 
-	return nodelist[rand.Intn(len(nodelist))].BlobURL(f.oid), nil
+	return f.c.scorer.Rank(cands), nil
+}
+
+// Request (a range of) the blob from the best replica, failing over
+// to the others when one errors or stalls.
+func (f *FileHandle) openBlob(rng string, exp int) (*http.Response, error) {
+	nodes, err := f.rankedNodes()
+	if err != nil {
+		return nil, err
+	}
+	allnodes, err := f.c.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range nodes {
+		req, err := http.NewRequest("GET",
+			allnodes[n.Name].BlobURL(f.oid), nil)
+		if err != nil {
+			return nil, err
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+
+		res, err := f.c.scorer.Do(n.Name, http.DefaultClient, req,
+			f.c.stall)
+		if err != nil {
+			log.Printf("Error reading %v from %v: %v", f.oid, n.Name, err)
+			continue
+		}
+		if res.StatusCode != exp {
+			err = httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
+			res.Body.Close()
+			log.Printf("Error reading %v from %v: %v", f.oid, n.Name, err)
+			continue
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("Couldn't read %v from any of %v", f.oid, nodes)
 }
 
 func (f *FileHandle) Read(b []byte) (int, error) {
@@ -215,28 +259,16 @@ func (f *FileHandle) Close() error {
 
 // Implement io.WriterTo
 func (f *FileHandle) WriteTo(w io.Writer) (int64, error) {
-	u, err := f.randomUrl()
-	if err != nil {
-		return 0, err
-	}
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return 0, err
-	}
+	rng, exp := "", 200
 	if f.off > 0 {
-		req.Header.Set("Range",
-			fmt.Sprintf("bytes=%v-%v", f.off, f.length-1))
+		rng, exp = fmt.Sprintf("bytes=%v-%v", f.off, f.length-1), 206
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := f.openBlob(rng, exp)
 	if err != nil {
 		return 0, err
 	}
-
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return 0, httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
-	}
 
 	n, err := io.Copy(w, res.Body)
 	f.off += n
@@ -250,28 +282,15 @@ func (f *FileHandle) ReadAt(p []byte, off int64) (n int, err error) {
 		end = f.length
 	}
 
-	u, err := f.randomUrl()
-	if err != nil {
-		return 0, err
-	}
-
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return 0, err
-	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v", off, end-1))
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer res.Body.Close()
 	exp := 206
 	if off == 0 && end == f.length {
 		exp = 200
 	}
-	if res.StatusCode != exp {
-		return 0, httputil.HTTPErrorf(res, "Unexpected http response: %S\n%B")
+	res, err := f.openBlob(fmt.Sprintf("bytes=%v-%v", off, end-1), exp)
+	if err != nil {
+		return 0, err
 	}
+	defer res.Body.Close()
 
 	n, err = io.ReadFull(res.Body, p)
 	if err == io.ErrUnexpectedEOF {
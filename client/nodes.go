@@ -2,8 +2,9 @@ package cbfsclient
 
 import (
 	"fmt"
-	"math/rand"
 	"time"
+
+	"github.com/couchbaselabs/cbfs/nodescore"
 )
 
 // Representation of a storage node.
@@ -20,6 +21,8 @@ type StorageNode struct {
 	Size      int64
 	UptimeStr string `json:"uptime_str"`
 	Version   string
+	Zone      string
+	Leaving   bool
 }
 
 func (a StorageNode) BlobURL(h string) string {
@@ -59,18 +62,18 @@ func (c *Client) RandomNode() (string, StorageNode, error) {
 		return "", StorageNode{}, err
 	}
 
-	nodes := make([]string, 0, len(nodeMap))
+	nodes := make([]cbfsnodescore.Candidate, 0, len(nodeMap))
 	for k, node := range nodeMap {
-		if !stale(node.HBAgeStr) {
-			nodes = append(nodes, k)
+		if !stale(node.HBAgeStr) && !node.Leaving {
+			nodes = append(nodes,
+				cbfsnodescore.Candidate{Name: k, Zone: node.Zone})
 		}
 	}
 
-	if len(nodes) == 0 {
+	picked, ok := c.scorer.Pick(nodes)
+	if !ok {
 		return "", StorageNode{}, fmt.Errorf("No nodes available")
 	}
 
-	name := nodes[rand.Intn(len(nodes))]
-
-	return name, nodeMap[name], nil
+	return picked.Name, nodeMap[picked.Name], nil
 }
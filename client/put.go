@@ -16,6 +16,9 @@ import (
 type PutOptions struct {
 	// If true, do a fast, unsafe store
 	Unsafe bool
+	// Number of copies to confirm before returning (0 for the
+	// cluster default)
+	WriteQuorum int
 	// Expiration time
 	Expiration int
 	// Hash to verify ("" for no verification)
@@ -114,6 +117,10 @@ func (c Client) Put(srcname, dest string, r io.Reader, opts PutOptions) error {
 	if opts.Unsafe {
 		preq.Header.Set("X-CBFS-Unsafe", "true")
 	}
+	if opts.WriteQuorum > 0 {
+		preq.Header.Set("X-CBFS-WriteQuorum",
+			strconv.Itoa(opts.WriteQuorum))
+	}
 	if opts.Expiration > 0 {
 		preq.Header.Set("X-CBFS-Expiration",
 			strconv.Itoa(opts.Expiration))
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Overall cluster verdicts.
+const (
+	healthGreen  = "green"
+	healthYellow = "yellow"
+	healthRed    = "red"
+)
+
+type nodeHealth struct {
+	Name       string        `json:"name"`
+	Addr       string        `json:"addr"`
+	Alive      bool          `json:"alive"`
+	Leaving    bool          `json:"leaving,omitempty"`
+	HBAge      time.Duration `json:"hbage"`
+	ClockDrift time.Duration `json:"clockDrift"`
+	Free       int64         `json:"free"`
+}
+
+type replicaHealth struct {
+	// Blobs with no copies at all
+	Lost  int64 `json:"lost"`
+	Under int64 `json:"under"`
+	Over  int64 `json:"over"`
+	Total int64 `json:"total"`
+}
+
+type garbageHealth struct {
+	Blobs int64 `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// A task lock held by a node that's no longer around to release it.
+type staleLock struct {
+	Task   string    `json:"task"`
+	Node   string    `json:"node"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+}
+
+type backupHealth struct {
+	Latest     string    `json:"latest,omitempty"`
+	When       time.Time `json:"when,omitempty"`
+	AgeSeconds int64     `json:"ageSeconds"`
+	Stale      bool      `json:"stale"`
+}
+
+type clusterHealth struct {
+	Verdict    string        `json:"verdict"`
+	Reasons    []string      `json:"reasons,omitempty"`
+	Nodes      []nodeHealth  `json:"nodes"`
+	Replicas   replicaHealth `json:"replicas"`
+	Garbage    garbageHealth `json:"garbage"`
+	StaleLocks []staleLock   `json:"staleLocks,omitempty"`
+	Backup     backupHealth  `json:"backup"`
+	// Nodes whose clocks are off by more than DriftWarnThresh
+	ClockDrift map[string]time.Duration `json:"clockDrift,omitempty"`
+	// What couldn't be checked
+	Errors  []string  `json:"errors,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// How many blobs have each number of replicas, from the repcounts
+// view.
+func countReplicas() (map[int]int64, error) {
+	viewRes := struct {
+		Rows []struct {
+			Key   int
+			Value int64
+		}
+	}{}
+	err := couchbase.ViewCustom("cbfs", "repcounts",
+		map[string]interface{}{
+			"group_level": 1,
+			"stale":       "update_after",
+		}, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+	rv := map[int]int64{}
+	for _, r := range viewRes.Rows {
+		rv[r.Key] = r.Value
+	}
+	return rv, nil
+}
+
+func summarizeReplicas(counts map[int]int64, min, max int) replicaHealth {
+	rv := replicaHealth{}
+	for n, c := range counts {
+		rv.Total += c
+		switch {
+		case n == 0:
+			rv.Lost += c
+			rv.Under += c
+		case n < min:
+			rv.Under += c
+		case n > max:
+			rv.Over += c
+		}
+	}
+	return rv
+}
+
+func garbageStats() (garbageHealth, error) {
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Value struct {
+				Count int64
+				Sum   float64
+			}
+		}
+	}{}
+	err := couchbase.ViewCustom("cbfs", "garbage",
+		map[string]interface{}{
+			"group_level": 1,
+			"key":         "garbage",
+			"stale":       "update_after",
+		}, &viewRes)
+	if err != nil {
+		return garbageHealth{}, err
+	}
+	rv := garbageHealth{}
+	for _, r := range viewRes.Rows {
+		rv.Blobs += r.Value.Count
+		rv.Bytes += int64(r.Value.Sum)
+	}
+	return rv, nil
+}
+
+// Find task locks held by nodes that are stale or gone.
+func findStaleLocks(nl NodeList) ([]staleLock, error) {
+	alive := map[string]bool{}
+	for _, n := range nl {
+		alive[n.name] = !n.isStale()
+	}
+
+	rv := []staleLock{}
+	tasks, err := listRunningTasks()
+	if err != nil {
+		return rv, err
+	}
+	for _, tl := range tasks {
+		if alive[tl.Node] {
+			continue
+		}
+		for name, ts := range tl.Tasks {
+			rv = append(rv, staleLock{name, tl.Node, ts.Timestamp,
+				"node is stale"})
+		}
+	}
+
+	if taskLeases == nil {
+		return rv, nil
+	}
+	for name := range globalPeriodicJobRecipes {
+		rec, held, err := taskLeases.holder(taskLeaseKey(name))
+		if err != nil {
+			return rv, err
+		}
+		switch {
+		case !held:
+		case rec.Expires.Before(time.Now()):
+			rv = append(rv, staleLock{name, rec.Node, rec.Expires,
+				"lease expired"})
+		case !alive[rec.Node]:
+			rv = append(rv, staleLock{name, rec.Node, rec.Expires,
+				"lease holder is stale"})
+		}
+	}
+	return rv, nil
+}
+
+// Decide how healthy the cluster is and why.
+func (h *clusterHealth) judge() {
+	red, yellow := []string{}, []string{}
+
+	alive := 0
+	for _, n := range h.Nodes {
+		if n.Alive {
+			alive++
+		} else {
+			yellow = append(yellow, fmt.Sprintf("node %v is down", n.Name))
+		}
+	}
+	if alive == 0 {
+		red = append(red, "no nodes are alive")
+	}
+	if h.Replicas.Lost > 0 {
+		red = append(red, fmt.Sprintf("%v blobs have no copies", h.Replicas.Lost))
+	}
+	if n := h.Replicas.Under - h.Replicas.Lost; n > 0 {
+		yellow = append(yellow, fmt.Sprintf("%v blobs are under-replicated", n))
+	}
+	if len(h.StaleLocks) > 0 {
+		yellow = append(yellow, fmt.Sprintf("%v stale task locks", len(h.StaleLocks)))
+	}
+	if h.Backup.Stale {
+		yellow = append(yellow, "the latest backup is stale")
+	}
+	for n, d := range h.ClockDrift {
+		yellow = append(yellow, fmt.Sprintf("clock on %v is off by %v", n, d))
+	}
+	if len(h.Errors) > 0 {
+		yellow = append(yellow, "some checks failed")
+	}
+
+	sort.Strings(red)
+	sort.Strings(yellow)
+	h.Reasons = append(red, yellow...)
+	switch {
+	case len(red) > 0:
+		h.Verdict = healthRed
+	case len(yellow) > 0:
+		h.Verdict = healthYellow
+	default:
+		h.Verdict = healthGreen
+	}
+}
+
+func checkClusterHealth() clusterHealth {
+	h := clusterHealth{Nodes: []nodeHealth{}, Checked: time.Now().UTC()}
+	fail := func(what string, err error) {
+		h.Errors = append(h.Errors, fmt.Sprintf("%v: %v", what, err))
+	}
+
+	nl, err := findAllNodes()
+	if err != nil {
+		fail("nodes", err)
+	}
+	for _, n := range nl {
+		h.Nodes = append(h.Nodes, nodeHealth{
+			Name:       n.name,
+			Addr:       n.Address(),
+			Alive:      !n.isStale(),
+			Leaving:    n.Leaving,
+			HBAge:      time.Since(n.Time),
+			ClockDrift: n.ClockDrift,
+			Free:       n.Free,
+		})
+		if n.ClockDrift > globalConfig.DriftWarnThresh {
+			if h.ClockDrift == nil {
+				h.ClockDrift = map[string]time.Duration{}
+			}
+			h.ClockDrift[n.name] = n.ClockDrift
+		}
+	}
+
+	if counts, err := countReplicas(); err == nil {
+		h.Replicas = summarizeReplicas(counts, globalConfig.MinReplicas,
+			globalConfig.MaxReplicas)
+	} else {
+		fail("replica counts", err)
+	}
+
+	if h.Garbage, err = garbageStats(); err != nil {
+		fail("garbage", err)
+	}
+
+	if h.StaleLocks, err = findStaleLocks(nl); err != nil {
+		fail("task locks", err)
+	}
+
+	b := backups{}
+	err = couchbase.Get(backupKey, &b)
+	if err == nil || gomemcached.IsNotFound(err) {
+		age, stale := backupAge(b)
+		h.Backup = backupHealth{b.Latest.Fn, b.Latest.When,
+			int64(age.Seconds()), stale}
+	} else {
+		fail("backups", err)
+	}
+
+	h.judge()
+	return h
+}
+
+func doClusterHealth(w http.ResponseWriter, req *http.Request) {
+	sendJson(w, req, checkClusterHealth())
+}
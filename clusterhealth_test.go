@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummarizeReplicas(t *testing.T) {
+	got := summarizeReplicas(map[int]int64{0: 1, 1: 2, 2: 4, 3: 8, 5: 16, 6: 32}, 3, 5)
+	exp := replicaHealth{Lost: 1, Under: 7, Over: 32, Total: 63}
+	if got != exp {
+		t.Errorf("Expected %+v, got %+v", exp, got)
+	}
+}
+
+func TestJudgeHealth(t *testing.T) {
+	up := nodeHealth{Name: "a", Alive: true}
+	down := nodeHealth{Name: "b"}
+
+	tests := []struct {
+		h       clusterHealth
+		verdict string
+		reasons []string
+	}{
+		{clusterHealth{Nodes: []nodeHealth{up}}, healthGreen, nil},
+		{clusterHealth{Nodes: []nodeHealth{up, down},
+			Replicas: replicaHealth{Under: 3}},
+			healthYellow, []string{"3 blobs are under-replicated", "node b is down"}},
+		{clusterHealth{Nodes: []nodeHealth{up},
+			StaleLocks: []staleLock{{Task: "gc"}},
+			Backup:     backupHealth{Stale: true},
+			ClockDrift: map[string]time.Duration{"a": time.Hour}},
+			healthYellow, []string{"1 stale task locks", "clock on a is off by 1h0m0s",
+				"the latest backup is stale"}},
+		{clusterHealth{Nodes: []nodeHealth{up},
+			Replicas: replicaHealth{Lost: 2, Under: 2}},
+			healthRed, []string{"2 blobs have no copies"}},
+		{clusterHealth{Nodes: []nodeHealth{down}, Errors: []string{"x"}},
+			healthRed, []string{"no nodes are alive", "node b is down",
+				"some checks failed"}},
+	}
+	for i, test := range tests {
+		test.h.judge()
+		if test.h.Verdict != test.verdict {
+			t.Errorf("%v: expected %v, got %v", i, test.verdict, test.h.Verdict)
+		}
+		if len(test.reasons) == 0 && len(test.h.Reasons) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(test.h.Reasons, test.reasons) {
+			t.Errorf("%v: expected reasons %q, got %q", i, test.reasons, test.h.Reasons)
+		}
+	}
+}
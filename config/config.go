@@ -6,6 +6,7 @@ import (
 	"io"
 	"reflect"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 )
@@ -64,6 +65,75 @@ type CBFSConfig struct {
 	TrimFullNodesSpace int64 `json:"trimFullSize"`
 	// How far time can drift from DB before warning
 	DriftWarnThresh time.Duration `json:"driftWarnThresh"`
+	// Is cluster rebalancing enabled?
+	RebalanceEnabled bool `json:"rebalanceEnabled"`
+	// How often to rebalance data across nodes
+	RebalanceFreq time.Duration `json:"rebalanceFreq"`
+	// How many blobs to consider moving from a node per rebalance
+	RebalanceCount int `json:"rebalanceCount"`
+	// Maximum number of bytes to move in a single rebalance
+	RebalanceBytes int64 `json:"rebalanceBytes"`
+	// Percentage a node's utilization may deviate from the target
+	RebalanceSlack int `json:"rebalanceSlack"`
+	// Bytes per second a node may send for background transfers
+	// (0 is unlimited)
+	BackgroundSendRate int64 `json:"bgSendRate"`
+	// Bytes per second a node may receive for background transfers
+	// (0 is unlimited)
+	BackgroundRecvRate int64 `json:"bgRecvRate"`
+	// Number of copies to write synchronously on upload
+	WriteReplicas int `json:"writeReplicas"`
+	// Number of copies that must be confirmed before an upload
+	// succeeds
+	WriteQuorum int `json:"writeQuorum"`
+	// How long to wait for a replica to start responding before
+	// trying another
+	ReadStallTimeout time.Duration `json:"readStallTimeout"`
+	// How long a global task's lease lasts without renewal
+	LeaseTTL time.Duration `json:"leaseTTL"`
+	// Number of runs of each task to remember
+	TaskHistoryCount int `json:"taskHistoryCount"`
+	// Schedules by task name, each a duration or a cron
+	// expression in UTC, overriding the task's usual frequency
+	Schedules map[string]string `json:"schedules"`
+	// Time of day (UTC) during which heavy tasks may start,
+	// e.g. "22:00-06:00" (empty is any time)
+	MaintenanceWindow string `json:"maintenanceWindow"`
+	// How long a blob must go unreferenced before it's collected
+	GCGracePeriod time.Duration `json:"gcGrace"`
+	// How long deleted files are remembered for incremental backups
+	TombstoneAge time.Duration `json:"tombstoneAge"`
+	// Path scheduled backups are written under (empty disables them)
+	BackupPrefix string `json:"backupPrefix"`
+	// Where scheduled backups copy file contents (empty for
+	// metadata only)
+	BackupTarget string `json:"backupTarget"`
+	// How often to take scheduled backups
+	BackupFreq time.Duration `json:"backupFreq"`
+	// How many daily, weekly and monthly backups scheduled backups
+	// keep (all zero keeps everything)
+	BackupKeepDaily   int `json:"backupKeepDaily"`
+	BackupKeepWeekly  int `json:"backupKeepWeekly"`
+	BackupKeepMonthly int `json:"backupKeepMonthly"`
+	// Age at which the latest scheduled backup is considered stale
+	BackupMaxAge time.Duration `json:"backupMaxAge"`
+	// Free space below which a node reports itself not ready
+	ReadyMinFree int64 `json:"readyMinFree"`
+	// Time since a node's last heartbeat after which it reports
+	// itself not ready
+	ReadyHeartbeatAge time.Duration `json:"readyHeartbeatAge"`
+	// Requests taking longer than this are logged with a breakdown
+	// and kept in /.cbfs/debug/slow (0 disables)
+	SlowRequestThresh time.Duration `json:"slowRequestThresh"`
+	// Waits for a couchbase connection longer than this are logged
+	// (0 disables)
+	SlowCouchbaseThresh time.Duration `json:"slowCouchbaseThresh"`
+	// Task runs taking longer than this are logged with a breakdown
+	// and kept in /.cbfs/debug/slow (0 disables)
+	SlowTaskThresh time.Duration `json:"slowTaskThresh"`
+	// Comma separated tasks not to run on schedule (usually set
+	// for one node)
+	DisabledTasks string `json:"disabledTasks"`
 }
 
 // Get the default configuration
@@ -91,6 +161,27 @@ func DefaultConfig() CBFSConfig {
 		TrimFullNodesCount:    10000,
 		TrimFullNodesSpace:    1 * 1024 * 1024 * 1024,
 		DriftWarnThresh:       5 * time.Minute,
+		RebalanceFreq:         time.Hour * 6,
+		RebalanceCount:        10000,
+		RebalanceBytes:        16 * 1024 * 1024 * 1024,
+		RebalanceSlack:        10,
+		WriteReplicas:         2,
+		WriteQuorum:           2,
+		ReadStallTimeout:      5 * time.Second,
+		LeaseTTL:              30 * time.Second,
+		TaskHistoryCount:      50,
+		GCGracePeriod:         time.Hour * 24,
+		TombstoneAge:          time.Hour * 24 * 30,
+		BackupFreq:            time.Hour * 24,
+		BackupKeepDaily:       7,
+		BackupKeepWeekly:      4,
+		BackupKeepMonthly:     12,
+		BackupMaxAge:          time.Hour * 48,
+		ReadyMinFree:          256 * 1024 * 1024,
+		ReadyHeartbeatAge:     time.Minute,
+		SlowRequestThresh:     5 * time.Second,
+		SlowCouchbaseThresh:   time.Second,
+		SlowTaskThresh:        30 * time.Minute,
 	}
 }
 
@@ -145,6 +236,10 @@ func (conf *CBFSConfig) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func badValue(name string, inval interface{}) error {
+	return fmt.Errorf("Invalid value for %v: %#v", name, inval)
+}
+
 // Set a parameter by name.
 func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 	var err error
@@ -168,6 +263,8 @@ func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 				}
 			case float64:
 				d = time.Duration(i)
+			default:
+				return badValue(name, inval)
 			}
 			val.Field(i).SetInt(int64(d))
 			return nil
@@ -182,11 +279,17 @@ func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 
 			case bool:
 				v = i
+			default:
+				return badValue(name, inval)
 			}
 			val.Field(i).SetBool(v)
 			return nil
 		case sf.Type.Kind() == reflect.String:
-			val.Field(i).SetString(inval.(string))
+			s, ok := inval.(string)
+			if !ok {
+				return badValue(name, inval)
+			}
+			val.Field(i).SetString(s)
 			return nil
 		case sf.Type.Kind() == reflect.Int, sf.Type.Kind() == reflect.Int64:
 			v := int64(0)
@@ -198,10 +301,23 @@ func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 				}
 
 			case float64:
+				if i != float64(int64(i)) {
+					return badValue(name, inval)
+				}
 				v = int64(i)
+			default:
+				return badValue(name, inval)
 			}
 			val.Field(i).SetInt(v)
 			return nil
+		case sf.Type == reflect.TypeOf(map[string]string{}):
+			m, err := setMapParameter(val.Field(i).Interface().(map[string]string),
+				inval)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %v: %v", name, err)
+			}
+			val.Field(i).Set(reflect.ValueOf(m))
+			return nil
 		default:
 			return fmt.Errorf("Unhandled type in field %v", name)
 		}
@@ -209,6 +325,48 @@ func (conf *CBFSConfig) SetParameter(name string, inval interface{}) error {
 	return unhandledValue(name)
 }
 
+// Maps may be given whole, as an object or its JSON text, or a
+// single entry may be changed with "key=value" ("key=" removes it).
+func setMapParameter(old map[string]string,
+	inval interface{}) (map[string]string, error) {
+
+	switch i := inval.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		rv := map[string]string{}
+		for k, v := range i {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", k)
+			}
+			rv[k] = s
+		}
+		return rv, nil
+	case string:
+		if strings.HasPrefix(strings.TrimSpace(i), "{") {
+			rv := map[string]string{}
+			err := json.Unmarshal([]byte(i), &rv)
+			return rv, err
+		}
+		parts := strings.SplitN(i, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", i)
+		}
+		rv := map[string]string{}
+		for k, v := range old {
+			rv[k] = v
+		}
+		if parts[1] == "" {
+			delete(rv, parts[0])
+		} else {
+			rv[parts[0]] = parts[1]
+		}
+		return rv, nil
+	}
+	return nil, fmt.Errorf("unhandled type %T", inval)
+}
+
 // Dump a text representation of this config to the given writer.
 func (conf CBFSConfig) Dump(w io.Writer) {
 	tw := tabwriter.NewWriter(w, 2, 4, 1, ' ', 0)
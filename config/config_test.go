@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -75,6 +76,10 @@ func TestSetParamErrors(t *testing.T) {
 		{"nonexistent", "something"},
 		{"gcfreq", "427years"},
 		{"maxrepl", "one"},
+		{"minrepl", 1.5},
+		{"hash", float64(1)},
+		{"gcEnabled", float64(1)},
+		{"hbfreq", true},
 	}
 
 	for _, test := range tests {
@@ -113,3 +118,138 @@ func TestDefaultWhenUnmarshaling(t *testing.T) {
 		t.Errorf("Expected 15m for driftWarnThresh, got %v", err)
 	}
 }
+
+func TestSetMapParam(t *testing.T) {
+	conf := DefaultConfig()
+
+	tests := []struct {
+		val interface{}
+		exp map[string]string
+	}{
+		{"gc=0 2 * * *", map[string]string{"gc": "0 2 * * *"}},
+		{"rebalance=6h", map[string]string{"gc": "0 2 * * *", "rebalance": "6h"}},
+		{"gc=", map[string]string{"rebalance": "6h"}},
+		{`{"a": "1h"}`, map[string]string{"a": "1h"}},
+		{map[string]interface{}{"b": "2h"}, map[string]string{"b": "2h"}},
+		{nil, nil},
+	}
+
+	for _, test := range tests {
+		err := conf.SetParameter("schedules", test.val)
+		if err != nil {
+			t.Errorf("Error setting schedules to %v: %v", test.val, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf.Schedules, test.exp) {
+			t.Errorf("Expected %v after %v, got %v",
+				test.exp, test.val, conf.Schedules)
+		}
+	}
+
+	for _, v := range []interface{}{"nokey", "=1h", `{"a": 1}`,
+		map[string]interface{}{"a": 1.0}, 7.0} {
+		if err := conf.SetParameter("schedules", v); err == nil {
+			t.Errorf("Expected error setting schedules to %v", v)
+		}
+	}
+
+	conf.Schedules = map[string]string{"gc": "@daily"}
+	d, err := json.Marshal(&conf)
+	if err != nil {
+		t.Fatalf("Error marshaling config: %v", err)
+	}
+	conf2 := CBFSConfig{}
+	if err := json.Unmarshal(d, &conf2); err != nil {
+		t.Fatalf("Error unmarshalling: %v", err)
+	}
+	if !reflect.DeepEqual(conf, conf2) {
+		t.Fatalf("Unmarshalled value is different:\n%v\n%v", conf, conf2)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("Expected the default config to be valid: %v", err)
+	}
+
+	tests := []struct {
+		param string
+		val   string
+		exp   string
+	}{
+		{"minrepl", "6", "maxrepl (5) is less than minrepl (6)"},
+		{"minrepl", "0", "minrepl must be at least 1"},
+		{"hbfreq", "0s", "hbfreq must be positive"},
+		{"hbfreq", "20m", "staleLimit (10m0s) must be longer than hbfreq"},
+		{"gcGrace", "-1h", "gcGrace can't be negative"},
+		{"gclimit", "-5", "gclimit can't be negative"},
+		{"defaultVersionCount", "-1", ""},
+		{"defaultVersionCount", "-2", "defaultVersionCount can't be negative"},
+		{"writeQuorum", "6", "writeQuorum (6) is more than maxrepl (5)"},
+		{"rebalanceSlack", "150", "rebalanceSlack is a percentage"},
+		{"leaseTTL", "0s", "leaseTTL must be positive"},
+	}
+	for _, test := range tests {
+		conf := DefaultConfig()
+		if err := conf.SetParameter(test.param, test.val); err != nil {
+			t.Fatalf("Error setting %v: %v", test.param, err)
+		}
+		err := conf.Validate()
+		switch {
+		case test.exp == "" && err != nil:
+			t.Errorf("Expected %v=%v to be valid, got %v", test.param, test.val, err)
+		case test.exp != "" && (err == nil || !strings.Contains(err.Error(), test.exp)):
+			t.Errorf("Expected %q for %v=%v, got %v", test.exp, test.param,
+				test.val, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s := Schema()
+	if len(s) != len(fieldDocs) {
+		t.Errorf("Expected %v fields, got %v", len(fieldDocs), len(s))
+	}
+	for _, f := range s {
+		if f.Doc == "" {
+			t.Errorf("No doc for %v", f.Name)
+		}
+	}
+	if s[0].Name != "gcfreq" || s[0].Type != "duration" || s[0].Default != "8h0m0s" {
+		t.Errorf("Unexpected schema for gcfreq: %+v", s[0])
+	}
+}
+
+func TestWithOverrides(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Schedules = map[string]string{"gc": "1h", "reconcile": "@daily"}
+
+	got, err := conf.WithOverrides(map[string]interface{}{
+		"trimFullSize":  float64(1024),
+		"disabledTasks": "reconcile",
+		"schedules":     map[string]interface{}{"gc": "2h", "reconcile": ""},
+	})
+	if err != nil {
+		t.Fatalf("Error overriding: %v", err)
+	}
+	if got.TrimFullNodesSpace != 1024 || got.DisabledTasks != "reconcile" {
+		t.Errorf("Overrides weren't applied: %+v", got)
+	}
+	exp := map[string]string{"gc": "2h"}
+	if !reflect.DeepEqual(got.Schedules, exp) {
+		t.Errorf("Expected schedules %v, got %v", exp, got.Schedules)
+	}
+	if conf.Schedules["gc"] != "1h" || conf.TrimFullNodesSpace == 1024 {
+		t.Errorf("Overriding changed the original: %+v", conf)
+	}
+
+	for _, o := range []map[string]interface{}{
+		{"hash": "sha256"},
+		{"nonexistent": "x"},
+		{"gcfreq": "soon"},
+	} {
+		if _, err := conf.WithOverrides(o); err == nil {
+			t.Errorf("Expected an error overriding %v", o)
+		}
+	}
+}
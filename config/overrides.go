@@ -0,0 +1,59 @@
+package cbfsconfig
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Parameters every node must agree on, so they can't be overridden
+// for one node.
+var clusterOnly = map[string]bool{
+	"hash":         true,
+	"minrepl":      true,
+	"maxrepl":      true,
+	"staleLimit":   true,
+	"leaseTTL":     true,
+	"gcGrace":      true,
+	"tombstoneAge": true,
+}
+
+// True if the named parameter may be overridden for a single node.
+func PerNode(name string) bool {
+	return !clusterOnly[name]
+}
+
+// A copy of this config with some parameters overridden, as given to
+// SetParameter.  Map parameters are merged by key rather than
+// replaced, and an empty value removes a key.
+func (conf CBFSConfig) WithOverrides(overrides map[string]interface{}) (CBFSConfig, error) {
+	names := make([]string, 0, len(overrides))
+	for k := range overrides {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !PerNode(name) {
+			return conf, fmt.Errorf("%v can't be set per node", name)
+		}
+		m, isMap := overrides[name].(map[string]interface{})
+		if !isMap {
+			if err := conf.SetParameter(name, overrides[name]); err != nil {
+				return conf, err
+			}
+			continue
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			err := conf.SetParameter(name, fmt.Sprintf("%v=%v", k, m[k]))
+			if err != nil {
+				return conf, err
+			}
+		}
+	}
+	return conf, nil
+}
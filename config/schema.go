@@ -0,0 +1,105 @@
+package cbfsconfig
+
+import (
+	"reflect"
+	"time"
+)
+
+// What each parameter is for, by name.
+var fieldDocs = map[string]string{
+	"gcfreq":                "How often to collect unreferenced blobs",
+	"gcEnabled":             "Whether garbage collection runs at all",
+	"gclimit":               "Maximum number of blobs to look at in a GC pass",
+	"hash":                  "Hash algorithm naming blobs (e.g. sha1, sha256)",
+	"hbfreq":                "How often nodes heartbeat",
+	"minrepl":               "Minimum number of copies of each blob to keep",
+	"maxrepl":               "Maximum number of copies of each blob to keep",
+	"cleanCount":            "Blobs to remove from a stale node per period",
+	"reconcileFreq":         "How often to reconcile local blobs with the registry",
+	"reconcileAge":          "Age of local blobs reconciliation looks at",
+	"quickReconcileFreq":    "How often to run a quick reconciliation",
+	"localValidationFreq":   "How often to verify a node has every blob registered to it",
+	"nodeCheckFreq":         "How often to look for stale nodes",
+	"staleLimit":            "Time since its last heartbeat after which a node is stale",
+	"underReplicaCheckFreq": "How often to look for under-replicated blobs",
+	"overReplicaCheckFreq":  "How often to look for over-replicated blobs",
+	"replicaCheckLimit":     "Blobs to fix per replication check",
+	"defaultVersionCount":   "Old versions of a file to keep (-1 keeps all)",
+	"updateSizesFreq":       "How often nodes report their size",
+	"trimFullFreq":          "How often to move blobs off full nodes",
+	"trimFullCount":         "Blobs to move from a full node per pass",
+	"trimFullSize":          "Bytes to keep free on each node",
+	"driftWarnThresh":       "Clock drift from the database that causes a warning",
+	"rebalanceEnabled":      "Whether blobs are rebalanced across nodes",
+	"rebalanceFreq":         "How often to rebalance",
+	"rebalanceCount":        "Blobs to consider moving from a node per rebalance",
+	"rebalanceBytes":        "Maximum bytes to move in one rebalance",
+	"rebalanceSlack":        "Percentage a node's use may differ from the target",
+	"bgSendRate":            "Bytes per second a node may send in the background (0 is unlimited)",
+	"bgRecvRate":            "Bytes per second a node may receive in the background (0 is unlimited)",
+	"writeReplicas":         "Copies written synchronously on upload",
+	"writeQuorum":           "Copies confirmed before an upload succeeds",
+	"readStallTimeout":      "How long to wait for a replica's response headers before trying another",
+	"leaseTTL":              "How long a global task's lease lasts without renewal",
+	"taskHistoryCount":      "Runs of each task to remember",
+	"schedules":             "Task schedules by name, each a duration or a UTC cron expression",
+	"maintenanceWindow":     "UTC time of day heavy tasks may start, e.g. 22:00-06:00 (empty is any time)",
+	"gcGrace":               "How long a blob must be unreferenced before it's collected",
+	"tombstoneAge":          "How long deleted files are remembered for incremental backups",
+	"backupPrefix":          "Path scheduled backups are written under (empty disables them)",
+	"backupTarget":          "Where scheduled backups copy file contents, pruned along with them (empty for metadata only)",
+	"backupFreq":            "How often to take scheduled backups",
+	"backupKeepDaily":       "Daily scheduled backups to keep",
+	"backupKeepWeekly":      "Weekly scheduled backups to keep",
+	"backupKeepMonthly":     "Monthly scheduled backups to keep",
+	"backupMaxAge":          "Age at which the latest scheduled backup is stale",
+	"readyMinFree":          "Free bytes below which a node isn't ready",
+	"readyHeartbeatAge":     "Heartbeat age after which a node isn't ready",
+	"slowRequestThresh":     "Requests slower than this are logged and kept (0 disables)",
+	"slowCouchbaseThresh":   "Couchbase connection waits slower than this are logged (0 disables)",
+	"slowTaskThresh":        "Task runs slower than this are logged and kept (0 disables)",
+	"disabledTasks":         "Comma separated tasks not to run on schedule",
+}
+
+// Description of one configuration parameter.
+type FieldSchema struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Default interface{} `json:"default"`
+	Doc     string      `json:"doc"`
+	PerNode bool        `json:"perNode"`
+}
+
+func typeName(t reflect.Type) string {
+	switch {
+	case t == reflect.TypeOf(time.Duration(0)):
+		return "duration"
+	case t.Kind() == reflect.Bool:
+		return "bool"
+	case t.Kind() == reflect.String:
+		return "string"
+	case t.Kind() == reflect.Int, t.Kind() == reflect.Int64:
+		return "int"
+	case t.Kind() == reflect.Map:
+		return "map"
+	}
+	return t.String()
+}
+
+// Describe every parameter, in declaration order.
+func Schema() []FieldSchema {
+	defaults := DefaultConfig().ToMap()
+	t := reflect.TypeOf(CBFSConfig{})
+	rv := make([]FieldSchema, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonFieldName(t.Field(i))
+		rv = append(rv, FieldSchema{
+			Name:    name,
+			Type:    typeName(t.Field(i).Type),
+			Default: defaults[name],
+			Doc:     fieldDocs[name],
+			PerNode: PerNode(name),
+		})
+	}
+	return rv
+}
@@ -0,0 +1,78 @@
+package cbfsconfig
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Everything wrong with a config.
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid config: " + strings.Join(v, "; ")
+}
+
+// Check that the values in the config make sense together.  Returns a
+// ValidationError listing every problem found.
+func (conf CBFSConfig) Validate() error {
+	errs := ValidationError{}
+	bad := func(f string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(f, args...))
+	}
+
+	val := reflect.ValueOf(conf)
+	for i := 0; i < val.NumField(); i++ {
+		sf := val.Type().Field(i)
+		name := jsonFieldName(sf)
+		switch {
+		case sf.Type == reflect.TypeOf(time.Duration(0)):
+			d := time.Duration(val.Field(i).Int())
+			if strings.HasSuffix(sf.Name, "Freq") && d <= 0 {
+				bad("%v must be positive, not %v", name, d)
+			} else if d < 0 {
+				bad("%v can't be negative (%v)", name, d)
+			}
+		case sf.Type.Kind() == reflect.Int, sf.Type.Kind() == reflect.Int64:
+			// -1 keeps every version.
+			if v := val.Field(i).Int(); v < 0 &&
+				!(sf.Name == "DefaultVersionCount" && v == -1) {
+				bad("%v can't be negative (%v)", name, v)
+			}
+		}
+	}
+
+	if conf.MinReplicas < 1 {
+		bad("minrepl must be at least 1, not %v", conf.MinReplicas)
+	}
+	if conf.MaxReplicas < conf.MinReplicas {
+		bad("maxrepl (%v) is less than minrepl (%v)",
+			conf.MaxReplicas, conf.MinReplicas)
+	}
+	if conf.WriteReplicas < 1 {
+		bad("writeReplicas must be at least 1, not %v", conf.WriteReplicas)
+	}
+	if conf.WriteQuorum < 1 {
+		bad("writeQuorum must be at least 1, not %v", conf.WriteQuorum)
+	}
+	if conf.WriteQuorum > conf.MaxReplicas {
+		bad("writeQuorum (%v) is more than maxrepl (%v)",
+			conf.WriteQuorum, conf.MaxReplicas)
+	}
+	if conf.RebalanceSlack > 100 {
+		bad("rebalanceSlack is a percentage, not %v", conf.RebalanceSlack)
+	}
+	if conf.HeartbeatFreq > 0 && conf.StaleNodeLimit <= conf.HeartbeatFreq {
+		bad("staleLimit (%v) must be longer than hbfreq (%v)",
+			conf.StaleNodeLimit, conf.HeartbeatFreq)
+	}
+	if conf.LeaseTTL <= 0 {
+		bad("leaseTTL must be positive, not %v", conf.LeaseTTL)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
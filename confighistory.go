@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+const (
+	configHistKey     = "/@configHistory"
+	configHistoryKeep = 100
+)
+
+// One parameter's change.
+type configFieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// One stored change to the cluster config or a node's overrides,
+// with the config or overrides it made.
+type configRevision struct {
+	Version   int                    `json:"version"`
+	When      time.Time              `json:"when"`
+	Who       string                 `json:"who"`
+	From      string                 `json:"from"`
+	Note      string                 `json:"note,omitempty"`
+	Changes   []configFieldChange    `json:"changes"`
+	Config    *cbfsconfig.CBFSConfig `json:"config,omitempty"`
+	Node      string                 `json:"node,omitempty"`
+	Overrides map[string]interface{} `json:"overrides,omitempty"`
+}
+
+type configHistory struct {
+	Type      string           `json:"type"`
+	Revisions []configRevision `json:"revisions"`
+}
+
+// Everything wrong with conf, including what only this package knows
+// (hashes and task names).
+func validateConfig(conf cbfsconfig.CBFSConfig) error {
+	errs := cbfsconfig.ValidationError{}
+	if err := conf.Validate(); err != nil {
+		errs = append(errs, err.(cbfsconfig.ValidationError)...)
+	}
+	if h, ok := hashBuilders[conf.Hash]; !ok || !h.Available() {
+		errs = append(errs, fmt.Sprintf("unknown hash %q", conf.Hash))
+	}
+	if err := validateSchedules(conf); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// The parameters that differ, in declaration order.
+func diffConfigs(old, current cbfsconfig.CBFSConfig) []configFieldChange {
+	om, cm := old.ToMap(), current.ToMap()
+	rv := []configFieldChange{}
+	for _, f := range cbfsconfig.Schema() {
+		if !reflect.DeepEqual(om[f.Name], cm[f.Name]) {
+			rv = append(rv, configFieldChange{f.Name, om[f.Name], cm[f.Name]})
+		}
+	}
+	return rv
+}
+
+func appendConfigRevision(h []configRevision, r configRevision,
+	keep int) []configRevision {
+
+	r.Version = 1
+	if len(h) > 0 {
+		r.Version = h[len(h)-1].Version + 1
+	}
+	h = append(h, r)
+	if len(h) > keep {
+		h = h[len(h)-keep:]
+	}
+	return h
+}
+
+// Add a change to the history.  If it's the first for the cluster
+// config or its node, prior (what it replaced) goes in first so the
+// change can be rolled back too.  In an empty history that's version 0.
+func addConfigChange(h []configRevision, r, prior configRevision,
+	keep int) []configRevision {
+
+	for _, o := range h {
+		if o.Node == r.Node {
+			return appendConfigRevision(h, r, keep)
+		}
+	}
+
+	prior.When, prior.Who, prior.From = r.When, r.Who, r.From
+	prior.Note = "before the first recorded change"
+	if len(h) == 0 {
+		h = []configRevision{prior}
+	} else {
+		h = appendConfigRevision(h, prior, keep)
+	}
+	return appendConfigRevision(h, r, keep)
+}
+
+func recordConfigChange(r, prior configRevision) error {
+	return couchbase.Update(configHistKey, 0, func(in []byte) ([]byte, error) {
+		h := configHistory{}
+		if err := json.Unmarshal(in, &h); err != nil && len(in) > 0 {
+			// Don't throw away history we can't read.
+			return nil, err
+		}
+		h.Type = "confighistory"
+		h.Revisions = addConfigChange(h.Revisions, r, prior,
+			configHistoryKeep)
+		return json.Marshal(h)
+	})
+}
+
+// Describe who is making a change to the config.
+func newConfigRevision(req *http.Request, changes []configFieldChange) configRevision {
+	who := req.Header.Get("X-CBFS-User")
+	if who == "" {
+		who = "unknown"
+	}
+	return configRevision{
+		When:    time.Now().UTC(),
+		Who:     who,
+		From:    req.RemoteAddr,
+		Note:    req.Header.Get("X-CBFS-Config-Note"),
+		Changes: changes,
+	}
+}
+
+// The stored config, or the default if there isn't one yet.
+func currentStoredConfig() (cbfsconfig.CBFSConfig, error) {
+	conf, err := RetrieveConfig()
+	if gomemcached.IsNotFound(err) {
+		return cbfsconfig.DefaultConfig(), nil
+	}
+	if err != nil {
+		return cbfsconfig.CBFSConfig{}, err
+	}
+	return *conf, nil
+}
+
+func doGetConfigSchema(w http.ResponseWriter, req *http.Request) {
+	sendJson(w, req, cbfsconfig.Schema())
+}
+
+func doGetConfigHistory(w http.ResponseWriter, req *http.Request) {
+	h := configHistory{Type: "confighistory", Revisions: []configRevision{}}
+	err := couchbase.Get(configHistKey, &h)
+	if err != nil && !gomemcached.IsNotFound(err) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, h)
+}
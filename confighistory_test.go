@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	old := cbfsconfig.DefaultConfig()
+	current := old
+	if d := diffConfigs(old, current); len(d) != 0 {
+		t.Errorf("Expected no changes, got %v", d)
+	}
+
+	current.MinReplicas = 4
+	current.Hash = "sha256"
+	exp := []configFieldChange{
+		{"hash", "sha1", "sha256"},
+		{"minrepl", 3, 4},
+	}
+	if d := diffConfigs(old, current); !reflect.DeepEqual(d, exp) {
+		t.Errorf("Expected %v, got %v", exp, d)
+	}
+}
+
+func TestAppendConfigRevision(t *testing.T) {
+	h := []configRevision{}
+	for i := 0; i < 5; i++ {
+		h = appendConfigRevision(h, configRevision{Who: "x"}, 3)
+	}
+	versions := []int{}
+	for _, r := range h {
+		versions = append(versions, r.Version)
+	}
+	if !reflect.DeepEqual(versions, []int{3, 4, 5}) {
+		t.Errorf("Expected versions 3-5, got %v", versions)
+	}
+}
+
+func TestAddConfigChange(t *testing.T) {
+	c0, c1 := cbfsconfig.DefaultConfig(), cbfsconfig.DefaultConfig()
+	c1.GCLimit = 10
+
+	h := addConfigChange(nil, configRevision{Who: "x", Config: &c1},
+		configRevision{Config: &c0}, 10)
+	h = addConfigChange(h, configRevision{Who: "y", Node: "n",
+		Overrides: map[string]interface{}{"gclimit": "5"}},
+		configRevision{Node: "n"}, 10)
+	h = addConfigChange(h, configRevision{Who: "z", Config: &c0},
+		configRevision{Config: &c1}, 10)
+
+	type rev struct {
+		version int
+		who     string
+		node    string
+		gclimit int
+	}
+	got := []rev{}
+	for _, r := range h {
+		g := -1
+		if r.Config != nil {
+			g = r.Config.GCLimit
+		}
+		got = append(got, rev{r.Version, r.Who, r.Node, g})
+	}
+	exp := []rev{
+		{0, "x", "", c0.GCLimit},
+		{1, "x", "", 10},
+		{2, "y", "n", -1},
+		{3, "y", "n", -1},
+		{4, "z", "", c0.GCLimit},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %+v, got %+v", exp, got)
+	}
+	if h[2].Overrides != nil || h[3].Overrides == nil {
+		t.Errorf("Expected node baseline without overrides, got %+v then %+v",
+			h[2].Overrides, h[3].Overrides)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := validateConfig(cbfsconfig.DefaultConfig()); err != nil {
+		t.Fatalf("Expected the default config to be valid: %v", err)
+	}
+
+	conf := cbfsconfig.DefaultConfig()
+	conf.Hash = "crc32"
+	conf.MinReplicas = 7
+	conf.Schedules = map[string]string{"nosuchtask": "1h"}
+	err := validateConfig(conf)
+	if err == nil {
+		t.Fatalf("Expected errors")
+	}
+	for _, exp := range []string{`unknown hash "crc32"`, "maxrepl (5) is less",
+		`unknown task "nosuchtask"`} {
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("Expected %q in %v", exp, err)
+		}
+	}
+}
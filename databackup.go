@@ -0,0 +1,323 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/backupstore"
+)
+
+// How many blobs are copied to or from a backup target at once.
+const dataBackupWorkers = 4
+
+// Open a target for a data backup.  An increment is only useful
+// where its base is.
+func openDataTarget(spec string, base *backupItem) (cbfsbackupstore.Target, error) {
+	t, err := cbfsbackupstore.Open(spec)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		if _, err := cbfsbackupstore.GetManifest(t, base.Fn); err != nil {
+			return nil, fmt.Errorf("base %v isn't in %v: %v", base.Fn, t, err)
+		}
+	}
+	return t, nil
+}
+
+// Every blob a metadata backup refers to, old revisions included.
+func backupBlobs(oid string) ([]cbfsbackupstore.Blob, error) {
+	r := blobReader(oid)
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	seen := map[string]int64{}
+	d := json.NewDecoder(gz)
+	for {
+		ob := struct {
+			Meta struct {
+				OID    string
+				Length int64
+				Older  []struct {
+					OID    string
+					Length int64
+				}
+			}
+		}{}
+		err := d.Decode(&ob)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ob.Meta.OID != "" {
+			seen[ob.Meta.OID] = ob.Meta.Length
+		}
+		for _, o := range ob.Meta.Older {
+			seen[o.OID] = o.Length
+		}
+	}
+
+	rv := make([]cbfsbackupstore.Blob, 0, len(seen))
+	for oid, l := range seen {
+		rv = append(rv, cbfsbackupstore.Blob{OID: oid, Length: l})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].OID < rv[j].OID })
+	return rv, nil
+}
+
+// Run f over the blobs a few at a time, returning the first error
+// and how many blobs f did something with.
+func eachBlob(blobs []cbfsbackupstore.Blob,
+	f func(cbfsbackupstore.Blob) (bool, error)) (int, error) {
+
+	ch := make(chan cbfsbackupstore.Blob)
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	done := 0
+	var firstErr error
+
+	for i := 0; i < dataBackupWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range ch {
+				did, err := f(b)
+				mu.Lock()
+				if did && err == nil {
+					done++
+				}
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("%v: %v", b.OID, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, b := range blobs {
+		ch <- b
+	}
+	close(ch)
+	wg.Wait()
+	return done, firstErr
+}
+
+func copyBlobTo(t cbfsbackupstore.Target, b cbfsbackupstore.Blob) (bool, error) {
+	has, err := t.HasBlob(b.OID)
+	if err != nil || has {
+		return false, err
+	}
+	r, err := openBlob(b.OID, false, "")
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	return true, t.PutBlob(b.OID, cbfsbackupstore.NewVerifier(r, getHash(), b.OID))
+}
+
+// Copy a metadata backup and every blob it refers to into a target,
+// skipping blobs an earlier backup already put there.  The manifest
+// is written last.
+func backupData(t cbfsbackupstore.Target, bi backupItem) (cbfsbackupstore.Manifest, error) {
+	defer logDuration("data backup to "+t.String(), time.Now())
+
+	m := cbfsbackupstore.Manifest{
+		Name:    bi.Fn,
+		Created: time.Now().UTC(),
+		Hash:    globalConfig.Hash,
+		Base:    bi.Base,
+	}
+
+	own, err := getBlobOwnership(bi.Oid)
+	if err != nil {
+		return m, err
+	}
+	m.Meta = cbfsbackupstore.Blob{OID: bi.Oid, Length: own.Length}
+
+	m.Blobs, err = backupBlobs(bi.Oid)
+	if err != nil {
+		return m, err
+	}
+	for _, b := range m.Blobs {
+		m.Bytes += b.Length
+	}
+
+	m.Copied, err = eachBlob(append(m.Blobs, m.Meta),
+		func(b cbfsbackupstore.Blob) (bool, error) {
+			return copyBlobTo(t, b)
+		})
+	if err != nil {
+		return m, err
+	}
+
+	log.Printf("Copied %v of %v blobs of %v to %v",
+		m.Copied, len(m.Blobs)+1, bi.Fn, t)
+	return m, cbfsbackupstore.PutManifest(t, m)
+}
+
+// Bring a blob back from a target unless the cluster still has it.
+func rehydrateBlob(t cbfsbackupstore.Target, b cbfsbackupstore.Blob) (bool, error) {
+	if own, err := getBlobOwnership(b.OID); err == nil && len(own.Nodes) > 0 {
+		return false, nil
+	}
+
+	r, err := t.GetBlob(b.OID)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	f, err := NewHashRecord(*root, b.OID)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, length, err := f.Process(r)
+	if err != nil {
+		return false, err
+	}
+	if err := recordBlobOwnership(b.OID, length, true); err != nil {
+		return false, err
+	}
+	increaseReplicaCount(b.OID, length, globalConfig.MinReplicas-1, "")
+	return true, nil
+}
+
+type dataRestoreResult struct {
+	Backups       []string `json:"backups"`
+	BlobsRestored int      `json:"blobsRestored"`
+	Files         int      `json:"files"`
+	Deletions     int      `json:"deletions"`
+	Skipped       int      `json:"skipped"`
+	Errors        int      `json:"errors"`
+}
+
+// Restore the files in a metadata backup that's back in the cluster.
+func restoreBackupMeta(oid string, newer bool, res *dataRestoreResult) error {
+	r := blobReader(oid)
+	defer r.Close()
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	d := json.NewDecoder(gz)
+	for {
+		ob := struct {
+			Path    string
+			Meta    *fileMeta
+			Deleted string
+		}{}
+		err := d.Decode(&ob)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fn := strings.TrimLeft(ob.Path, "/")
+		switch {
+		case ob.Deleted != "":
+			var deleted time.Time
+			deleted, err = time.Parse(time.RFC3339Nano, ob.Deleted)
+			if err == nil {
+				err = restoreDeletion(fn, deleted)
+			}
+			if err == nil {
+				res.Deletions++
+			}
+		case ob.Meta != nil:
+			_, err = restoreMeta(fn, *ob.Meta, -1, restoreSkip, newer)
+			if err == nil {
+				res.Files++
+			}
+		}
+		switch err {
+		case nil:
+		case errExists:
+			res.Skipped++
+		default:
+			log.Printf("Error restoring %v: %v", fn, err)
+			res.Errors++
+		}
+	}
+}
+
+// Restore a backup from a target along with the backups it builds
+// on.  Blobs come back first so no restored file refers to a missing
+// one.
+func restoreData(t cbfsbackupstore.Target, name string,
+	newer bool) (dataRestoreResult, error) {
+
+	defer logDuration("data restore from "+t.String(), time.Now())
+
+	res := dataRestoreResult{}
+	chain, err := cbfsbackupstore.Chain(t, name)
+	if err != nil {
+		return res, err
+	}
+
+	for _, m := range chain {
+		if m.Hash != globalConfig.Hash {
+			return res, fmt.Errorf("backup %v uses %v hashes, we use %v",
+				m.Name, m.Hash, globalConfig.Hash)
+		}
+		res.Backups = append(res.Backups, m.Name)
+		n, err := eachBlob(append(m.Blobs, m.Meta),
+			func(b cbfsbackupstore.Blob) (bool, error) {
+				return rehydrateBlob(t, b)
+			})
+		res.BlobsRestored += n
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for i, m := range chain {
+		// Increments replace what they build on.
+		if err := restoreBackupMeta(m.Meta.OID, newer || i > 0, &res); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func doRestoreData(w http.ResponseWriter, req *http.Request) {
+	name := req.FormValue("fn")
+	spec := req.FormValue("target")
+	if name == "" || spec == "" {
+		http.Error(w, "Missing fn or target parameter", 400)
+		return
+	}
+	t, err := cbfsbackupstore.Open(spec)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	newer, _ := strconv.ParseBool(req.FormValue("newer"))
+
+	res, err := restoreData(t, name, newer)
+	if err != nil {
+		log.Printf("Error restoring %v from %v: %v", name, t, err)
+		http.Error(w, fmt.Sprintf("Error restoring %v: %v", name, err), 500)
+		return
+	}
+	sendJson(w, req, res)
+}
@@ -12,7 +12,7 @@ import (
 var couchbase *cb.Bucket
 
 const ddocKey = "/@ddocVersion"
-const ddocVersion = 3
+const ddocVersion = 4
 const designDoc = `
 {
     "spatialInfos": [],
@@ -23,6 +23,12 @@ const designDoc = `
             "removeLink": "#removeView=cbfs%2F_design%252Fdev_cbfs%2F_view%2Ffile_blobs",
             "viewLink": "#showView=cbfs%2F_design%252Fdev_cbfs%2F_view%2Ffile_blobs"
         },
+        {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    emit(doc.modified, [doc.name ? doc.name : meta.id, \"file\"]);\n  } else if (doc.type === \"tombstone\") {\n    emit(doc.deleted, [doc.name, \"tombstone\"]);\n  }\n}",
+            "name": "file_changes",
+            "removeLink": "#removeView=cbfs%2F_design%252Fdev_cbfs%2F_view%2Ffile_changes",
+            "viewLink": "#showView=cbfs%2F_design%252Fdev_cbfs%2F_view%2Ffile_changes"
+        },
         {
             "map": "function (doc, meta) {\n  if(doc.type == \"file\") {  \n    var idarr = meta.id.split(\"/\");\n    emit(idarr, doc.length);\n  }\n}",
             "name": "file_browse",
@@ -63,6 +69,9 @@ const designDoc = `
         "file_blobs": {
             "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    var toEmit = {};\n    toEmit[doc.oid] = doc.name ? doc.name : meta.id;\n    if (doc.older) {\n      for (var i = 0; i < doc.older.length; i++) {\n        toEmit[doc.older[i].oid] = doc.name ? doc.name : meta.id;\n      }\n    }\n    for (var k in toEmit) {\n      emit([k, \"file\", doc.name ? doc.name : meta.id], null);\n    }\n  } else if (doc.type === \"blob\") {\n    var replicas=0;\n    for (var node in doc.nodes) {\n      replicas++;\n      emit([doc.oid, \"blob\", node], null);\n    }\n    if (replicas === 0) {\n      emit([doc.oid, \"blob\", \"\"], null);\n    }\n  }\n}"
         },
+        "file_changes": {
+            "map": "function (doc, meta) {\n  if (doc.type === \"file\") {\n    emit(doc.modified, [doc.name ? doc.name : meta.id, \"file\"]);\n  } else if (doc.type === \"tombstone\") {\n    emit(doc.deleted, [doc.name, \"tombstone\"]);\n  }\n}"
+        },
         "file_browse": {
             "map": "function (doc, meta) {\n  if(doc.type == \"file\") {  \n    var idarr = (doc.name ? doc.name : meta.id).split(\"/\");\n    emit(idarr, doc.length);\n  }\n}",
             "reduce": "_stats"
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cb "github.com/couchbaselabs/go-couchbase"
@@ -42,6 +43,10 @@ func init() {
 	expHistos = expvar.NewMap("cb")
 
 	cb.ConnPoolCallback = recordConnPoolStat
+
+	expvar.Publish("nodescores", expvar.Func(func() interface{} {
+		return nodeScorer.Stats()
+	}))
 }
 
 func connPoolHisto(name string) metrics.Histogram {
@@ -64,6 +69,11 @@ func recordConnPoolStat(host string, source string, start time.Time, err error)
 	duration := time.Since(start)
 	histo := connPoolHisto(host)
 	histo.Update(int64(duration))
+	cbPoolWaits.observe(duration.Seconds(), host)
+	if err != nil {
+		cbPoolErrors.add(1, host)
+	}
+	noteCouchbaseWait(host, source, start, err)
 }
 
 func initTaskMetrics() {
@@ -108,24 +118,28 @@ type rateConn struct {
 func (r *rateConn) WriteTo(w io.Writer) (int64, error) {
 	n, err := io.Copy(w, r.c)
 	readBytes.Update(n)
+	atomic.AddInt64(&bytesReceived, n)
 	return n, err
 }
 
 func (r *rateConn) Write(b []byte) (n int, err error) {
 	n, err = r.c.Write(b)
 	writeBytes.Update(int64(n))
+	atomic.AddInt64(&bytesSent, int64(n))
 	return
 }
 
 func (r *rateConn) ReadFrom(rr io.Reader) (int64, error) {
 	n, err := io.Copy(r.c, rr)
 	writeBytes.Update(n)
+	atomic.AddInt64(&bytesSent, n)
 	return n, err
 }
 
 func (r *rateConn) Read(b []byte) (n int, err error) {
 	n, err = r.c.Read(b)
 	readBytes.Update(int64(n))
+	atomic.AddInt64(&bytesReceived, int64(n))
 	return
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -109,7 +110,7 @@ func quickVerifyWorker(ch chan os.FileInfo) {
 	}
 }
 
-func reconcileWith(wf func(chan os.FileInfo)) error {
+func reconcileWith(ctx context.Context, wf func(chan os.FileInfo)) error {
 	explen := getHash().Size() * 2
 
 	vch := make(chan os.FileInfo)
@@ -119,14 +120,20 @@ func reconcileWith(wf func(chan os.FileInfo)) error {
 		go wf(vch)
 	}
 
+	progress := progressOf(ctx)
 	return filepath.Walk(*root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !info.IsDir() && !strings.HasPrefix(info.Name(), "tmp") &&
 			len(info.Name()) == explen {
 
 			vch <- info
+			progress.scanned(1)
+			progress.moved(info.Size())
 
 			return err
 		}
@@ -134,10 +141,10 @@ func reconcileWith(wf func(chan os.FileInfo)) error {
 	})
 }
 
-func reconcile() error {
-	return reconcileWith(verifyWorker)
+func reconcile(ctx context.Context) error {
+	return reconcileWith(ctx, verifyWorker)
 }
 
-func quickReconcile() error {
-	return reconcileWith(quickVerifyWorker)
+func quickReconcile(ctx context.Context) error {
+	return reconcileWith(ctx, quickVerifyWorker)
 }
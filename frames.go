@@ -179,8 +179,8 @@ func serveFrame() {
 	}
 
 	s := &http.Server{
-		Handler: http.HandlerFunc(httpHandler),
+		Handler: http.HandlerFunc(frameHandler),
 	}
 
-	log.Fatal(s.Serve(ll))
+	serveUntilShutdown(s, func() error { return s.Serve(ll) })
 }
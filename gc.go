@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/cbfs/trace"
+)
+
+// Blobs referenced this recently are never collected.
+const gcRecentRef = 15 * time.Minute
+
+const gcGenKey = "/@gcgen"
+
+const gcInBackup = "in backup"
+
+// What garbage collection does with an unreferenced blob.
+type gcAction string
+
+const (
+	gcKeepBlob   = gcAction("keep")
+	gcMarkBlob   = gcAction("mark")
+	gcDeleteBlob = gcAction("delete")
+)
+
+// Recorded on a blob while it goes unreferenced.  First and Last are
+// the collection passes it was first and most recently found in.
+type gcMark struct {
+	Since time.Time `json:"since"`
+	First uint64    `json:"first"`
+	Last  uint64    `json:"last"`
+}
+
+// Move a blob found unreferenced in pass gen along toward
+// collection.  It's condemned once it's been found unreferenced in
+// at least two consecutive passes spanning the grace period.
+func (b *BlobOwnership) gcStep(gen uint64, now time.Time,
+	grace time.Duration) (gcAction, string) {
+
+	if b.Garbage {
+		return gcDeleteBlob, "already condemned"
+	}
+	ref := b.latestReference()
+	if now.Sub(ref) < gcRecentRef {
+		b.Unreferenced = nil
+		return gcKeepBlob, "recently used"
+	}
+
+	m := b.Unreferenced
+	if m == nil || m.Last+1 < gen || m.Since.Before(ref) {
+		b.Unreferenced = &gcMark{now, gen, gen}
+		return gcMarkBlob, "first unreferenced pass"
+	}
+	m.Last = gen
+	if m.First == gen {
+		return gcMarkBlob, "first unreferenced pass"
+	}
+	if until := m.Since.Add(grace); now.Before(until) {
+		return gcMarkBlob, fmt.Sprintf("in grace period until %v",
+			until.Format(time.RFC3339))
+	}
+	b.Garbage = true
+	return gcDeleteBlob, fmt.Sprintf("unreferenced since %v (passes %v-%v)",
+		m.Since.Format(time.RFC3339), m.First, m.Last)
+}
+
+// Decide what to do with an unreferenced blob, recording the
+// decision unless this is a dry run.
+func gcStepBlob(h string, gen uint64, dryRun bool) (BlobOwnership, gcAction, string, error) {
+	ownership := BlobOwnership{}
+	var action gcAction
+	var reason string
+	grace := globalConfig.GCGracePeriod
+
+	if dryRun {
+		err := couchbase.Get("/"+h, &ownership)
+		if err == nil {
+			action, reason = ownership.gcStep(gen, time.Now(), grace)
+		}
+		return ownership, action, reason, err
+	}
+
+	err := couchbase.Update("/"+h, 0, func(in []byte) ([]byte, error) {
+		ownership = BlobOwnership{}
+		if len(in) == 0 {
+			return nil, cb.UpdateCancel
+		}
+		if err := json.Unmarshal(in, &ownership); err != nil {
+			return nil, err
+		}
+		action, reason = ownership.gcStep(gen, time.Now(), grace)
+		return json.Marshal(ownership)
+	})
+	if err == cb.UpdateCancel {
+		err = errors.New("no ownership record")
+	}
+	return ownership, action, reason, err
+}
+
+// One blob copy considered for collection.
+type gcEntry struct {
+	OID    string   `json:"oid"`
+	Node   string   `json:"node,omitempty"`
+	Length int64    `json:"length"`
+	Nodes  []string `json:"nodes,omitempty"`
+	Action gcAction `json:"action"`
+	Reason string   `json:"reason"`
+}
+
+// Find the current collection pass, starting a new one unless this
+// is a dry run.
+func gcGeneration(dryRun bool) (uint64, error) {
+	if dryRun {
+		gen, err := couchbase.Incr(gcGenKey, 0, 0, 0)
+		return gen + 1, err
+	}
+	return couchbase.Incr(gcGenKey, 1, 1, 0)
+}
+
+// Walk the blob copies no file refers to, deciding what to do with
+// each.  Nothing is changed on a dry run.
+func walkGarbage(ctx context.Context, dryRun bool, visit func(gcEntry)) error {
+	tr := cbfstrace.FromContext(ctx)
+	sp := tr.Start("generation")
+	gen, err := gcGeneration(dryRun)
+	sp.End()
+	if err != nil {
+		return err
+	}
+
+	sp = tr.Start("backups")
+	backedup, err := loadExistingHashes()
+	sp.End()
+	if err != nil {
+		return err
+	}
+
+	viewRes := struct {
+		Rows []struct {
+			Key []string
+		}
+		Errors []cb.ViewError
+	}{}
+
+	progress := progressOf(ctx)
+	var decided gcEntry
+	startKey := "g"
+	done := false
+	for !done {
+		if err := ctx.Err(); err != nil {
+			log.Printf("Garbage collection stopped: %v", err)
+			return err
+		}
+		log.Printf("  gc loop at %#v", startKey)
+		// we hit this view descending because we want file sorted
+		// before blob the fact that we walk the list backwards
+		// hopefully not too awkward
+		sp := tr.Start("view")
+		err := couchbase.ViewCustom("cbfs", "file_blobs",
+			map[string]interface{}{
+				"stale":      false,
+				"descending": true,
+				"limit":      globalConfig.GCLimit + 1,
+				"startkey":   []string{startKey},
+			}, &viewRes)
+		sp.End()
+		if err != nil {
+			return err
+		}
+		done = len(viewRes.Rows) < globalConfig.GCLimit
+
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		progress.scanned(len(viewRes.Rows))
+
+		sp = tr.Start("sweep")
+		lastBlob := ""
+		for _, r := range viewRes.Rows {
+			if len(r.Key) < 3 {
+				log.Printf("Malformed key in gc result: %+v", r)
+				continue
+			}
+			blobId := r.Key[0]
+			typeFlag := r.Key[1]
+			blobNode := r.Key[2]
+			startKey = blobId
+
+			switch {
+			case typeFlag == "file":
+				lastBlob = blobId
+			case typeFlag != "blob" || blobId == lastBlob:
+			case blobNode == "":
+				visit(gcEntry{OID: blobId, Action: gcDeleteBlob,
+					Reason: "no owners"})
+			case decided.OID == blobId:
+				// Each copy gets its own row.
+				e := decided
+				e.Node = blobNode
+				visit(e)
+			default:
+				decided = gcEntry{OID: blobId, Node: blobNode}
+				if b, err := hex.DecodeString(blobId); err == nil &&
+					backedup.Contains(b) {
+
+					decided.Action, decided.Reason = gcKeepBlob, gcInBackup
+					visit(decided)
+					continue
+				}
+				own, action, reason, err := gcStepBlob(blobId, gen, dryRun)
+				if err != nil {
+					action, reason = gcKeepBlob, err.Error()
+				}
+				decided.Length = own.Length
+				for n := range own.Nodes {
+					decided.Nodes = append(decided.Nodes, n)
+				}
+				sort.Strings(decided.Nodes)
+				decided.Action, decided.Reason = action, reason
+				visit(decided)
+			}
+		}
+		sp.End()
+
+		if !dryRun && !relockTask("garbageCollectBlobs") {
+			log.Printf("We lost the lock for garbage collecting.")
+			return errors.New("Lost lock")
+		}
+	}
+	return nil
+}
+
+// Report what garbage collection would do right now.
+func doGCReport(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="gc-report.json"`)
+	w.WriteHeader(200)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	e := json.NewEncoder(w)
+	var encErr error
+	err := walkGarbage(ctx, true, func(g gcEntry) {
+		if encErr == nil {
+			if encErr = e.Encode(g); encErr != nil {
+				cancel()
+			}
+		}
+	})
+	if err == nil {
+		err = encErr
+	}
+	if err != nil {
+		log.Printf("Error producing gc report: %v", err)
+		e.Encode(map[string]string{"error": err.Error()})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCStep(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	grace := 12 * time.Hour
+	b := BlobOwnership{
+		Nodes: map[string]time.Time{"n1": start.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		gen    uint64
+		at     time.Duration
+		exp    gcAction
+		reason string
+	}{
+		{1, 0, gcMarkBlob, "first pass"},
+		{1, time.Minute, gcMarkBlob, "same pass again"},
+		{2, 8 * time.Hour, gcMarkBlob, "in grace"},
+		{3, 16 * time.Hour, gcDeleteBlob, "past grace"},
+		{4, 17 * time.Hour, gcDeleteBlob, "condemned"},
+	}
+	for _, test := range tests {
+		got, reason := b.gcStep(test.gen, start.Add(test.at), grace)
+		if got != test.exp {
+			t.Fatalf("%v: expected %v, got %v (%v)",
+				test.reason, test.exp, got, reason)
+		}
+	}
+	if !b.Garbage {
+		t.Errorf("Expected the blob to be condemned")
+	}
+}
+
+func TestGCStepInterrupted(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	grace := time.Hour
+	b := BlobOwnership{
+		Nodes: map[string]time.Time{"n1": start.Add(-time.Hour)},
+	}
+
+	if got, _ := b.gcStep(1, start, grace); got != gcMarkBlob {
+		t.Fatalf("Expected a mark, got %v", got)
+	}
+
+	// A pass that didn't see it unreferenced starts over.
+	if got, _ := b.gcStep(3, start.Add(2*time.Hour), grace); got != gcMarkBlob {
+		t.Fatalf("Expected a skipped pass to restart, got %v", got)
+	}
+	if b.Unreferenced.First != 3 {
+		t.Errorf("Expected the mark to restart at 3, got %+v", b.Unreferenced)
+	}
+
+	// Referring to it again cancels the sweep.
+	b.Referenced = start.Add(3 * time.Hour)
+	if got, _ := b.gcStep(4, start.Add(3*time.Hour+time.Minute), grace); got != gcKeepBlob {
+		t.Fatalf("Expected a recently used blob to be kept, got %v", got)
+	}
+	if b.Unreferenced != nil {
+		t.Errorf("Expected the mark to be cleared, got %+v", b.Unreferenced)
+	}
+
+	if got, _ := b.gcStep(5, start.Add(4*time.Hour), grace); got != gcMarkBlob {
+		t.Fatalf("Expected a fresh mark, got %v", got)
+	}
+	if got, _ := b.gcStep(6, start.Add(6*time.Hour), grace); got != gcDeleteBlob {
+		t.Fatalf("Expected deletion after two passes, got %v", got)
+	}
+}
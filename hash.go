@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"encoding/hex"
 	"fmt"
@@ -50,6 +51,21 @@ type hashRecord struct {
 	hashin  string
 	base    string
 	written int64
+	// Time spent writing to tmpf
+	diskTime time.Duration
+}
+
+// Adds the time spent in each write to *d.
+type timedWriter struct {
+	w io.Writer
+	d *time.Duration
+}
+
+func (t timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	*t.d += time.Since(start)
+	return n, err
 }
 
 func NewHashRecord(tmpdir, hashin string) (*hashRecord, error) {
@@ -60,13 +76,14 @@ func NewHashRecord(tmpdir, hashin string) (*hashRecord, error) {
 
 	sh := getHash()
 
-	return &hashRecord{
+	h := &hashRecord{
 		tmpf:   tmpf,
 		sh:     sh,
-		w:      io.MultiWriter(tmpf, sh),
 		hashin: hashin,
 		base:   *root,
-	}, nil
+	}
+	h.w = io.MultiWriter(timedWriter{tmpf, &h.diskTime}, sh)
+	return h, nil
 }
 
 func (h *hashRecord) Write(p []byte) (n int, err error) {
@@ -127,7 +144,7 @@ func (h *hashRecord) Close() error {
 	return nil
 }
 
-func cleanTmpFiles() error {
+func cleanTmpFiles(ctx context.Context) error {
 	d, err := os.Open(*root)
 	if err != nil {
 		return err
@@ -145,6 +162,7 @@ func cleanTmpFiles() error {
 
 			err = os.Remove(filepath.Join(*root, fn.Name()))
 			if err == nil {
+				progressOf(ctx).acted(1)
 				cleaned++
 			} else {
 				log.Printf("Error cleaning %v: %v",
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/dustin/go-humanize"
+)
+
+// How long readiness checks get before they count as failed.
+const readyCheckTimeout = 5 * time.Second
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// Each check says what it saw, or why the node isn't ready.
+var readyChecks = map[string]func() (string, error){
+	"couchbase": checkRegistered,
+	"storage":   checkStorageWritable,
+	"space":     checkFreeSpace,
+	"heartbeat": checkHeartbeatAge,
+	"clock":     checkClockDrift,
+}
+
+// Can we reach couchbase, and are we still in the node registry?
+func checkRegistered() (string, error) {
+	sn := StorageNode{}
+	err := couchbase.Get("/"+serverId, &sn)
+	switch {
+	case gomemcached.IsNotFound(err):
+		return "", errors.New("not in the node registry")
+	case err != nil:
+		return "", err
+	case sn.Leaving:
+		return "", errors.New("leaving the cluster")
+	}
+	return "registered as " + serverId, nil
+}
+
+func checkStorageWritable() (string, error) {
+	f, err := ioutil.TempFile(*root, "tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ready?"))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+	return *root + " is writable", nil
+}
+
+func checkFreeSpace() (string, error) {
+	avail := availableSpace()
+	detail := humanize.Bytes(uint64(avail)) + " available"
+	if avail < globalConfig.ReadyMinFree {
+		return "", fmt.Errorf("%v, need %v", detail,
+			humanize.Bytes(uint64(globalConfig.ReadyMinFree)))
+	}
+	return detail, nil
+}
+
+func checkHeartbeatAge() (string, error) {
+	last := atomic.LoadInt64(&lastHeartbeat)
+	if last == 0 {
+		return "", errors.New("no heartbeat recorded yet")
+	}
+	age := time.Since(time.Unix(0, last)).Truncate(time.Millisecond)
+	if age > globalConfig.ReadyHeartbeatAge {
+		return "", fmt.Errorf("last heartbeat %v ago", age)
+	}
+	return fmt.Sprintf("last heartbeat %v ago", age), nil
+}
+
+func checkClockDrift() (string, error) {
+	if atomic.LoadInt64(&clockChecked) == 0 {
+		return "not checked yet", nil
+	}
+	drift := time.Duration(atomic.LoadInt64(&clockDrift))
+	if drift > globalConfig.DriftWarnThresh {
+		return "", fmt.Errorf("clock is off by %v", drift)
+	}
+	return fmt.Sprintf("clock is off by %v", drift), nil
+}
+
+// Run the checks at once, failing any that take longer than timeout.
+func checkReadiness(checks map[string]func() (string, error),
+	timeout time.Duration) readiness {
+
+	rv := readiness{Ready: true, Checks: map[string]healthCheck{}}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, f := range checks {
+		wg.Add(1)
+		go func(name string, f func() (string, error)) {
+			defer wg.Done()
+			ch := make(chan healthCheck, 1)
+			go func() {
+				detail, err := f()
+				if err != nil {
+					ch <- healthCheck{Detail: err.Error()}
+					return
+				}
+				ch <- healthCheck{OK: true, Detail: detail}
+			}()
+			var hc healthCheck
+			select {
+			case hc = <-ch:
+			case <-time.After(timeout):
+				hc = healthCheck{Detail: fmt.Sprintf("timed out after %v", timeout)}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			rv.Checks[name] = hc
+			rv.Ready = rv.Ready && hc.OK
+		}(name, f)
+	}
+	wg.Wait()
+	return rv
+}
+
+// The process is up.
+func doHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"node":    serverId,
+		"version": VERSION,
+		"uptime":  time.Since(startTime).Truncate(time.Second).String(),
+	})
+}
+
+// The node should be given traffic.
+func doReadyz(w http.ResponseWriter, req *http.Request) {
+	r := checkReadiness(readyChecks, readyCheckTimeout)
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(r)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	r := checkReadiness(map[string]func() (string, error){
+		"good": func() (string, error) { return "fine", nil },
+		"bad":  func() (string, error) { return "", errors.New("on fire") },
+		"slow": func() (string, error) { <-block; return "", nil },
+	}, 10*time.Millisecond)
+
+	if r.Ready {
+		t.Errorf("Expected not ready with failing checks")
+	}
+	exp := map[string]healthCheck{
+		"good": {OK: true, Detail: "fine"},
+		"bad":  {Detail: "on fire"},
+		"slow": {Detail: "timed out after 10ms"},
+	}
+	for name, hc := range exp {
+		if r.Checks[name] != hc {
+			t.Errorf("Expected %v to be %+v, got %+v", name, hc, r.Checks[name])
+		}
+	}
+
+	r = checkReadiness(map[string]func() (string, error){
+		"good": func() (string, error) { return "fine", nil },
+	}, time.Second)
+	if !r.Ready {
+		t.Errorf("Expected ready with passing checks: %+v", r)
+	}
+}
+
+func TestCheckClockDrift(t *testing.T) {
+	defer atomic.StoreInt64(&clockChecked, 0)
+	defer atomic.StoreInt64(&clockDrift, 0)
+
+	if _, err := checkClockDrift(); err != nil {
+		t.Errorf("Expected an unchecked clock to be fine, got %v", err)
+	}
+
+	atomic.StoreInt64(&clockChecked, time.Now().UnixNano())
+	atomic.StoreInt64(&clockDrift, int64(globalConfig.DriftWarnThresh/2))
+	if _, err := checkClockDrift(); err != nil {
+		t.Errorf("Expected a small drift to be fine, got %v", err)
+	}
+
+	atomic.StoreInt64(&clockDrift, int64(globalConfig.DriftWarnThresh*2))
+	if _, err := checkClockDrift(); err == nil {
+		t.Errorf("Expected a large drift to fail")
+	}
+}
+
+func TestCheckHeartbeatAge(t *testing.T) {
+	defer atomic.StoreInt64(&lastHeartbeat, 0)
+
+	if _, err := checkHeartbeatAge(); err == nil {
+		t.Errorf("Expected an error before any heartbeat")
+	}
+	atomic.StoreInt64(&lastHeartbeat, time.Now().UnixNano())
+	if _, err := checkHeartbeatAge(); err != nil {
+		t.Errorf("Expected a fresh heartbeat to be fine, got %v", err)
+	}
+	atomic.StoreInt64(&lastHeartbeat,
+		time.Now().Add(-2*globalConfig.ReadyHeartbeatAge).UnixNano())
+	if _, err := checkHeartbeatAge(); err == nil {
+		t.Errorf("Expected an old heartbeat to fail")
+	}
+}
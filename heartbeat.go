@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,6 +16,16 @@ var noFSFree = errors.New("no filesystemFree")
 
 var spaceUsed int64
 
+// When this node last recorded a heartbeat (unix nanos).
+var lastHeartbeat int64
+
+var (
+	// Serializes heartbeats so nothing follows the final one.
+	heartbeatMu sync.Mutex
+	leaving     bool
+	startTime   = time.Now().UTC()
+)
+
 func availableSpace() int64 {
 	freeSpace, err := filesystemFree()
 	if err != nil {
@@ -83,7 +94,24 @@ func updateSpaceUsedLoop() {
 	}
 }
 
-func oneHeartbeat(startTime time.Time) {
+func oneHeartbeat() {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	if !leaving {
+		recordHeartbeat()
+	}
+}
+
+// Tell the cluster we're going away so it doesn't have to wait for
+// us to go stale.
+func finalHeartbeat() {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	leaving = true
+	recordHeartbeat()
+}
+
+func recordHeartbeat() {
 	u, err := url.Parse(*couchbaseServer)
 	c, err := net.Dial("tcp", u.Host)
 	localAddr := ""
@@ -102,12 +130,22 @@ func oneHeartbeat(startTime time.Time) {
 		Used:      spaceUsed,
 		Free:      availableSpace(),
 		Version:   VERSION,
+		Zone:      *zone,
+		Leaving:   leaving,
+
+		ClockDrift: time.Duration(atomic.LoadInt64(&clockDrift)),
+	}
+	if leaving {
+		// Nobody should send us anything.
+		aboutMe.Free = 0
 	}
 
 	err = couchbase.Set("/"+serverId, 0, aboutMe)
 	if err != nil {
 		log.Printf("Failed to record a heartbeat: %v", err)
+		return
 	}
+	atomic.StoreInt64(&lastHeartbeat, aboutMe.Time.UnixNano())
 }
 
 func heartbeat() {
@@ -116,7 +154,6 @@ func heartbeat() {
 	configChange := make(chan interface{})
 	confBroadcaster.Register(configChange)
 
-	startTime := time.Now().UTC()
 	go updateSpaceUsedLoop()
 
 	period := globalConfig.HeartbeatFreq
@@ -125,7 +162,7 @@ func heartbeat() {
 	for {
 		select {
 		case <-ticker.C:
-			oneHeartbeat(startTime)
+			oneHeartbeat()
 		case <-configChange:
 			if period != globalConfig.HeartbeatFreq {
 				period = globalConfig.HeartbeatFreq
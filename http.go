@@ -12,9 +12,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/trace"
 )
 
 const (
@@ -27,20 +29,32 @@ const (
 	fetchPrefix      = "/.cbfs/fetch/"
 	listPrefix       = "/.cbfs/list/"
 	configPrefix     = "/.cbfs/config/"
+	configSchemaPath = "/.cbfs/config/schema"
+	configHistPath   = "/.cbfs/config/history"
 	zipPrefix        = "/.cbfs/zip/"
 	tarPrefix        = "/.cbfs/tar/"
 	fsckPrefix       = "/.cbfs/fsck/"
+	gcReportPrefix   = "/.cbfs/gc/report/"
 	taskPrefix       = "/.cbfs/tasks/"
 	taskinfoPrefix   = "/.cbfs/tasks/info/"
+	taskQueuePrefix  = "/.cbfs/tasks/queue/"
+	taskCancelPrefix = "/.cbfs/tasks/cancel/"
+	taskHistPrefix   = "/.cbfs/tasks/history/"
 	pingPrefix       = "/.cbfs/ping/"
 	fileInfoPrefix   = "/.cbfs/info/file/"
 	framePrefix      = "/.cbfs/info/frames/"
 	markBackupPrefix = "/.cbfs/backup/mark/"
 	restorePrefix    = "/.cbfs/backup/restore/"
+	dataRestPrefix   = "/.cbfs/backup/data/restore/"
+	verifyBakPrefix  = "/.cbfs/backup/verify/"
 	backupStrmPrefix = "/.cbfs/backup/stream/"
 	backupPrefix     = "/.cbfs/backup/"
+	rebalancePrefix  = "/.cbfs/rebalance/"
 	quitPrefix       = "/.cbfs/exit/"
 	debugPrefix      = "/.cbfs/debug/"
+	healthPrefix     = "/.cbfs/health/"
+	// Also served at /metrics
+	metricsPrefix = "/.cbfs/metrics/"
 )
 
 type storInfo struct {
@@ -66,79 +80,112 @@ func sendJson(w http.ResponseWriter, req *http.Request, ob interface{}) {
 }
 
 // Given a Reader, we produce a new reader that will duplicate the
-// stream into the next available node and reproduce that content into
-// another node.  Iff that node successfully stores the content, we
-// return the hash it computed.
+// stream into each of the given nodes.  Each node that successfully
+// stores the content reports the hash it computed.
 //
 // The returned Reader must be consumed until the input EOFs or is
-// closed.  The returned channel may yield a storInfo struct before
-// it's closed.  If it's closed without yielding a storInfo, there are
-// no remote nodes available.
-func altStoreFile(name string, r io.Reader,
-	length int64) (io.Reader, <-chan storInfo) {
-
-	bgch := make(chan storInfo, 2)
-	if length == -1 {
-		// No alt store requested
-		close(bgch)
-		return r, bgch
-	}
-
-	nodes, err := findRemoteNodes()
-	nodes = nodes.withAtLeast(length)
-	if err == nil && len(nodes) > 0 {
-		r1, r2 := newMultiReader(r)
-		r = r2
-
-		go func() {
-			defer close(bgch)
-
-			rv := storInfo{node: nodes[0].Address()}
+// closed.  The returned channel yields exactly one storInfo per node
+// and is then closed.  A node that falls too far behind is dropped
+// from the stream and reports the error.
+func altStoreFile(reqID, name string, r io.Reader,
+	nodes NodeList, sp *cbfstrace.Span) (*fanoutReader, <-chan storInfo) {
+
+	rlog := reqLog(replLog, reqID)
+
+	bgch := make(chan storInfo, len(nodes))
+	f, readers := newFanoutReader(r, len(nodes))
+
+	wg := &sync.WaitGroup{}
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(n StorageNode, r1 io.Reader) {
+			defer wg.Done()
+
+			rv := storInfo{node: n.name}
+			nsp := sp.Start("secondary", "node", n.name)
+			send := func() {
+				nsp.Fail(rv.err)
+				nsp.End()
+				bgch <- rv
+			}
 
-			rurl := "http://" + nodes[0].Address() + blobPrefix
-			log.Printf("Piping secondary storage of %v to %v",
-				name, nodes[0])
+			rurl := "http://" + n.Address() + blobPrefix
+			rlog.Debugf("Piping secondary storage of %v to %v",
+				name, n)
 
 			preq, err := http.NewRequest("POST", rurl, r1)
 			if err != nil {
-				r1.CloseWithError(err)
 				rv.err = err
-				bgch <- rv
+				send()
 				return
 			}
+			setRequestID(preq, reqID)
 
-			presp, err := nodes[0].Client().Do(preq)
+			presp, err := n.Client().Do(preq)
 			if err == nil {
 				if presp.StatusCode != 201 {
-					rv.err = errors.New(presp.Status)
-					r1.CloseWithError(rv.err)
-					bgch <- rv
+					err = errors.New(presp.Status)
+				} else {
+					rv.hs = presp.Header.Get("X-CBFS-Hash")
 				}
-				_, err := io.Copy(ioutil.Discard, presp.Body)
+				_, e := io.Copy(ioutil.Discard, presp.Body)
 				if err == nil {
-					rv.hs = presp.Header.Get("X-CBFS-Hash")
+					err = e
 				}
 				presp.Body.Close()
 			} else {
-				log.Printf("Error http'n %v to %v: %v", name,
+				rlog.Errorf("Error http'n %v to %v: %v", name,
 					rurl, err)
 			}
 			rv.err = err
-			bgch <- rv
-		}()
-	} else {
-		log.Printf("Doing a single-node upload: findRemote=%v, status=%v",
-			nodes, errorOrSuccess(err))
+			send()
+		}(n, readers[i])
+	}
+
+	go func() {
+		wg.Wait()
 		close(bgch)
+	}()
+
+	return f, bgch
+}
+
+// Pick the nodes an upload will be synchronously copied to.
+func findSecondaries(length int64, count int) (NodeList, error) {
+	if count < 1 {
+		return NodeList{}, nil
+	}
+	nodes, err := findRemoteNodes()
+	if err != nil {
+		return nodes, err
+	}
+	nodes = nodes.withAtLeast(length)
+	if len(nodes) > count {
+		nodes = nodes[:count]
 	}
+	return nodes, nil
+}
 
-	return r, bgch
+// The number of copies an upload needs before we report success, and
+// whether the client explicitly asked for it.
+func writeQuorum(header http.Header) (int, bool, error) {
+	q := header.Get("X-CBFS-WriteQuorum")
+	if q == "" {
+		return globalConfig.WriteQuorum, false, nil
+	}
+	i, err := strconv.Atoi(q)
+	if err != nil || i < 1 {
+		return 0, true, fmt.Errorf("Invalid write quorum: %q", q)
+	}
+	return i, true, nil
 }
 
 func doPostRawBlob(w http.ResponseWriter, req *http.Request) {
+	rlog := reqLog(httpLog, requestID(req))
+
 	f, err := NewHashRecord(*root, "")
 	if err != nil {
-		log.Printf("Error writing tmp file: %v", err)
+		rlog.Errorf("Error writing tmp file: %v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -146,14 +193,14 @@ func doPostRawBlob(w http.ResponseWriter, req *http.Request) {
 
 	sh, length, err := f.Process(req.Body)
 	if err != nil {
-		log.Printf("Error linking in raw hash: %v", err)
+		rlog.Errorf("Error linking in raw hash: %v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	err = recordBlobOwnership(sh, length, true)
 	if err != nil {
-		log.Printf("Error recording ownership of %v: %v", sh, err)
+		rlog.Errorf("Error recording ownership of %v: %v", sh, err)
 		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
 			500)
 		return
@@ -173,36 +220,82 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 	}
 
 	fn, _ := resolvePath(req)
+	reqID := requestID(req)
+	rlog := reqLog(httpLog, reqID)
 
 	f, err := NewHashRecord(*root, req.Header.Get("X-CBFS-Hash"))
 	if err != nil {
-		log.Printf("Error writing tmp file: %v", err)
+		rlog.Errorf("Error writing tmp file: %v", err)
 		http.Error(w, "Error writing tmp file", 500)
 		return
 	}
 	defer f.Close()
 
+	quorum, explicit, err := writeQuorum(req.Header)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	unsafe, _ := strconv.ParseBool(req.Header.Get("X-CBFS-Unsafe"))
+	if unsafe && explicit {
+		http.Error(w, "X-CBFS-Unsafe can't be combined with X-CBFS-WriteQuorum", 400)
+		return
+	}
+
+	replicas := globalConfig.WriteReplicas
+	if replicas < quorum {
+		replicas = quorum
+	}
+
 	l := req.ContentLength
 	if l < 1 {
 		// If we don't know, guess about a meg.
 		l = 1024 * 1024
 	}
-	if t, _ := strconv.ParseBool(req.Header.Get("X-CBFS-Unsafe")); t {
-		l = -1
+	if unsafe {
+		replicas, quorum = 1, 1
+	}
+
+	nodes, err := findSecondaries(l, replicas-1)
+	if err != nil {
+		rlog.Warnf("Error finding secondaries for %v: %v",
+			req.URL.Path, err)
+	}
+	if len(nodes)+1 < quorum {
+		if explicit {
+			http.Error(w,
+				fmt.Sprintf("Only %v nodes available for write quorum of %v",
+					len(nodes)+1, quorum), 503)
+			return
+		}
+		rlog.Warnf("Only %v nodes available for %v, reducing quorum from %v",
+			len(nodes)+1, req.URL.Path, quorum)
+		quorum = len(nodes) + 1
 	}
-	r, bgch := altStoreFile(fn, req.Body, l)
+
+	tr := cbfstrace.FromContext(req.Context())
+	sp := tr.Start("write", "secondaries", strconv.Itoa(len(nodes)))
+	r, bgch := altStoreFile(reqID, fn, req.Body, nodes, sp)
 
 	h, length, err := f.Process(r)
+	sp.SetAttr("bytes", length)
+	sp.SetAttr("disk", f.diskTime)
+	sp.Fail(err)
+	sp.End()
 	if err != nil {
-		log.Printf("Error completing blob write for %v: %v",
+		r.CloseWithError(err)
+		rlog.Errorf("Error completing blob write for %v: %v",
 			req.URL.Path, err)
 		http.Error(w, fmt.Sprintf("Error completing blob write: %v", err), 500)
 		return
 	}
 
+	sp = tr.Start("ownership")
 	err = recordBlobOwnership(h, length, true)
+	sp.Fail(err)
+	sp.End()
 	if err != nil {
-		log.Printf("Error storing blob ownership of %v for %v: %v",
+		rlog.Errorf("Error storing blob ownership of %v for %v: %v",
 			h, req.URL.Path, err)
 		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
 			500)
@@ -216,32 +309,50 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 		Modified: time.Now().UTC(),
 	}
 
-	// We *should* have two replicas at this point.
-	replicas := 2
-	if si, hasStuff := <-bgch; hasStuff {
-		if si.err != nil || si.hs != h {
-			log.Printf("Error in secondary store of %v to %v for %v: %v",
+	sp = tr.Start("secondaries")
+	stored := 1
+	failedNodes, failures := []string{}, []string{}
+	for si := range bgch {
+		if si.err == nil && si.hs != h {
+			si.err = fmt.Errorf("hash mismatch: %v", si.hs)
+		}
+		if si.err != nil {
+			rlog.Warnf("Error in secondary store of %v to %v for %v: %v",
 				h, si.node, req.URL.Path, si.err)
-			http.Error(w,
-				fmt.Sprintf("Error creating sync secondary copy: %v\n%v",
-					si.err, si.hs), 500)
-
-			// We do have this item now, so even if it's
-			// not going to be linked to a file, we will
-			// increase the replica count to the minimum
-			// so we don't report underreplication.
-			if globalConfig.MinReplicas > 1 {
-				go increaseReplicaCount(h, length,
-					globalConfig.MinReplicas-1)
-			}
+			failedNodes = append(failedNodes, si.node)
+			failures = append(failures,
+				fmt.Sprintf("%v: %v", si.node, si.err))
+			continue
+		}
+		stored++
+	}
+	sp.SetAttr("stored", stored)
+	sp.End()
 
-			return
+	w.Header().Set("X-CBFS-Replicas", strconv.Itoa(stored))
+	if len(failedNodes) > 0 {
+		w.Header().Set("X-CBFS-FailedNodes", strings.Join(failedNodes, ","))
+	}
+
+	if stored < quorum {
+		// We do have this item now, so even if it's not going
+		// to be linked to a file, we will increase the replica
+		// count to the minimum so we don't report
+		// underreplication.
+		if globalConfig.MinReplicas > stored {
+			go increaseReplicaCount(h, length,
+				globalConfig.MinReplicas-stored, reqID)
 		}
-	} else {
-		// In this case, the upstream couldn't find a
-		// secondary for us.
-		log.Printf("Singly stored %v for %v", h, req.URL.Path)
-		replicas--
+
+		http.Error(w,
+			fmt.Sprintf("Write quorum not met: %v of %v copies stored, "+
+				"file metadata not stored\n%v",
+				stored, quorum, strings.Join(failures, "\n")), 500)
+		return
+	}
+
+	if stored == 1 {
+		rlog.Warnf("Singly stored %v for %v", h, req.URL.Path)
 	}
 
 	revs := globalConfig.DefaultVersionCount
@@ -255,27 +366,27 @@ func putUserFile(w http.ResponseWriter, req *http.Request) {
 
 	exp := getExpiration(req.Header)
 
-	err = storeMeta(fn, exp, fm, revs, req.Header)
+	err = storeMeta(req.Context(), fn, exp, fm, revs, req.Header)
 	if err == errUploadPrecondition {
-		log.Printf("Upload precondition failed: %v -> %v", fn, h)
+		rlog.Infof("Upload precondition failed: %v -> %v", fn, h)
 		http.Error(w, "precondition failed", 412)
 		return
 	}
 	if err != nil {
-		log.Printf("Error storing file meta of %v -> %v: %v",
+		rlog.Errorf("Error storing file meta of %v -> %v: %v",
 			fn, h, err)
 		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
 			500)
 		return
 	}
 
-	log.Printf("Wrote %v -> %v", req.URL.Path, h)
+	rlog.Infof("Wrote %v -> %v", req.URL.Path, h)
 
-	if globalConfig.MinReplicas > replicas {
+	if globalConfig.MinReplicas > stored {
 		// We're below min replica count.  Start fixing that
 		// up immediately.
 		go increaseReplicaCount(h, length,
-			globalConfig.MinReplicas-replicas)
+			globalConfig.MinReplicas-stored, reqID)
 	}
 
 	w.WriteHeader(201)
@@ -294,9 +405,10 @@ func putRawHash(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	rlog := reqLog(httpLog, requestID(req))
 	f, err := NewHashRecord(*root, inputhash)
 	if err != nil {
-		log.Printf("Error writing tmp file: %v", err)
+		rlog.Errorf("Error writing tmp file: %v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -304,14 +416,14 @@ func putRawHash(w http.ResponseWriter, req *http.Request) {
 
 	sh, length, err := f.Process(req.Body)
 	if err != nil {
-		log.Printf("Error linking in raw hash: %v", err)
+		rlog.Errorf("Error linking in raw hash: %v", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	err = recordBlobOwnership(inputhash, length, true)
 	if err != nil {
-		log.Printf("Error recording blob ownership of %v: %v",
+		rlog.Errorf("Error recording blob ownership of %v: %v",
 			inputhash, err)
 		http.Error(w, fmt.Sprintf("Error recording blob ownership: %v", err),
 			500)
@@ -327,6 +439,8 @@ func doPut(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case req.URL.Path == configPrefix:
 		putConfig(w, req)
+	case strings.HasPrefix(req.URL.Path, nodeConfigPrefix):
+		putNodeConfig(w, req, minusPrefix(req.URL.Path, nodeConfigPrefix))
 	case strings.HasPrefix(req.URL.Path, blobPrefix):
 		putRawHash(w, req)
 	case strings.HasPrefix(req.URL.Path, metaPrefix):
@@ -506,11 +620,13 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	f, err := openBlob(oid, req.Header.Get("X-CBFS-LocalOnly") != "")
+	f, err := openBlob(oid, req.Header.Get("X-CBFS-LocalOnly") != "",
+		requestID(req))
 	if err == nil {
 		// normal path
 		defer f.Close()
 	} else if notloc, ok := err.(errNotLocal); ok {
+		noteBlobSource(req, blobRedirect)
 		w.Header().Set("Location", notloc.urls[0])
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(300)
@@ -531,8 +647,10 @@ func doGetUserDoc(w http.ResponseWriter, req *http.Request) {
 
 	go recordBlobAccess(oid)
 	if r, ok := f.(io.ReadSeeker); ok {
+		noteBlobSource(req, blobLocal)
 		http.ServeContent(w, req, path, modified, r)
 	} else {
+		noteBlobSource(req, blobRemote)
 		w.WriteHeader(200)
 		_, err := io.Copy(w, f)
 		if err != nil {
@@ -556,12 +674,18 @@ func doServeRawBlob(w http.ResponseWriter, req *http.Request, oid string) {
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 
+	if req.Header.Get(backgroundHeader) != "" {
+		w = &throttledResponseWriter{w, bgSendThrottle}
+	}
+
+	noteBlobSource(req, blobLocal)
 	go recordBlobAccess(oid)
 	http.ServeContent(w, req, "", time.Time{}, f)
 }
 
 func getBlobFromRemote(w http.ResponseWriter, oid string,
-	respHeader http.Header, cachePerc int) error {
+	respHeader http.Header, cachePerc int, background bool,
+	reqID string) error {
 
 	// Find the owners of this blob
 	ownership, err := getBlobOwnership(oid)
@@ -572,7 +696,8 @@ func getBlobFromRemote(w http.ResponseWriter, oid string,
 		return err
 	}
 
-	f, err := openRemote(oid, ownership.Length, cachePerc, ownership.ResolveNodes())
+	f, err := openRemote(oid, ownership.Length, cachePerc,
+		ownership.ResolveNodes(), background, reqID)
 	if err != nil {
 		return err
 	}
@@ -641,7 +766,7 @@ func doFetchDoc(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	if !maybeQueueBlobFetch(path, req.Header.Get("X-Prevnode")) {
+	if !maybeQueueBlobFetch(path, req.Header.Get("X-Prevnode"), requestID(req)) {
 		http.Error(w, "Queue is full. Try later.", 503)
 		return
 	}
@@ -655,20 +780,44 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case req.URL.Path == pingPrefix:
 		doPing(w, req)
+	case req.URL.Path == metricsPrefix, req.URL.Path == "/metrics":
+		doMetrics(w, req)
+	case req.URL.Path == healthPrefix:
+		doClusterHealth(w, req)
+	case req.URL.Path == "/healthz":
+		doHealthz(w, req)
+	case req.URL.Path == "/readyz":
+		doReadyz(w, req)
 	case req.URL.Path == framePrefix:
 		doGetFramesData(w, req)
 	case req.URL.Path == blobPrefix:
 		doList(w, req)
 	case req.URL.Path == nodePrefix:
 		doListNodes(w, req)
+	case req.URL.Path == taskQueuePrefix:
+		doGetTaskQueue(w, req)
+	case req.URL.Path == taskHistPrefix:
+		doTaskHistory(w, req)
 	case req.URL.Path == taskinfoPrefix:
 		doListTaskInfo(w, req)
 	case req.URL.Path == taskPrefix:
 		doListTasks(w, req)
 	case req.URL.Path == configPrefix:
 		doGetConfig(w, req)
+	case req.URL.Path == configSchemaPath:
+		doGetConfigSchema(w, req)
+	case req.URL.Path == configHistPath:
+		doGetConfigHistory(w, req)
+	case req.URL.Path == effectiveConfigPath:
+		doGetEffectiveConfig(w, req)
+	case strings.HasPrefix(req.URL.Path, nodeConfigPrefix):
+		doGetNodeConfig(w, req, minusPrefix(req.URL.Path, nodeConfigPrefix))
+	case req.URL.Path == rebalancePrefix:
+		doRebalancePlan(w, req)
 	case strings.HasPrefix(req.URL.Path, backupStrmPrefix):
 		doExport(w, req, minusPrefix(req.URL.Path, backupStrmPrefix))
+	case req.URL.Path == verifyBakPrefix:
+		doVerifyBackup(w, req)
 	case req.URL.Path == backupPrefix:
 		doGetBackupInfo(w, req)
 	case strings.HasPrefix(req.URL.Path, fileInfoPrefix):
@@ -692,8 +841,12 @@ func doGet(w http.ResponseWriter, req *http.Request) {
 		doZipDocs(w, req, minusPrefix(req.URL.Path, zipPrefix))
 	case strings.HasPrefix(req.URL.Path, tarPrefix):
 		doTarDocs(w, req, minusPrefix(req.URL.Path, tarPrefix))
+	case req.URL.Path == gcReportPrefix:
+		doGCReport(w, req)
 	case strings.HasPrefix(req.URL.Path, fsckPrefix):
 		dofsck(w, req, minusPrefix(req.URL.Path, fsckPrefix))
+	case req.URL.Path == slowPrefix:
+		doSlowTraces(w, req)
 	case strings.HasPrefix(req.URL.Path, debugPrefix):
 		doDebug(w, req)
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
@@ -723,7 +876,7 @@ func doDeleteOID(w http.ResponseWriter, req *http.Request) {
 }
 
 func doDeleteUserDoc(w http.ResponseWriter, req *http.Request) {
-	_, k := resolvePath(req)
+	path, k := resolvePath(req)
 	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
 		existing := fileMeta{}
 		err := json.Unmarshal(in, &existing)
@@ -733,6 +886,9 @@ func doDeleteUserDoc(w http.ResponseWriter, req *http.Request) {
 		return nil, nil
 	})
 	if err == nil {
+		if err := recordTombstone(path); err != nil {
+			log.Printf("Error recording deletion of %v: %v", path, err)
+		}
 		w.WriteHeader(204)
 	} else if err == errUploadPrecondition {
 		http.Error(w, "precondition failed", 412)
@@ -745,6 +901,10 @@ func doDelete(w http.ResponseWriter, req *http.Request) {
 	switch {
 	case strings.HasPrefix(req.URL.Path, blobPrefix):
 		doDeleteOID(w, req)
+	case req.URL.Path == taskQueuePrefix:
+		doPurgeTaskQueue(w, req)
+	case strings.HasPrefix(req.URL.Path, restorePrefix):
+		doRestoreDeletion(w, req, minusPrefix(req.URL.Path, restorePrefix))
 	case *enableCRUDProxy && strings.HasPrefix(req.URL.Path, crudproxyPrefix):
 		proxyCRUDDelete(w, req, minusPrefix(req.URL.Path, crudproxyPrefix))
 	case strings.HasPrefix(req.URL.Path, "/.cbfs/"):
@@ -755,11 +915,7 @@ func doDelete(w http.ResponseWriter, req *http.Request) {
 }
 
 func doExit(w http.ResponseWriter, req *http.Request) {
-	time.AfterFunc(time.Second, func() {
-		log.Printf("Quitting per user request from %v",
-			req.RemoteAddr)
-		os.Exit(0)
-	})
+	go gracefulShutdown("user request from " + req.RemoteAddr)
 	w.WriteHeader(202)
 }
 
@@ -825,8 +981,12 @@ func doPost(w http.ResponseWriter, req *http.Request) {
 		doBlobInfo(w, req)
 	} else if strings.HasPrefix(req.URL.Path, markBackupPrefix) {
 		doMarkBackup(w, req)
+	} else if req.URL.Path == dataRestPrefix {
+		doRestoreData(w, req)
 	} else if strings.HasPrefix(req.URL.Path, restorePrefix) {
 		doRestoreDocument(w, req, minusPrefix(req.URL.Path, restorePrefix))
+	} else if strings.HasPrefix(req.URL.Path, taskCancelPrefix) {
+		doCancelTask(w, req, minusPrefix(req.URL.Path, taskCancelPrefix))
 	} else if strings.HasPrefix(req.URL.Path, taskPrefix) {
 		doInduceTask(w, req, minusPrefix(req.URL.Path, taskPrefix))
 	} else if strings.HasPrefix(req.URL.Path, backupPrefix) {
@@ -841,6 +1001,18 @@ func doPost(w http.ResponseWriter, req *http.Request) {
 }
 
 func httpHandler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	ensureRequestID(w, req)
+	sr := &statusRecorder{ResponseWriter: w}
+	req = startRequestTrace(withRecorder(req, sr))
+	defer func() {
+		took := time.Since(start)
+		finishRequestTrace(req, sr.code())
+		recordRequestMetrics(req, sr.code(), took)
+		logAccess(req, sr, start, took)
+	}()
+	w = sr
+
 	switch req.Method {
 	case "PUT":
 		doPut(w, req)
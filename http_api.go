@@ -19,6 +19,7 @@ import (
 	"github.com/couchbase/gomemcached"
 	"github.com/couchbase/gomemcached/client"
 	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/schedule"
 )
 
 func doGetConfig(w http.ResponseWriter, req *http.Request) {
@@ -27,11 +28,18 @@ func doGetConfig(w http.ResponseWriter, req *http.Request) {
 		log.Printf("Error updating config: %v", err)
 	}
 
+	// The cluster's config, without this node's overrides.
+	conf, err := currentStoredConfig()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(200)
 
 	e := json.NewEncoder(w)
-	err = e.Encode(&globalConfig)
+	err = e.Encode(&conf)
 	if err != nil {
 		log.Printf("Error sending config: %v", err)
 	}
@@ -48,6 +56,27 @@ func putConfig(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := validateConfig(conf); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	overrides, err := allNodeOverrides()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading node overrides: %v", err), 500)
+		return
+	}
+	if err := checkNodeOverrides(conf, overrides); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	old, err := currentStoredConfig()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading current config: %v", err), 500)
+		return
+	}
+
 	err = StoreConfig(conf)
 	if err != nil {
 		w.WriteHeader(500)
@@ -55,6 +84,15 @@ func putConfig(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if changes := diffConfigs(old, conf); len(changes) > 0 {
+		r := newConfigRevision(req, changes)
+		r.Config = &conf
+		prior := configRevision{Config: &old}
+		if err := recordConfigChange(r, prior); err != nil {
+			log.Printf("Error recording config change: %v", err)
+		}
+	}
+
 	err = updateConfig()
 	if err != nil {
 		log.Printf("Error fetching newly stored config: %v", err)
@@ -108,17 +146,45 @@ func doList(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+type taskInfo struct {
+	Excl     []string   `json:"excl"`
+	Schedule string     `json:"schedule"`
+	Heavy    bool       `json:"heavy,omitempty"`
+	Disabled bool       `json:"disabled,omitempty"`
+	Next     *time.Time `json:"next,omitempty"`
+}
+
+func describeTask(name string, r *periodicJobRecipe,
+	window cbfsschedule.Window) taskInfo {
+
+	s := taskSchedule(name, r.period)
+	rv := taskInfo{Excl: r.excl, Schedule: s.String(), Heavy: r.heavy,
+		Disabled: taskDisabled(name)}
+	// Only cron schedules fire at a time every node agrees on.
+	if cbfsschedule.Aligned(s) {
+		next := s.Next(time.Now())
+		if r.heavy {
+			next = window.NextOpen(next)
+		}
+		rv.Next = &next
+	}
+	return rv
+}
+
 func doListTaskInfo(w http.ResponseWriter, req *http.Request) {
 	res := struct {
-		Global map[string][]string `json:"global"`
-		Local  map[string][]string `json:"local"`
-	}{make(map[string][]string), make(map[string][]string)}
+		Global            map[string]taskInfo `json:"global"`
+		Local             map[string]taskInfo `json:"local"`
+		MaintenanceWindow string              `json:"maintenanceWindow,omitempty"`
+	}{make(map[string]taskInfo), make(map[string]taskInfo),
+		globalConfig.MaintenanceWindow}
 
+	window := maintenanceWindow()
 	for k, v := range globalPeriodicJobRecipes {
-		res.Global[k] = v.excl
+		res.Global[k] = describeTask(k, v, window)
 	}
 	for k, v := range localPeriodicJobRecipes {
-		res.Local[k] = v.excl
+		res.Local[k] = describeTask(k, v, window)
 	}
 
 	sendJson(w, req, res)
@@ -260,6 +326,8 @@ func doListNodes(w http.ResponseWriter, req *http.Request) {
 			"bindaddr":   node.BindAddr,
 			"framesbind": node.FrameBind,
 			"version":    node.Version,
+			"zone":       node.Zone,
+			"leaving":    node.Leaving,
 		}
 		// Grandfathering these in.
 		if !node.Started.IsZero() {
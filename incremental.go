@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+const tombstonePrefix = "/@tomb/"
+
+// Increments start a little before their base did, since change
+// times only sort correctly to the second.
+const incrementOverlap = time.Minute
+
+// Left behind when a file is deleted so incremental backups can
+// include the deletion.
+type tombstone struct {
+	Name    string    `json:"name"`
+	Deleted time.Time `json:"deleted"`
+	Type    string    `json:"type"`
+}
+
+func recordTombstone(fn string) error {
+	ts := tombstone{fn, time.Now().UTC(), "tombstone"}
+	exp := int(ts.Deleted.Add(globalConfig.TombstoneAge).Unix())
+	return couchbase.Set(shortName(tombstonePrefix+fn), exp, &ts)
+}
+
+// Find the backup an increment should build on.  An empty name means
+// the latest one.
+func findBackupBase(name string) (*backupItem, error) {
+	b := backups{}
+	err := couchbase.Get(backupKey, &b)
+	if err != nil {
+		if gomemcached.IsNotFound(err) {
+			err = errors.New("no previous backup to build on")
+		}
+		return nil, err
+	}
+	removeDeadBackups(&b)
+
+	var base *backupItem
+	for i := range b.Backups {
+		if name == "" || b.Backups[i].Fn == name {
+			base = &b.Backups[i]
+		}
+	}
+	switch {
+	case base == nil && name == "":
+		return nil, errors.New("no previous backup to build on")
+	case base == nil:
+		return nil, fmt.Errorf("no such backup: %v", name)
+	case base.Started.IsZero():
+		return nil, fmt.Errorf("backup %v predates incremental backups", base.Fn)
+	case time.Since(base.Started) > globalConfig.TombstoneAge:
+		return nil, fmt.Errorf("backup %v is older than the tombstone age (%v)",
+			base.Fn, globalConfig.TombstoneAge)
+	}
+	return base, nil
+}
+
+// Stream every file created, modified or deleted since the given
+// time, oldest change first.
+func streamChanges(w io.Writer, since time.Time) error {
+	viewRes := struct {
+		Rows []struct {
+			Key   string
+			Id    string
+			Value []string
+		}
+		Errors []cb.ViewError
+	}{}
+
+	enc := json.NewEncoder(w)
+	limit := 1000
+	params := map[string]interface{}{
+		"stale":    false,
+		"limit":    limit,
+		"startkey": since.Add(-incrementOverlap).UTC().Format(time.RFC3339Nano),
+	}
+	for {
+		err := couchbase.ViewCustom("cbfs", "file_changes", params, &viewRes)
+		if err != nil {
+			return err
+		}
+		if len(viewRes.Errors) > 0 {
+			return fmt.Errorf("View errors: %v", viewRes.Errors)
+		}
+
+		keys := []string{}
+		for _, r := range viewRes.Rows {
+			if len(r.Value) == 2 && r.Value[1] == "file" {
+				keys = append(keys, r.Id)
+			}
+		}
+		metas, err := couchbase.GetBulk(keys)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range viewRes.Rows {
+			if len(r.Value) != 2 {
+				log.Printf("Malformed change row: %+v", r)
+				continue
+			}
+			var ob interface{}
+			switch r.Value[1] {
+			case "tombstone":
+				ob = map[string]interface{}{
+					"path":    r.Value[0],
+					"deleted": r.Key,
+				}
+			case "file":
+				res, ok := metas[r.Id]
+				if !ok || res.Status != gomemcached.SUCCESS {
+					// Deleted since; its tombstone
+					// will turn up.
+					continue
+				}
+				fm := fileMeta{}
+				if err := json.Unmarshal(res.Body, &fm); err != nil {
+					log.Printf("Error decoding %v: %v", r.Id, err)
+					continue
+				}
+				ob = map[string]interface{}{
+					"path": r.Value[0],
+					"meta": fm,
+				}
+			}
+			if err := enc.Encode(ob); err != nil {
+				return err
+			}
+		}
+
+		if len(viewRes.Rows) < limit {
+			return nil
+		}
+		last := viewRes.Rows[len(viewRes.Rows)-1]
+		params["startkey"] = last.Key
+		params["startkey_docid"] = last.Id
+		params["skip"] = 1
+	}
+}
+
+// Store a restored file unless what's there is at least as new.
+func storeNewerMeta(k string, fm fileMeta, exp int) error {
+	err := couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
+		existing := fileMeta{}
+		if json.Unmarshal(in, &existing) == nil &&
+			!existing.Modified.Before(fm.Modified) {
+			return nil, cb.UpdateCancel
+		}
+		return json.Marshal(fm)
+	})
+	if err == cb.UpdateCancel {
+		err = errExists
+	}
+	return err
+}
+
+// Apply a deletion recorded in an incremental backup.
+func doRestoreDeletion(w http.ResponseWriter, req *http.Request, fn string) {
+	fn = strings.TrimLeft(fn, "/")
+	deleted, err := time.Parse(time.RFC3339Nano, req.FormValue("deleted"))
+	if fn == "" || err != nil {
+		http.Error(w, "A filename and deletion time are required", 400)
+		return
+	}
+
+	err = restoreDeletion(fn, deleted)
+	switch err {
+	case nil:
+		w.WriteHeader(204)
+	case errExists:
+		http.Error(w, "File was modified after it was deleted", 409)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// Delete a file unless it was modified after the deletion being
+// restored.
+func restoreDeletion(fn string, deleted time.Time) error {
+	found := false
+	err := couchbase.Update(shortName(fn), 0, func(in []byte) ([]byte, error) {
+		existing := fileMeta{}
+		if len(in) == 0 || json.Unmarshal(in, &existing) != nil {
+			return nil, cb.UpdateCancel
+		}
+		found = true
+		if existing.Modified.After(deleted) {
+			return nil, cb.UpdateCancel
+		}
+		return nil, nil
+	})
+	switch {
+	case err == cb.UpdateCancel && !found:
+		return nil
+	case err == cb.UpdateCancel:
+		return errExists
+	case err == nil:
+		log.Printf("Restored deletion of %v", fn)
+	}
+	return err
+}
@@ -112,6 +112,115 @@ func newMultiReader(r io.Reader) (ErrorCloser, io.Reader) {
 	return newMultiReaderTimeout(r, 15*time.Second)
 }
 
+// A fanoutReader copies everything read through it into a set of
+// secondary pipes.  Each secondary has its own queue so one that
+// falls behind by more than the timeout is dropped (its reader sees
+// Timeout) rather than stalling the primary or the others.
+//
+// Read and CloseWithError must be called from a single goroutine.
+type fanoutReader struct {
+	r       io.Reader
+	dests   []*fanoutDest
+	timeout time.Duration
+}
+
+type fanoutDest struct {
+	pw     *io.PipeWriter
+	ch     chan []byte
+	err    error
+	closed bool
+}
+
+const fanoutQueueLen = 64
+
+func (d *fanoutDest) run() {
+	var werr error
+	for b := range d.ch {
+		if werr == nil {
+			_, werr = d.pw.Write(b)
+		}
+	}
+	d.pw.CloseWithError(d.err)
+}
+
+func (d *fanoutDest) close(err error) {
+	if d.closed {
+		return
+	}
+	d.closed = true
+	d.err = err
+	if err != nil {
+		// Unblock any write in progress.
+		d.pw.CloseWithError(err)
+	}
+	close(d.ch)
+}
+
+func (d *fanoutDest) send(b []byte, timeout time.Duration) {
+	if d.closed {
+		return
+	}
+	select {
+	case d.ch <- b:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d.ch <- b:
+	case <-timer.C:
+		d.close(Timeout)
+	}
+}
+
+func (f *fanoutReader) Read(p []byte) (n int, err error) {
+	n, err = f.r.Read(p)
+	if n > 0 {
+		b := make([]byte, n)
+		copy(b, p[:n])
+		for _, d := range f.dests {
+			d.send(b, f.timeout)
+		}
+	}
+	if err != nil {
+		f.CloseWithError(err)
+	}
+	return
+}
+
+// Finish all secondaries.  io.EOF (or nil) finishes them normally,
+// anything else is passed along to their readers.
+func (f *fanoutReader) CloseWithError(err error) error {
+	if err == io.EOF {
+		err = nil
+	}
+	for _, d := range f.dests {
+		d.close(err)
+	}
+	return nil
+}
+
+func newFanoutReaderTimeout(r io.Reader, n int,
+	to time.Duration) (*fanoutReader, []io.Reader) {
+
+	f := &fanoutReader{r: r, timeout: to}
+	readers := make([]io.Reader, 0, n)
+	for i := 0; i < n; i++ {
+		pr, pw := io.Pipe()
+		d := &fanoutDest{pw: pw, ch: make(chan []byte, fanoutQueueLen)}
+		go d.run()
+		f.dests = append(f.dests, d)
+		readers = append(readers, pr)
+	}
+	return f, readers
+}
+
+func newFanoutReader(r io.Reader, n int) (*fanoutReader, []io.Reader) {
+	return newFanoutReaderTimeout(r, n, 15*time.Second)
+}
+
 type geezyWriter struct {
 	orig http.ResponseWriter
 	w    io.Writer
@@ -78,6 +78,44 @@ func TestMultiReaderSourceError(t *testing.T) {
 	}
 }
 
+func TestFanoutReader(t *testing.T) {
+	t.Parallel()
+
+	// Enough data to overflow a stalled secondary's queue.
+	size := int64(expSize * fanoutQueueLen * 2)
+
+	randomSrc := randomDataMaker{rand.NewSource(1028890720402726901)}
+	lr := io.LimitReader(&randomSrc, size)
+
+	f, rs := newFanoutReaderTimeout(lr, 2, 10*time.Millisecond)
+
+	b1 := &bytes.Buffer{}
+	b2 := &bytes.Buffer{}
+
+	res := make(chan copyRes, 1)
+	go bgCopy(b2, rs[0], res)
+
+	// rs[1] is never read, so it should be dropped without
+	// holding up the others.  (Hide ReadFrom to keep reads small.)
+	n, err := io.Copy(struct{ io.Writer }{b1}, f)
+	if err != nil || n != size {
+		t.Fatalf("Primary read %v bytes, err=%v", n, err)
+	}
+
+	res2 := <-res
+	if res2.e != nil || res2.s != size {
+		t.Fatalf("Secondary read %v bytes, err=%v", res2.s, res2.e)
+	}
+	if !reflect.DeepEqual(b1, b2) {
+		t.Fatalf("Didn't read the same data from the two things")
+	}
+
+	_, err = io.Copy(ioutil.Discard, rs[1])
+	if err != Timeout {
+		t.Fatalf("Expected a timeout on the stalled reader, got %v", err)
+	}
+}
+
 func BenchmarkRandomDataMaker(b *testing.B) {
 	randomSrc := randomDataMaker{rand.NewSource(1028890720402726901)}
 	for i := 0; i < b.N; i++ {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+var (
+	errLeaseHeld   = errors.New("lease is held by another node")
+	errLeaseFenced = errors.New("lease was granted to a newer holder")
+)
+
+// How long a released or expired lease's check is trusted.
+const leaseCheckInterval = time.Second
+
+// Stored for each held lease.  The token increases with every grant
+// so work done under an old lease can be told apart from work done
+// under a newer one.
+type leaseRecord struct {
+	Node    string    `json:"node"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Type    string    `json:"type"`
+}
+
+// Where leases live.
+type leaseBackend interface {
+	// Store the record if nobody holds the lease.
+	add(key string, rec leaseRecord, ttl time.Duration) (bool, error)
+	// Extend the lease if it's still held under rec's node and token.
+	renew(key string, rec leaseRecord, ttl time.Duration) (bool, error)
+	// Drop the lease if it's still held under rec's node and token.
+	release(key string, rec leaseRecord) error
+	// Get the lease's current record, if any.
+	get(key string) (leaseRecord, bool, error)
+	// Get the next fencing token for a key.
+	nextToken(key string) (uint64, error)
+}
+
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Hands out leases to a single node.
+type leaseService struct {
+	backend leaseBackend
+	clock   clock
+	node    string
+	ttl     func() time.Duration
+}
+
+func newLeaseService(b leaseBackend, c clock, node string,
+	ttl func() time.Duration) *leaseService {
+	return &leaseService{b, c, node, ttl}
+}
+
+// A lease held by this node.
+type lease struct {
+	svc *leaseService
+	key string
+	ttl time.Duration
+	rec leaseRecord
+
+	mu        sync.Mutex
+	expires   time.Time
+	lost      bool
+	fenced    bool
+	checked   time.Time
+	callbacks []func()
+	done      chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+	stopOnce  sync.Once
+}
+
+// Try to take the named lease.  Returns errLeaseHeld if another node
+// has it.  The lease is renewed in the background until released or
+// lost.
+func (s *leaseService) acquire(key string) (*lease, error) {
+	token, err := s.backend.nextToken(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := s.ttl()
+	start := s.clock.Now()
+	rec := leaseRecord{
+		Node:    s.node,
+		Token:   token,
+		Expires: start.Add(ttl).UTC(),
+		Type:    "lease",
+	}
+	ok, err := s.backend.add(key, rec, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errLeaseHeld
+	}
+
+	l := &lease{
+		svc:     s,
+		key:     key,
+		ttl:     ttl,
+		rec:     rec,
+		expires: start.Add(ttl),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go l.renewLoop()
+	return l, nil
+}
+
+// Who holds the named lease, if anyone.
+func (s *leaseService) holder(key string) (leaseRecord, bool, error) {
+	return s.backend.get(key)
+}
+
+// The fencing token this lease was granted with.
+func (l *lease) token() uint64 {
+	return l.rec.Token
+}
+
+// Refuse work done under this lease once a newer holder has been
+// granted it.  Losing the lease this way also runs OnLost callbacks.
+// A nil lease guards nothing.
+//
+// Nobody else can hold an unexpired lease, so the backend is only
+// asked once it's expired or released, and then at most every
+// leaseCheckInterval.
+func (l *lease) check() error {
+	if l == nil {
+		return nil
+	}
+	now := l.svc.clock.Now()
+	l.mu.Lock()
+	fenced := l.fenced
+	fresh := (!l.lost && now.Before(l.expires)) ||
+		now.Sub(l.checked) < leaseCheckInterval
+	l.mu.Unlock()
+	switch {
+	case fenced:
+		return errLeaseFenced
+	case fresh:
+		return nil
+	}
+
+	cur, held, err := l.svc.backend.get(l.key)
+	if err != nil {
+		return err
+	}
+	if held && cur.Token > l.rec.Token {
+		l.mu.Lock()
+		l.fenced = true
+		l.mu.Unlock()
+		l.lose(fmt.Sprintf("fenced by token %v from %v", cur.Token, cur.Node))
+		return errLeaseFenced
+	}
+	l.mu.Lock()
+	l.checked = now
+	l.mu.Unlock()
+	return nil
+}
+
+// True if we still hold the lease.
+func (l *lease) valid() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.lost && l.svc.clock.Now().Before(l.expires)
+}
+
+// Closed when the lease is lost or released.
+func (l *lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Call f if the lease is lost.  If it's already lost, f is called
+// right away.
+func (l *lease) OnLost(f func()) {
+	l.mu.Lock()
+	if !l.lost {
+		l.callbacks = append(l.callbacks, f)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	f()
+}
+
+func (l *lease) lose(why string) {
+	l.mu.Lock()
+	if l.lost {
+		l.mu.Unlock()
+		return
+	}
+	l.lost = true
+	cbs := l.callbacks
+	l.callbacks = nil
+	l.mu.Unlock()
+
+	log.Printf("Lost lease %v (token %v): %v", l.key, l.rec.Token, why)
+	l.closeOnce.Do(func() { close(l.done) })
+	for _, f := range cbs {
+		f()
+	}
+}
+
+// Extend the lease once.  Returns false if it's been lost.
+func (l *lease) renew() bool {
+	start := l.svc.clock.Now()
+	rec := l.rec
+	rec.Expires = start.Add(l.ttl).UTC()
+
+	ok, err := l.svc.backend.renew(l.key, rec, l.ttl)
+	switch {
+	case err != nil:
+		log.Printf("Error renewing lease %v: %v", l.key, err)
+		l.mu.Lock()
+		expired := !l.svc.clock.Now().Before(l.expires)
+		l.mu.Unlock()
+		if expired {
+			l.lose("expired while unable to renew")
+			return false
+		}
+		return true
+	case !ok:
+		l.lose("taken over by another node")
+		return false
+	}
+
+	l.mu.Lock()
+	l.expires = start.Add(l.ttl)
+	l.mu.Unlock()
+	return true
+}
+
+func (l *lease) renewLoop() {
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-l.svc.clock.After(l.ttl / 3):
+		}
+		if !l.renew() {
+			return
+		}
+	}
+}
+
+// Give up the lease.
+func (l *lease) release() {
+	l.stopOnce.Do(func() { close(l.stop) })
+	l.mu.Lock()
+	wasLost := l.lost
+	l.lost = true
+	l.callbacks = nil
+	l.mu.Unlock()
+	l.closeOnce.Do(func() { close(l.done) })
+
+	if !wasLost {
+		if err := l.svc.backend.release(l.key, l.rec); err != nil {
+			log.Printf("Error releasing lease %v: %v", l.key, err)
+		}
+	}
+}
+
+// Leases stored in couchbase.
+type cbLeaseBackend struct{}
+
+// Memcached expirations are in whole seconds.
+func leaseExp(ttl time.Duration) int {
+	return int((ttl + time.Second - 1) / time.Second)
+}
+
+func (cbLeaseBackend) add(key string, rec leaseRecord, ttl time.Duration) (bool, error) {
+	return couchbase.Add(key, leaseExp(ttl), rec)
+}
+
+func sameHolder(in []byte, rec leaseRecord) bool {
+	cur := leaseRecord{}
+	err := json.Unmarshal(in, &cur)
+	return err == nil && cur.Node == rec.Node && cur.Token == rec.Token
+}
+
+func (cbLeaseBackend) renew(key string, rec leaseRecord, ttl time.Duration) (bool, error) {
+	err := couchbase.Update(key, leaseExp(ttl), func(in []byte) ([]byte, error) {
+		if !sameHolder(in, rec) {
+			return nil, cb.UpdateCancel
+		}
+		return json.Marshal(rec)
+	})
+	if err == cb.UpdateCancel {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (cbLeaseBackend) release(key string, rec leaseRecord) error {
+	err := couchbase.Update(key, 0, func(in []byte) ([]byte, error) {
+		if !sameHolder(in, rec) {
+			return nil, cb.UpdateCancel
+		}
+		return nil, nil
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+func (cbLeaseBackend) get(key string) (leaseRecord, bool, error) {
+	rec := leaseRecord{}
+	err := couchbase.Get(key, &rec)
+	if gomemcached.IsNotFound(err) {
+		return rec, false, nil
+	}
+	return rec, err == nil, err
+}
+
+func (cbLeaseBackend) nextToken(key string) (uint64, error) {
+	return couchbase.Incr(key+"/fence", 1, 1, 0)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	kept := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			kept = append(kept, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = kept
+}
+
+// Leases in memory, expiring on the fake clock.
+type memLeaseBackend struct {
+	clock  *fakeClock
+	mu     sync.Mutex
+	leases map[string]leaseRecord
+	tokens map[string]uint64
+	fail   error
+	gets   int
+}
+
+func newMemLeaseBackend(c *fakeClock) *memLeaseBackend {
+	return &memLeaseBackend{clock: c,
+		leases: map[string]leaseRecord{}, tokens: map[string]uint64{}}
+}
+
+func (m *memLeaseBackend) liveLocked(key string) (leaseRecord, bool) {
+	rec, ok := m.leases[key]
+	if ok && !m.clock.Now().Before(rec.Expires) {
+		delete(m.leases, key)
+		ok = false
+	}
+	return rec, ok
+}
+
+func (m *memLeaseBackend) add(key string, rec leaseRecord, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.liveLocked(key); ok {
+		return false, nil
+	}
+	m.leases[key] = rec
+	return true, nil
+}
+
+func (m *memLeaseBackend) renew(key string, rec leaseRecord, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return false, m.fail
+	}
+	cur, ok := m.liveLocked(key)
+	if !ok || cur.Node != rec.Node || cur.Token != rec.Token {
+		return false, nil
+	}
+	m.leases[key] = rec
+	return true, nil
+}
+
+func (m *memLeaseBackend) release(key string, rec leaseRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.liveLocked(key); ok && cur.Token == rec.Token {
+		delete(m.leases, key)
+	}
+	return nil
+}
+
+func (m *memLeaseBackend) get(key string) (leaseRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gets++
+	if m.fail != nil {
+		return leaseRecord{}, false, m.fail
+	}
+	rec, ok := m.liveLocked(key)
+	return rec, ok, nil
+}
+
+func (m *memLeaseBackend) nextToken(key string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[key]++
+	return m.tokens[key], nil
+}
+
+func testLeases(t *testing.T) (*fakeClock, *memLeaseBackend, *leaseService, *leaseService) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	b := newMemLeaseBackend(c)
+	ttl := func() time.Duration { return 30 * time.Second }
+	return c, b, newLeaseService(b, c, "a", ttl), newLeaseService(b, c, "b", ttl)
+}
+
+func TestLeaseExclusion(t *testing.T) {
+	_, _, a, b := testLeases(t)
+
+	la, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	if _, err := b.acquire("k"); err != errLeaseHeld {
+		t.Fatalf("Expected lease to be held, got %v", err)
+	}
+
+	la.release()
+	select {
+	case <-la.Done():
+	default:
+		t.Errorf("Expected release to finish the lease")
+	}
+
+	lb, err := b.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring released lease: %v", err)
+	}
+	defer lb.release()
+	if lb.token() <= la.token() {
+		t.Errorf("Expected fencing token to increase: %v then %v",
+			la.token(), lb.token())
+	}
+	if rec, held, _ := b.holder("k"); !held || rec.Node != "b" {
+		t.Errorf("Expected b to hold the lease, got %+v/%v", rec, held)
+	}
+}
+
+func TestLeaseRenewal(t *testing.T) {
+	c, _, a, _ := testLeases(t)
+
+	l, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	defer l.release()
+
+	for i := 0; i < 10; i++ {
+		c.advance(10 * time.Second)
+		if !l.renew() {
+			t.Fatalf("Failed to renew at step %v", i)
+		}
+	}
+	if !l.valid() {
+		t.Errorf("Expected renewed lease to still be valid")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	c, _, a, b := testLeases(t)
+
+	l, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	lost := make(chan bool, 1)
+	l.OnLost(func() { lost <- true })
+
+	// Without renewal the lease expires and someone else takes it.
+	l.stopOnce.Do(func() { close(l.stop) })
+	c.advance(31 * time.Second)
+	if l.valid() {
+		t.Errorf("Expected expired lease to be invalid")
+	}
+	lb, err := b.acquire("k")
+	if err != nil {
+		t.Fatalf("Error taking expired lease: %v", err)
+	}
+	defer lb.release()
+
+	if l.renew() {
+		t.Errorf("Expected renewal of a stolen lease to fail")
+	}
+	select {
+	case <-lost:
+	default:
+		t.Errorf("Expected lost callback")
+	}
+	select {
+	case <-l.Done():
+	default:
+		t.Errorf("Expected lost lease to be done")
+	}
+
+	called := false
+	l.OnLost(func() { called = true })
+	if !called {
+		t.Errorf("Expected late callback to run immediately")
+	}
+}
+
+func TestLeaseRenewFailures(t *testing.T) {
+	c, back, a, _ := testLeases(t)
+
+	l, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	defer l.release()
+
+	back.mu.Lock()
+	back.fail = errLeaseHeld
+	back.mu.Unlock()
+	c.advance(10 * time.Second)
+	if !l.renew() || !l.valid() {
+		t.Fatalf("Expected lease to survive a failed renewal")
+	}
+	c.advance(25 * time.Second)
+	if l.renew() || l.valid() {
+		t.Fatalf("Expected lease to be lost once it expired")
+	}
+}
+
+func TestLeaseRenewLoop(t *testing.T) {
+	c, back, a, _ := testLeases(t)
+
+	l, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	defer l.release()
+
+	// Someone else stomps on it; the next renewal notices.
+	back.mu.Lock()
+	back.leases["k"] = leaseRecord{Node: "b", Token: 99,
+		Expires: c.Now().Add(time.Hour)}
+	back.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.advance(10 * time.Second)
+		select {
+		case <-l.Done():
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatalf("Expected the renewal loop to notice the lost lease")
+}
+
+func TestLeaseFencing(t *testing.T) {
+	c, _, a, b := testLeases(t)
+
+	la, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), taskLeaseCtxKey{}, la)
+	if err := checkFence(ctx); err != nil {
+		t.Fatalf("Expected holder's write to be allowed, got %v", err)
+	}
+
+	// a stalls long enough for its lease to expire and b to take it.
+	la.stopOnce.Do(func() { close(la.stop) })
+	c.advance(31 * time.Second)
+	lb, err := b.acquire("k")
+	if err != nil {
+		t.Fatalf("Error taking expired lease: %v", err)
+	}
+	defer lb.release()
+
+	// When a wakes up, its writes are refused and it gives up.
+	if err := checkFence(ctx); err != errLeaseFenced {
+		t.Errorf("Expected stale holder's write to be refused, got %v", err)
+	}
+	select {
+	case <-la.Done():
+	default:
+		t.Errorf("Expected fenced lease to be lost")
+	}
+	if err := lb.check(); err != nil {
+		t.Errorf("Expected new holder's write to be allowed, got %v", err)
+	}
+	if err := checkFence(context.Background()); err != nil {
+		t.Errorf("Expected unleased writes to be unguarded, got %v", err)
+	}
+
+	task := internodeTask{cmd: removeObjectCmd, oid: "x", fence: la}
+	if err := runInternodeTask(task); err != errLeaseFenced {
+		t.Errorf("Expected stale removal to be dropped, got %v", err)
+	}
+}
+
+func TestLeaseCheckCaching(t *testing.T) {
+	c, back, a, _ := testLeases(t)
+
+	l, err := a.acquire("k")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	l.stopOnce.Do(func() { close(l.stop) })
+
+	// A live lease needs no lookups.
+	for i := 0; i < 3; i++ {
+		if err := l.check(); err != nil {
+			t.Fatalf("Expected a live lease to pass, got %v", err)
+		}
+	}
+	if back.gets != 0 {
+		t.Errorf("Expected no lookups for a live lease, got %v", back.gets)
+	}
+
+	// Once it's expired, a failed lookup is an error, not fencing.
+	c.advance(31 * time.Second)
+	back.mu.Lock()
+	back.fail = errLeaseHeld
+	back.mu.Unlock()
+	if err := l.check(); err != errLeaseHeld {
+		t.Errorf("Expected the lookup error, got %v", err)
+	}
+	task := internodeTask{cmd: removeObjectCmd, oid: "x", fence: l}
+	if err := runInternodeTask(task); err != errLeaseHeld {
+		t.Errorf("Expected the task to fail for a retry, got %v", err)
+	}
+
+	// A good answer is trusted for a while.
+	back.mu.Lock()
+	back.fail = nil
+	back.gets = 0
+	back.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := l.check(); err != nil {
+			t.Fatalf("Expected an unclaimed lease to pass, got %v", err)
+		}
+	}
+	if back.gets != 1 {
+		t.Errorf("Expected one lookup, got %v", back.gets)
+	}
+	c.advance(leaseCheckInterval)
+	l.check()
+	if back.gets != 2 {
+		t.Errorf("Expected another lookup after %v, got %v",
+			leaseCheckInterval, back.gets)
+	}
+}
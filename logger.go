@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/logger"
+)
+
+var logFormat = flag.String("logFormat", cbfslogger.Text,
+	"Log format: text, logfmt or json")
+var logLevel = flag.String("logLevel", "info",
+	"Minimum log level, optionally by subsystem (e.g. info,http=debug)")
+
+// Correlates the log lines of one request across nodes.
+const requestIDHeader = "X-CBFS-Request-ID"
+
+var (
+	mainLog  = cbfslogger.New("main")
+	httpLog  = cbfslogger.New("http")
+	replLog  = cbfslogger.New("replication")
+	queueLog = cbfslogger.New("taskqueue")
+	taskLog  = cbfslogger.New("tasks")
+)
+
+func initLogger(slog bool) {
+	w, stamp := io.Writer(os.Stderr), true
+	if slog {
+		if lw := initSyslog(); lw != nil {
+			w, stamp = lw, false
+		}
+	}
+	if err := cbfslogger.Configure(w, *logFormat, stamp); err != nil {
+		log.Fatalf("Can't initialize logging: %v", err)
+	}
+	if err := cbfslogger.SetLevels(*logLevel); err != nil {
+		log.Fatalf("Can't initialize logging: %v", err)
+	}
+
+	// Everything still using the log package is info from main, but
+	// it's never filtered since it includes errors and log.Fatalf.
+	log.SetFlags(0)
+	log.SetOutput(mainLog.UnfilteredWriter(cbfslogger.Info))
+}
+
+func newRequestID() string {
+	return fmt.Sprintf("%016x", uint64(rand.Int63()))
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Use the request ID a client or another node sent, or make one up,
+// and hand it back in the response.
+func ensureRequestID(w http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+func requestID(req *http.Request) string {
+	return req.Header.Get(requestIDHeader)
+}
+
+// Carry a request ID on to an internode request.
+func setRequestID(req *http.Request, id string) {
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// A logger tagging lines with the request they're for.
+func reqLog(l *cbfslogger.Logger, id string) *cbfslogger.Logger {
+	return l.With("reqid", id)
+}
@@ -0,0 +1,290 @@
+// Leveled, structured logging by subsystem.
+//
+// Every line has a time, level, subsystem and message, plus whatever
+// fields were attached with With.  Lines are written as plain text,
+// logfmt or JSON, and each subsystem may log at its own minimum level.
+package cbfslogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How important a log line is.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// Parse a level name.
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		return Warn, nil
+	}
+	for i, n := range levelNames {
+		if s == n {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Line formats.
+const (
+	Text   = "text"
+	Logfmt = "logfmt"
+	JSON   = "json"
+)
+
+var out = struct {
+	sync.Mutex
+	w      io.Writer
+	format string
+	stamp  bool
+	level  Level
+	levels map[string]Level
+}{w: os.Stderr, format: Text, stamp: true, level: Info,
+	levels: map[string]Level{}}
+
+// For tests.
+var now = time.Now
+
+// Set where lines go and how they look.  Leave stamp off when the
+// writer adds its own times, as syslog does.
+func Configure(w io.Writer, format string, stamp bool) error {
+	switch format {
+	case Text, Logfmt, JSON:
+	default:
+		return fmt.Errorf("unknown log format: %q", format)
+	}
+	out.Lock()
+	defer out.Unlock()
+	out.w, out.format, out.stamp = w, format, stamp
+	return nil
+}
+
+// Set the minimum levels from a list like "info,http=debug,tasks=warn".
+// A bare level is the default for subsystems not named.
+func SetLevels(spec string) error {
+	def, levels := Info, map[string]Level{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		sub, name := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			sub, name = strings.TrimSpace(part[:i]), part[i+1:]
+		}
+		l, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		if sub == "" {
+			def = l
+		} else {
+			levels[sub] = l
+		}
+	}
+	out.Lock()
+	defer out.Unlock()
+	out.level, out.levels = def, levels
+	return nil
+}
+
+// Whether a subsystem logs at a level.
+func Enabled(subsystem string, l Level) bool {
+	out.Lock()
+	defer out.Unlock()
+	min, ok := out.levels[subsystem]
+	if !ok {
+		min = out.level
+	}
+	return l >= min
+}
+
+type field struct {
+	k string
+	v interface{}
+}
+
+// Logs for one subsystem.
+type Logger struct {
+	subsystem string
+	fields    []field
+}
+
+func New(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// A logger adding the given key/value pairs to every line.  Pairs
+// with an empty string value are left off, so an unknown request ID
+// doesn't clutter the log.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	rv := &Logger{subsystem: l.subsystem,
+		fields: append([]field{}, l.fields...)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if s, ok := kv[i+1].(string); ok && s == "" {
+			continue
+		}
+		rv.fields = append(rv.fields, field{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+	return rv
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(Debug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(Info, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(Warn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(Error, format, args...)
+}
+
+// Log an error and exit.  This is never filtered.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.write(Error, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if Enabled(l.subsystem, level) {
+		l.Log(level, fmt.Sprintf(format, args...))
+	}
+}
+
+// Write one line if the subsystem logs at level.
+func (l *Logger) Log(level Level, msg string) {
+	if Enabled(l.subsystem, level) {
+		l.write(level, msg)
+	}
+}
+
+func (l *Logger) write(level Level, msg string) {
+	msg = strings.TrimRight(msg, "\n")
+	out.Lock()
+	defer out.Unlock()
+	var line string
+	switch out.format {
+	case JSON:
+		line = l.formatJSON(level, msg)
+	case Logfmt:
+		line = l.formatLogfmt(level, msg)
+	default:
+		line = l.formatText(level, msg)
+	}
+	io.WriteString(out.w, line+"\n")
+}
+
+func (l *Logger) formatText(level Level, msg string) string {
+	parts := []string{}
+	if out.stamp {
+		parts = append(parts, now().Format("2006/01/02 15:04:05"))
+	}
+	parts = append(parts, strings.ToUpper(level.String()),
+		"["+l.subsystem+"]", msg)
+	for _, f := range l.fields {
+		parts = append(parts, f.k+"="+logfmtValue(f.v))
+	}
+	return strings.Join(parts, " ")
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *Logger) formatLogfmt(level Level, msg string) string {
+	parts := []string{}
+	if out.stamp {
+		parts = append(parts, "time="+now().UTC().Format(time.RFC3339Nano))
+	}
+	parts = append(parts, "level="+level.String(),
+		"subsystem="+logfmtValue(l.subsystem), "msg="+logfmtValue(msg))
+	for _, f := range l.fields {
+		parts = append(parts, f.k+"="+logfmtValue(f.v))
+	}
+	return strings.Join(parts, " ")
+}
+
+func jsonValue(v interface{}) string {
+	if e, ok := v.(error); ok {
+		v = e.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+func (l *Logger) formatJSON(level Level, msg string) string {
+	parts := []string{}
+	if out.stamp {
+		parts = append(parts, `"time":`+jsonValue(now().UTC()))
+	}
+	parts = append(parts, `"level":`+jsonValue(level.String()),
+		`"subsystem":`+jsonValue(l.subsystem), `"msg":`+jsonValue(msg))
+	for _, f := range l.fields {
+		parts = append(parts, jsonValue(f.k)+":"+jsonValue(f.v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type levelWriter struct {
+	l      *Logger
+	level  Level
+	filter bool
+}
+
+func (w levelWriter) Write(b []byte) (int, error) {
+	if w.filter {
+		w.l.Log(w.level, string(b))
+	} else {
+		w.l.write(w.level, string(b))
+	}
+	return len(b), nil
+}
+
+// Log every write at level.
+func (l *Logger) Writer(level Level) io.Writer {
+	return levelWriter{l, level, true}
+}
+
+// Log every write at level, whatever the minimum level is.  For
+// output of unknown importance, like the standard log package's,
+// which may be an error or about to exit.
+func (l *Logger) UnfilteredWriter(level Level) io.Writer {
+	return levelWriter{l, level, false}
+}
@@ -0,0 +1,89 @@
+package cbfslogger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func capture(t *testing.T, format string, stamp bool) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	if err := Configure(buf, format, stamp); err != nil {
+		t.Fatalf("Error configuring %v: %v", format, err)
+	}
+	now = func() time.Time {
+		return time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	}
+	return buf
+}
+
+func reset() {
+	Configure(os.Stderr, Text, true)
+	SetLevels("info")
+	now = time.Now
+}
+
+func TestFormats(t *testing.T) {
+	defer reset()
+	tests := []struct {
+		format string
+		exp    string
+	}{
+		{Text, `2026/10/18 12:30:00 WARN [http] slow "thing" reqid=abc err="bad news"` + "\n"},
+		{Logfmt, `time=2026-10-18T12:30:00Z level=warn subsystem=http msg="slow \"thing\"" reqid=abc err="bad news"` + "\n"},
+		{JSON, `{"time":"2026-10-18T12:30:00Z","level":"warn","subsystem":"http","msg":"slow \"thing\"","reqid":"abc","err":"bad news"}` + "\n"},
+	}
+	for _, test := range tests {
+		buf := capture(t, test.format, true)
+		New("http").With("reqid", "abc", "node", "", "err", errors.New("bad news")).
+			Warnf("slow %q", "thing")
+		if buf.String() != test.exp {
+			t.Errorf("%v:\nexpected %s\ngot      %s", test.format, test.exp, buf)
+		}
+	}
+
+	if err := Configure(os.Stderr, "xml", true); err == nil {
+		t.Errorf("Expected an error configuring an unknown format")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	defer reset()
+	buf := capture(t, Text, false)
+	if err := SetLevels("warn, http=debug,tasks=error"); err != nil {
+		t.Fatalf("Error setting levels: %v", err)
+	}
+
+	New("http").Debugf("a")
+	New("tasks").Warnf("b")
+	New("tasks").Errorf("c")
+	New("main").Infof("d")
+	New("main").Writer(Warn).Write([]byte("e\n"))
+	New("main").Writer(Info).Write([]byte("f\n"))
+	New("main").UnfilteredWriter(Info).Write([]byte("g\n"))
+
+	exp := "DEBUG [http] a\nERROR [tasks] c\nWARN [main] e\nINFO [main] g\n"
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%vgot:\n%v", exp, buf)
+	}
+
+	for _, spec := range []string{"loud", "http=", "http=verbose"} {
+		if err := SetLevels(spec); err == nil {
+			t.Errorf("Expected an error setting levels %q", spec)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{Debug, Info, Warn, Error} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("Round trip of %v gave %v/%v", l, got, err)
+		}
+	}
+	if got, err := ParseLevel("WARNING"); err != nil || got != Warn {
+		t.Errorf("Expected WARNING to be warn, got %v/%v", got, err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEnsureRequestID(t *testing.T) {
+	req := httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set(requestIDHeader, "upload-42")
+	w := httptest.NewRecorder()
+	if id := ensureRequestID(w, req); id != "upload-42" {
+		t.Errorf("Expected the client's ID kept, got %v", id)
+	}
+	if got := w.Header().Get(requestIDHeader); got != "upload-42" {
+		t.Errorf("Expected the ID in the response, got %v", got)
+	}
+
+	for _, bad := range []string{"", "has space", strings.Repeat("x", 65)} {
+		req := httptest.NewRequest("GET", "/x", nil)
+		req.Header.Set(requestIDHeader, bad)
+		id := ensureRequestID(httptest.NewRecorder(), req)
+		if id == bad || !validRequestID(id) || requestID(req) != id {
+			t.Errorf("Expected a new ID for %q, got %q (header %q)",
+				bad, id, requestID(req))
+		}
+	}
+}
@@ -3,17 +3,15 @@
 package main
 
 import (
+	"io"
 	"log"
 	"log/syslog"
 )
 
-func initLogger(slog bool) {
-	if slog {
-		lw, err := syslog.New(syslog.LOG_INFO, "cbfs")
-		if err != nil {
-			log.Fatalf("Can't initialize syslog: %v", err)
-		}
-		log.SetOutput(lw)
-		log.SetFlags(0)
+func initSyslog() io.Writer {
+	lw, err := syslog.New(syslog.LOG_INFO, "cbfs")
+	if err != nil {
+		log.Fatalf("Can't initialize syslog: %v", err)
 	}
+	return lw
 }
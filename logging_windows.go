@@ -1,11 +1,11 @@
 package main
 
 import (
+	"io"
 	"log"
 )
 
-func initLogger(slog bool) {
-	if slog {
-		log.Printf("No syslog support on Windows, using regular logging")
-	}
+func initSyslog() io.Writer {
+	log.Printf("No syslog support on Windows, using regular logging")
+	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -12,10 +13,12 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/trace"
 	"github.com/dustin/go-humanize"
 	"github.com/couchbase/gomemcached"
 	"github.com/dustin/httputil"
@@ -39,6 +42,8 @@ var viewTimeout = flag.Duration("viewTimeout", 5*time.Second,
 var internodeTimeout = flag.Duration("internodeTimeout", 5*time.Second,
 	"Internode client read timeout")
 var useSyslog = flag.Bool("syslog", false, "Log to syslog")
+var zone = flag.String("zone", "",
+	"Zone (rack, datacenter, etc...) this node lives in")
 
 var globalConfig *cbfsconfig.CBFSConfig
 
@@ -138,12 +143,21 @@ func shouldStoreMeta(header http.Header, exists bool, fm fileMeta) bool {
 	return true
 }
 
-func storeMeta(fn string, exp int, fm fileMeta, revs int, header http.Header) error {
+func storeMeta(ctx context.Context, fn string, exp int, fm fileMeta, revs int,
+	header http.Header) error {
+
 	k := shortName(fn)
 	if k != fn {
 		fm.Name = fn
 	}
+	sp := cbfstrace.FromContext(ctx).Start("meta")
+	attempts := 0
+	defer func() {
+		sp.SetAttr("attempts", attempts)
+		sp.End()
+	}()
 	return couchbase.Update(k, exp, func(in []byte) ([]byte, error) {
+		attempts++
 		existing := fileMeta{}
 		err := json.Unmarshal(in, &existing)
 		if !shouldStoreMeta(header, err == nil, existing) {
@@ -182,8 +196,9 @@ func main() {
 
 	initLogger(*useSyslog)
 	initNodeListKeys()
+	nodeScorer.SetZone(*zone)
 
-	http.DefaultTransport = TimeoutTransport(*internodeTimeout)
+	http.DefaultTransport = nodeTransport{TimeoutTransport(*internodeTimeout)}
 	expvar.Publish("httpclients", httputil.InitHTTPTracker(false))
 
 	if getHash() == nil {
@@ -210,6 +225,22 @@ func main() {
 		maxStorage = int64(ms)
 	}
 
+	if err := initTracing(); err != nil {
+		log.Fatalf("Error opening trace file: %v", err)
+	}
+
+	if *accessLogPath != "" {
+		maxSize, err := humanize.ParseBytes(*accessLogMaxSize)
+		if err != nil {
+			log.Fatalf("Error parsing access log size: %v", err)
+		}
+		accessLogger, err = openAccessLog(*accessLogPath, *accessLogFormat,
+			int64(maxSize), *accessLogKeep)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+	}
+
 	couchbase, err = dbConnect()
 	if err != nil {
 		log.Fatalf("Can't connect to couchbase: %v", err)
@@ -233,7 +264,11 @@ func main() {
 
 	go dnsServices()
 
-	internodeTaskQueue = make(chan internodeTask, *taskWorkers*1024)
+	internodeTaskQueue, err = openTaskQueue(filepath.Join(*root, ".taskqueue"),
+		*taskWorkers*1024, findNode)
+	if err != nil {
+		log.Fatalf("Error opening internode task queue: %v", err)
+	}
 	initTaskQueueWorkers()
 
 	go heartbeat()
@@ -255,5 +290,6 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error listening: %v", err)
 	}
-	log.Fatal(s.Serve(l))
+	go handleSignals()
+	serveUntilShutdown(s, func() error { return s.Serve(l) })
 }
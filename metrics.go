@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the replica count distribution is reused between scrapes.
+const replicaCountCacheTime = time.Minute
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1,
+		2.5, 5, 10, 30, 60}
+	taskBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400}
+
+	httpRequests = newCounterVec("method", "endpoint", "code")
+	httpLatency  = newHistogramVec(latencyBuckets, "method", "endpoint")
+	taskRuns     = newCounterVec("task", "outcome")
+	taskLatency  = newHistogramVec(taskBuckets, "task")
+	cbPoolWaits  = newHistogramVec(latencyBuckets, "host")
+	cbPoolErrors = newCounterVec("host")
+
+	bytesReceived, bytesSent int64
+)
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	parts := []string{}
+	for i, n := range names {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, n, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%v="%v"`, extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// Counters by label values.
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string][]string
+	counts map[string]float64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: map[string][]string{},
+		counts: map[string]float64{}}
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	k := strings.Join(values, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[k]; !ok {
+		c.values[k] = values
+	}
+	c.counts[k] += v
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, name, "counter", help)
+	keys := []string{}
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", name,
+			formatLabels(c.labels, c.values[k]), formatValue(c.counts[k]))
+	}
+}
+
+type histogram struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histograms by label values.
+type histogramVec struct {
+	mu      sync.Mutex
+	labels  []string
+	buckets []float64
+	histos  map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets,
+		histos: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	k := strings.Join(values, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hs, ok := h.histos[k]
+	if !ok {
+		hs = &histogram{values: values, counts: make([]uint64, len(h.buckets))}
+		h.histos[k] = hs
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hs.counts[i]++
+		}
+	}
+	hs.count++
+	hs.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, name, "histogram", help)
+	keys := []string{}
+	for k := range h.histos {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hs := h.histos[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", name,
+				formatLabels(h.labels, hs.values, "le", formatValue(b)),
+				hs.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", name,
+			formatLabels(h.labels, hs.values, "le", "+Inf"), hs.count)
+		l := formatLabels(h.labels, hs.values)
+		fmt.Fprintf(w, "%v_sum%v %v\n", name, l, formatValue(hs.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", name, l, hs.count)
+	}
+}
+
+type gaugeSample struct {
+	labels []string
+	value  float64
+}
+
+func writeGauge(w io.Writer, name, help string, labels []string,
+	samples []gaugeSample) {
+
+	writeHeader(w, name, "gauge", help)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%v%v %v\n", name, formatLabels(labels, s.labels),
+			formatValue(s.value))
+	}
+}
+
+var metricEndpoints = []string{
+	blobPrefix, blobInfoPath, nodePrefix, metaPrefix, proxyPrefix,
+	crudproxyPrefix, fetchPrefix, listPrefix, configPrefix, zipPrefix,
+	tarPrefix, fsckPrefix, gcReportPrefix, taskPrefix, taskinfoPrefix,
+	taskQueuePrefix, taskCancelPrefix, taskHistPrefix, pingPrefix,
+	fileInfoPrefix, framePrefix, markBackupPrefix, restorePrefix,
+	dataRestPrefix, verifyBakPrefix, backupStrmPrefix, backupPrefix,
+	rebalancePrefix, quitPrefix, debugPrefix, metricsPrefix, healthPrefix,
+	slowPrefix, configSchemaPath, configHistPath, nodeConfigPrefix,
+	effectiveConfigPath,
+}
+
+func init() {
+	// Most specific first.
+	sort.Slice(metricEndpoints, func(i, j int) bool {
+		return len(metricEndpoints[i]) > len(metricEndpoints[j])
+	})
+}
+
+// Name the endpoint a request is for without the parts of the path
+// that would make too many label values.
+func metricEndpoint(path string) string {
+	switch path {
+	case "/metrics", "/healthz", "/readyz":
+		return path
+	}
+	if !strings.HasPrefix(path, "/.cbfs/") {
+		return "file"
+	}
+	for _, e := range metricEndpoints {
+		if strings.HasPrefix(path, e) {
+			return e
+		}
+	}
+	return "other"
+}
+
+// Remembers the status and size of a response, and where any blob
+// served came from.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	blob    string
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+// Keeps sendfile working for blobs.
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = 200
+	}
+	var n int64
+	var err error
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(s.ResponseWriter, r)
+	}
+	s.written += n
+	return n, err
+}
+
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return 200
+	}
+	return s.status
+}
+
+func recordRequestMetrics(req *http.Request, status int, took time.Duration) {
+	ep := metricEndpoint(req.URL.Path)
+	httpRequests.add(1, req.Method, ep, strconv.Itoa(status))
+	httpLatency.observe(took.Seconds(), req.Method, ep)
+}
+
+func recordTaskMetrics(task, outcome string, took time.Duration) {
+	taskRuns.add(1, task, outcome)
+	taskLatency.observe(took.Seconds(), task)
+}
+
+var replicaCounts = struct {
+	sync.Mutex
+	at      time.Time
+	samples []gaugeSample
+}{}
+
+// How many blobs have each number of replicas, from the repcounts
+// view.
+func replicaCountSamples() []gaugeSample {
+	replicaCounts.Lock()
+	defer replicaCounts.Unlock()
+	if time.Since(replicaCounts.at) < replicaCountCacheTime {
+		return replicaCounts.samples
+	}
+
+	counts, err := countReplicas()
+	if err != nil {
+		log.Printf("Error getting replica counts for metrics: %v", err)
+		return replicaCounts.samples
+	}
+
+	keys := []int{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	samples := []gaugeSample{}
+	for _, k := range keys {
+		samples = append(samples,
+			gaugeSample{[]string{strconv.Itoa(k)}, float64(counts[k])})
+	}
+	replicaCounts.at = time.Now()
+	replicaCounts.samples = samples
+	return samples
+}
+
+func writeMetrics(w io.Writer) {
+	httpRequests.write(w, "cbfs_http_requests_total",
+		"HTTP requests by method, endpoint and status.")
+	httpLatency.write(w, "cbfs_http_request_duration_seconds",
+		"Time to serve HTTP requests.")
+
+	writeHeader(w, "cbfs_network_received_bytes_total", "counter",
+		"Bytes received by the HTTP server.")
+	fmt.Fprintf(w, "cbfs_network_received_bytes_total %v\n",
+		atomic.LoadInt64(&bytesReceived))
+	writeHeader(w, "cbfs_network_sent_bytes_total", "counter",
+		"Bytes sent by the HTTP server.")
+	fmt.Fprintf(w, "cbfs_network_sent_bytes_total %v\n",
+		atomic.LoadInt64(&bytesSent))
+
+	if internodeTaskQueue != nil {
+		st := internodeTaskQueue.state(0)
+		writeGauge(w, "cbfs_internode_queue_depth",
+			"Internode tasks waiting.", nil,
+			[]gaugeSample{{nil, float64(st.Depth)}})
+		writeGauge(w, "cbfs_internode_queue_inflight",
+			"Internode tasks running.", nil,
+			[]gaugeSample{{nil, float64(len(st.InFlight))}})
+		writeHeader(w, "cbfs_internode_queue_rejected_total", "counter",
+			"Internode tasks turned away from a full queue.")
+		fmt.Fprintf(w, "cbfs_internode_queue_rejected_total %v\n", st.Rejected)
+	}
+
+	taskRuns.write(w, "cbfs_task_runs_total",
+		"Task runs on this node by outcome.")
+	taskLatency.write(w, "cbfs_task_duration_seconds",
+		"How long task runs on this node took.")
+
+	cbPoolWaits.write(w, "cbfs_couchbase_pool_seconds",
+		"Time spent getting Couchbase connections.")
+	cbPoolErrors.write(w, "cbfs_couchbase_pool_errors_total",
+		"Failures getting Couchbase connections.")
+
+	if nl, err := findAllNodes(); err == nil {
+		used, free := []gaugeSample{}, []gaugeSample{}
+		for _, n := range nl {
+			used = append(used, gaugeSample{[]string{n.name}, float64(n.Used)})
+			free = append(free, gaugeSample{[]string{n.name}, float64(n.Free)})
+		}
+		writeGauge(w, "cbfs_node_used_bytes", "Disk used by each node.",
+			[]string{"node"}, used)
+		writeGauge(w, "cbfs_node_free_bytes", "Disk free on each node.",
+			[]string{"node"}, free)
+	} else {
+		log.Printf("Error getting nodes for metrics: %v", err)
+	}
+
+	writeGauge(w, "cbfs_blobs_by_replicas",
+		"Blobs by how many replicas they have.",
+		[]string{"replicas"}, replicaCountSamples())
+}
+
+func doMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
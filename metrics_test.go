@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricEndpoint(t *testing.T) {
+	tests := []struct {
+		path, exp string
+	}{
+		{"/some/file.txt", "file"},
+		{"/metrics", "/metrics"},
+		{"/readyz", "/readyz"},
+		{"/.cbfs/blob/abc123", blobPrefix},
+		{"/.cbfs/blob/info/", blobInfoPath},
+		{"/.cbfs/tasks/history/", taskHistPrefix},
+		{"/.cbfs/tasks/rebalance", taskPrefix},
+		{"/.cbfs/backup/restore/a/b", restorePrefix},
+		{"/.cbfs/backup/data/restore/", dataRestPrefix},
+		{"/.cbfs/nonsense", "other"},
+	}
+	for _, test := range tests {
+		if got := metricEndpoint(test.path); got != test.exp {
+			t.Errorf("Endpoint of %v = %v, want %v", test.path, got, test.exp)
+		}
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	c := newCounterVec("method", "code")
+	c.add(1, "GET", "200")
+	c.add(2, "GET", "200")
+	c.add(1, "PUT", `a"b`)
+
+	h := newHistogramVec([]float64{1, 5}, "task")
+	h.observe(0.5, "gc")
+	h.observe(3, "gc")
+	h.observe(10, "gc")
+
+	buf := &bytes.Buffer{}
+	c.write(buf, "x_total", "Some things.")
+	h.write(buf, "y_seconds", "Some times.")
+
+	exp := `# HELP x_total Some things.
+# TYPE x_total counter
+x_total{method="GET",code="200"} 3
+x_total{method="PUT",code="a\"b"} 1
+# HELP y_seconds Some times.
+# TYPE y_seconds histogram
+y_seconds_bucket{task="gc",le="1"} 1
+y_seconds_bucket{task="gc",le="5"} 2
+y_seconds_bucket{task="gc",le="+Inf"} 3
+y_seconds_sum{task="gc"} 13.5
+y_seconds_count{task="gc"} 3
+`
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%v\ngot:\n%v", exp, buf.String())
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sr := &statusRecorder{ResponseWriter: rec}
+	if sr.code() != 200 {
+		t.Errorf("Expected an unwritten response to be 200, got %v", sr.code())
+	}
+	sr.WriteHeader(404)
+	sr.Write([]byte("not "))
+	sr.ReadFrom(strings.NewReader("found"))
+	if sr.code() != 404 || sr.written != 9 {
+		t.Errorf("Expected 404 with 9 bytes, got %v with %v", sr.code(), sr.written)
+	}
+	if rec.Body.String() != "not found" {
+		t.Errorf("Expected the body passed through, got %q", rec.Body)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+const (
+	nodeConfigPrefix    = "/.cbfs/config/node/"
+	effectiveConfigPath = "/.cbfs/config/effective"
+)
+
+// Command line flags shown alongside a node's effective config.
+var nodeFlags = []string{"verifyWorkers", "taskWorkers", "maxSize",
+	"cachePercent"}
+
+// Parameters overridden for a single node.
+type nodeConfig struct {
+	Type      string                 `json:"type"`
+	Node      string                 `json:"node"`
+	Overrides map[string]interface{} `json:"overrides"`
+}
+
+func nodeConfigKey(node string) string {
+	return "/@" + node + "/config"
+}
+
+// The node's overrides (empty if it has none).
+func getNodeOverrides(node string) (map[string]interface{}, error) {
+	nc := nodeConfig{}
+	err := couchbase.Get(nodeConfigKey(node), &nc)
+	if err != nil && !gomemcached.IsNotFound(err) {
+		return nil, err
+	}
+	if nc.Overrides == nil {
+		nc.Overrides = map[string]interface{}{}
+	}
+	return nc.Overrides, nil
+}
+
+// The cluster config with overrides applied, if the result is valid.
+func effectiveConfig(cluster cbfsconfig.CBFSConfig,
+	overrides map[string]interface{}) (cbfsconfig.CBFSConfig, error) {
+
+	conf, err := cluster.WithOverrides(overrides)
+	if err == nil {
+		err = validateConfig(conf)
+	}
+	return conf, err
+}
+
+// The overrides of every registered node that has any.
+func allNodeOverrides() (map[string]map[string]interface{}, error) {
+	reg, err := retrieveNodeRegistry()
+	if gomemcached.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := map[string]map[string]interface{}{}
+	for node := range reg.Nodes {
+		overrides, err := getNodeOverrides(node)
+		if err != nil {
+			return nil, err
+		}
+		if len(overrides) > 0 {
+			rv[node] = overrides
+		}
+	}
+	return rv, nil
+}
+
+// Name each node whose overrides don't work with a cluster config.
+func checkNodeOverrides(cluster cbfsconfig.CBFSConfig,
+	all map[string]map[string]interface{}) error {
+
+	nodes := []string{}
+	for node := range all {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	errs := []string{}
+	for _, node := range nodes {
+		if _, err := effectiveConfig(cluster, all[node]); err != nil {
+			errs = append(errs, fmt.Sprintf("overrides for node %v: %v",
+				node, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// The config this node should run with.
+func nodeEffectiveConfig(node string,
+	cluster cbfsconfig.CBFSConfig) (cbfsconfig.CBFSConfig, error) {
+
+	overrides, err := getNodeOverrides(node)
+	if err != nil {
+		return cluster, err
+	}
+	conf, err := effectiveConfig(cluster, overrides)
+	if err != nil {
+		return cluster, err
+	}
+	return conf, nil
+}
+
+// One value of a node's effective config, and where it came from.
+type configSource struct {
+	Name   string      `json:"name"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// Say whether each parameter comes from the defaults, the cluster
+// config or the node's overrides.
+func configSources(cluster cbfsconfig.CBFSConfig,
+	overrides map[string]interface{},
+	effective cbfsconfig.CBFSConfig) []configSource {
+
+	dm, cm, em := cbfsconfig.DefaultConfig().ToMap(), cluster.ToMap(),
+		effective.ToMap()
+	rv := []configSource{}
+	for _, f := range cbfsconfig.Schema() {
+		src := "default"
+		if _, ok := overrides[f.Name]; ok {
+			src = "node"
+		} else if !reflect.DeepEqual(cm[f.Name], dm[f.Name]) {
+			src = "cluster"
+		}
+		rv = append(rv, configSource{f.Name, em[f.Name], src})
+	}
+	return rv
+}
+
+func flagSources() []configSource {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	rv := []configSource{}
+	for _, name := range nodeFlags {
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+		src := "default"
+		if set[name] {
+			src = "flag"
+		}
+		rv = append(rv, configSource{"-" + name, f.Value.String(), src})
+	}
+	return rv
+}
+
+func doGetEffectiveConfig(w http.ResponseWriter, req *http.Request) {
+	node := req.FormValue("node")
+	if node == "" {
+		node = serverId
+	}
+
+	cluster, err := currentStoredConfig()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	overrides, err := getNodeOverrides(node)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	res := struct {
+		Node   string         `json:"node"`
+		Params []configSource `json:"params"`
+		Flags  []configSource `json:"flags,omitempty"`
+		Error  string         `json:"error,omitempty"`
+	}{Node: node}
+
+	conf, err := effectiveConfig(cluster, overrides)
+	if err != nil {
+		// This is what the node falls back to.
+		res.Error = err.Error()
+		conf, overrides = cluster, nil
+	}
+	res.Params = configSources(cluster, overrides, conf)
+	// Flags are only known to the node itself.
+	if node == serverId {
+		res.Flags = flagSources()
+	}
+	sendJson(w, req, res)
+}
+
+func doGetNodeConfig(w http.ResponseWriter, req *http.Request, node string) {
+	overrides, err := getNodeOverrides(node)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, overrides)
+}
+
+// What differs between two sets of overrides, by name.
+func diffOverrides(old, current map[string]interface{}) []configFieldChange {
+	names := []string{}
+	for k := range old {
+		names = append(names, k)
+	}
+	for k := range current {
+		if _, ok := old[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	rv := []configFieldChange{}
+	for _, n := range names {
+		if !reflect.DeepEqual(old[n], current[n]) {
+			rv = append(rv, configFieldChange{n, old[n], current[n]})
+		}
+	}
+	return rv
+}
+
+// Replace all of a node's overrides.
+func putNodeConfig(w http.ResponseWriter, req *http.Request, node string) {
+	if node == "" || strings.Contains(node, "/") {
+		http.Error(w, fmt.Sprintf("Invalid node name: %q", node), 400)
+		return
+	}
+
+	// Overrides for a node that isn't registered would never apply.
+	reg, err := retrieveNodeRegistry()
+	if err != nil && !gomemcached.IsNotFound(err) {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, ok := reg.Nodes[node]; !ok {
+		http.Error(w, fmt.Sprintf("No such node: %q", node), 404)
+		return
+	}
+
+	overrides := map[string]interface{}{}
+	if err := json.NewDecoder(req.Body).Decode(&overrides); err != nil {
+		http.Error(w, fmt.Sprintf("Error reading overrides: %v", err), 400)
+		return
+	}
+
+	cluster, err := currentStoredConfig()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, err := effectiveConfig(cluster, overrides); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	old, err := getNodeOverrides(node)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = couchbase.Set(nodeConfigKey(node), 0, nodeConfig{
+		Type:      "nodeconfig",
+		Node:      node,
+		Overrides: overrides,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error writing overrides: %v", err), 500)
+		return
+	}
+
+	if changes := diffOverrides(old, overrides); len(changes) > 0 {
+		r := newConfigRevision(req, changes)
+		r.Node, r.Overrides = node, overrides
+		prior := configRevision{Node: node, Overrides: old}
+		if err := recordConfigChange(r, prior); err != nil {
+			httpLog.Warnf("Error recording config change for %v: %v", node, err)
+		}
+	}
+
+	// Other nodes will see it when they next reload.
+	if node == serverId {
+		if err := updateConfig(); err != nil {
+			httpLog.Warnf("Error reloading config: %v", err)
+		}
+	}
+
+	w.WriteHeader(204)
+}
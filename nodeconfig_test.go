@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+)
+
+func TestConfigSources(t *testing.T) {
+	cluster := cbfsconfig.DefaultConfig()
+	cluster.GCLimit = 10
+	overrides := map[string]interface{}{"trimFullSize": "1024"}
+	conf, err := effectiveConfig(cluster, overrides)
+	if err != nil {
+		t.Fatalf("Error applying overrides: %v", err)
+	}
+
+	got := map[string]configSource{}
+	for _, s := range configSources(cluster, overrides, conf) {
+		got[s.Name] = s
+	}
+	exp := map[string]configSource{
+		"trimFullSize": {"trimFullSize", int64(1024), "node"},
+		"gclimit":      {"gclimit", 10, "cluster"},
+		"minrepl":      {"minrepl", 3, "default"},
+	}
+	for k, v := range exp {
+		if !reflect.DeepEqual(got[k], v) {
+			t.Errorf("Expected %+v, got %+v", v, got[k])
+		}
+	}
+}
+
+func TestEffectiveConfigErrors(t *testing.T) {
+	cluster := cbfsconfig.DefaultConfig()
+	tests := []map[string]interface{}{
+		{"hash": "sha256"},
+		{"disabledTasks": "nosuchtask"},
+		{"hbfreq": "1h"},
+	}
+	for _, o := range tests {
+		if _, err := effectiveConfig(cluster, o); err == nil {
+			t.Errorf("Expected an error overriding %v", o)
+		}
+	}
+}
+
+func TestCheckNodeOverrides(t *testing.T) {
+	all := map[string]map[string]interface{}{
+		"a": {"hbfreq": "2m"},
+		"b": {"gclimit": "5"},
+	}
+	cluster := cbfsconfig.DefaultConfig()
+	if err := checkNodeOverrides(cluster, all); err != nil {
+		t.Fatalf("Expected overrides to be fine, got %v", err)
+	}
+
+	// Now a's heartbeat is too slow for the cluster.
+	cluster.StaleNodeLimit = time.Minute
+	err := checkNodeOverrides(cluster, all)
+	if err == nil || !strings.Contains(err.Error(), "node a:") ||
+		strings.Contains(err.Error(), "node b:") {
+		t.Errorf("Expected only node a to conflict, got %v", err)
+	}
+}
+
+func TestDiffOverrides(t *testing.T) {
+	got := diffOverrides(
+		map[string]interface{}{"a": "1", "b": "2"},
+		map[string]interface{}{"b": "3", "c": "4", "a": "1"})
+	exp := []configFieldChange{{"b", "2", "3"}, {"c", nil, "4"}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestTaskDisabled(t *testing.T) {
+	defer func(s string) { globalConfig.DisabledTasks = s }(globalConfig.DisabledTasks)
+	globalConfig.DisabledTasks = "gc, reconcile"
+	tests := map[string]bool{"gc": true, "reconcile": true,
+		"quickReconcile": false, "": false}
+	for name, exp := range tests {
+		if taskDisabled(name) != exp {
+			t.Errorf("Expected %q disabled = %v", name, exp)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/couchbase/gomemcached"
+	"github.com/couchbaselabs/cbfs/nodescore"
 	cb "github.com/couchbaselabs/go-couchbase"
 )
 
@@ -23,6 +25,9 @@ var VERSION = "0.0.0"
 var nodeTooOld = errors.New("Node information is too stale")
 var notQueued = errors.New("Could not queue request")
 
+// Tracks how well other nodes have been serving us.
+var nodeScorer = cbfsnodescore.New("")
+
 type StorageNode struct {
 	Addr      string    `json:"addr"`
 	Type      string    `json:"type"`
@@ -33,6 +38,10 @@ type StorageNode struct {
 	Used      int64     `json:"used"`
 	Free      int64     `json:"free"`
 	Version   string    `json:"version"`
+	Zone      string    `json:"zone,omitempty"`
+	Leaving   bool      `json:"leaving,omitempty"`
+	// How far off this node's clock was when it last checked
+	ClockDrift time.Duration `json:"clockDrift,omitempty"`
 
 	name        string
 	storageSize int64
@@ -81,11 +90,16 @@ func (a StorageNode) fetchURL(h string) string {
 		a.Address(), h)
 }
 
+// A node is stale if it's missed heartbeats or told us it's leaving.
+func (n StorageNode) isStale() bool {
+	return n.Leaving || time.Since(n.Time) > globalConfig.StaleNodeLimit
+}
+
 func (n StorageNode) IsDead() bool {
 	// Get the freshest data.
 	nn, err := findNode(n.name)
 	if err == nil {
-		return time.Now().Sub(nn.Time) > globalConfig.StaleNodeLimit
+		return nn.isStale()
 	}
 	return false
 }
@@ -120,10 +134,30 @@ func (a NodeList) Swap(i, j int) {
 	a[i], a[j] = a[j], a[i]
 }
 
+// The nodes ordered by how quickly we expect them to serve us.
+func (a NodeList) ranked() NodeList {
+	byName := map[string]StorageNode{}
+	cands := make([]cbfsnodescore.Candidate, 0, len(a))
+	for _, n := range a {
+		byName[n.name] = n
+		cands = append(cands, cbfsnodescore.Candidate{Name: n.name, Zone: n.Zone})
+	}
+	rv := make(NodeList, 0, len(a))
+	leaving := NodeList{}
+	for _, c := range nodeScorer.Rank(cands) {
+		if byName[c.Name].Leaving {
+			leaving = append(leaving, byName[c.Name])
+		} else {
+			rv = append(rv, byName[c.Name])
+		}
+	}
+	return append(rv, leaving...)
+}
+
 // Ask a node to acquire a blob.
-func (n StorageNode) acquireBlob(oid, prevNode string) error {
+func (n StorageNode) acquireBlob(oid, prevNode, reqID string) error {
 	if n.IsLocal() {
-		if !maybeQueueBlobFetch(oid, prevNode) {
+		if !maybeQueueBlobFetch(oid, prevNode, reqID) {
 			return notQueued
 		}
 	} else {
@@ -133,6 +167,7 @@ func (n StorageNode) acquireBlob(oid, prevNode string) error {
 		}
 
 		req.Header.Set("X-Prevnode", prevNode)
+		setRequestID(req, reqID)
 
 		resp, err := n.Client().Do(req)
 		if err != nil {
@@ -149,7 +184,7 @@ func (n StorageNode) acquireBlob(oid, prevNode string) error {
 }
 
 // Ask a node to delete a blob.
-func (n StorageNode) deleteBlob(oid string) error {
+func (n StorageNode) deleteBlob(oid, reqID string) error {
 	if n.IsLocal() {
 		return removeObject(oid)
 	} else {
@@ -157,6 +192,7 @@ func (n StorageNode) deleteBlob(oid string) error {
 		if err != nil {
 			return err
 		}
+		setRequestID(req, reqID)
 		resp, err := n.Client().Do(req)
 		if err != nil {
 			return err
@@ -170,7 +206,7 @@ func (n StorageNode) deleteBlob(oid string) error {
 				resp.Status, oid, n)
 		}
 	}
-	log.Printf("Removed %v from %v", oid, n)
+	reqLog(replLog, reqID).Infof("Removed %v from %v", oid, n)
 	return nil
 }
 
@@ -276,7 +312,7 @@ func findNode(name string) (StorageNode, error) {
 	return sn, err
 }
 
-func updateNodeSizes() error {
+func updateNodeSizes(ctx context.Context) error {
 	viewRes := struct {
 		Rows []struct {
 			Key   string
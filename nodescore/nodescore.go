@@ -0,0 +1,253 @@
+// Latency- and locality-aware node selection.
+//
+// A Scorer remembers how quickly and reliably each node has answered
+// recently and uses that, along with the node's zone, to decide which
+// replica to talk to first.
+package cbfsnodescore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight given to each new observation.
+	defaultAlpha = 0.2
+	// Assumed latency of nodes we've never talked to.
+	defaultPrior = 50 * time.Millisecond
+	// Added to nodes outside our zone.
+	defaultZonePenalty = 100 * time.Millisecond
+	// Nodes that failed this recently go to the back of the line.
+	defaultFailWindow = 10 * time.Second
+)
+
+// A node that may be chosen.
+type Candidate struct {
+	Name string
+	Zone string
+}
+
+// What we know about a node.
+type NodeStats struct {
+	Latency   time.Duration `json:"latency"`
+	ErrorRate float64       `json:"errorRate"`
+	Samples   int64         `json:"samples"`
+	LastError time.Time     `json:"lastError,omitempty"`
+
+	// Whether Latency has been measured, or is just the prior.
+	measured bool
+}
+
+// Tracks and ranks nodes.  Safe for concurrent use.
+type Scorer struct {
+	// Weight of each new observation in the moving averages.
+	Alpha float64
+	// Latency assumed for nodes without observations.
+	Prior time.Duration
+	// Added to the expected latency of nodes in other zones.
+	ZonePenalty time.Duration
+	// How long a failure pushes a node to the back of the line.
+	FailWindow time.Duration
+
+	now func() time.Time
+
+	mu    sync.Mutex
+	zone  string
+	nodes map[string]*NodeStats
+}
+
+// Make a scorer preferring nodes in the given zone ("" for no
+// preference).
+func New(zone string) *Scorer {
+	return &Scorer{
+		Alpha:       defaultAlpha,
+		Prior:       defaultPrior,
+		ZonePenalty: defaultZonePenalty,
+		FailWindow:  defaultFailWindow,
+		now:         time.Now,
+		zone:        zone,
+		nodes:       map[string]*NodeStats{},
+	}
+}
+
+// Change the preferred zone.
+func (s *Scorer) SetZone(zone string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.zone = zone
+}
+
+// Record the outcome of a request to a node.
+func (s *Scorer) Observe(node string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, ok := s.nodes[node]
+	if !ok {
+		ns = &NodeStats{Latency: s.Prior}
+		s.nodes[node] = ns
+	}
+	ns.Samples++
+
+	// Failures tell us nothing about how fast a node is.
+	e := 0.0
+	switch {
+	case err != nil:
+		e = 1
+		ns.LastError = s.now()
+	case !ns.measured:
+		ns.Latency, ns.measured = latency, true
+	default:
+		ns.Latency += time.Duration(s.Alpha * float64(latency-ns.Latency))
+	}
+	ns.ErrorRate += s.Alpha * (e - ns.ErrorRate)
+}
+
+// Get a copy of everything we know.
+func (s *Scorer) Stats() map[string]NodeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rv := make(map[string]NodeStats, len(s.nodes))
+	for k, v := range s.nodes {
+		rv[k] = *v
+	}
+	return rv
+}
+
+// The expected cost of using a node.  Lower is better.
+func (s *Scorer) scoreLocked(c Candidate) float64 {
+	lat := float64(s.Prior)
+	rate := 0.0
+	if ns, ok := s.nodes[c.Name]; ok {
+		lat = float64(ns.Latency)
+		rate = ns.ErrorRate
+		if !ns.LastError.IsZero() && s.now().Sub(ns.LastError) < s.FailWindow {
+			lat += float64(s.FailWindow)
+		}
+	}
+	if s.zone != "" && c.Zone != s.zone {
+		lat += float64(s.ZonePenalty)
+	}
+	// An error costs about as much as trying again elsewhere.
+	return lat * (1 + 10*rate)
+}
+
+// Score a single node.  Lower is better.
+func (s *Scorer) Score(c Candidate) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scoreLocked(c)
+}
+
+type scored struct {
+	c     Candidate
+	score float64
+}
+
+type byScore []scored
+
+func (b byScore) Len() int           { return len(b) }
+func (b byScore) Less(i, j int) bool { return b[i].score < b[j].score }
+func (b byScore) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Order candidates best first.  Equally good nodes are shuffled so
+// load is spread between them.
+func (s *Scorer) Rank(cands []Candidate) []Candidate {
+	s.mu.Lock()
+	sc := make(byScore, len(cands))
+	for i, p := range rand.Perm(len(cands)) {
+		sc[i] = scored{cands[p], s.scoreLocked(cands[p])}
+	}
+	s.mu.Unlock()
+
+	sort.Stable(sc)
+
+	rv := make([]Candidate, len(sc))
+	for i := range sc {
+		rv[i] = sc[i].c
+	}
+	return rv
+}
+
+// Pick a single candidate, favoring good ones without always choosing
+// the same one.  Returns false if there are no candidates.
+func (s *Scorer) Pick(cands []Candidate) (Candidate, bool) {
+	switch len(cands) {
+	case 0:
+		return Candidate{}, false
+	case 1:
+		return cands[0], true
+	}
+
+	// Best of two random choices.
+	i := rand.Intn(len(cands))
+	j := rand.Intn(len(cands) - 1)
+	if j >= i {
+		j++
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scoreLocked(cands[j]) < s.scoreLocked(cands[i]) {
+		i = j
+	}
+	return cands[i], true
+}
+
+// Server errors count against a node like transport errors.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("HTTP status %d", int(e))
+}
+
+// Releases the request's context when the body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Issue a request, abandoning it if no response headers arrive within
+// the stall timeout (0 waits forever).  The timeout doesn't cover
+// reading the body; a node that stalls part way through a body is
+// only caught by the client's own timeouts.  The outcome is recorded
+// against the node.
+func (s *Scorer) Do(node string, client *http.Client, req *http.Request,
+	stall time.Duration) (*http.Response, error) {
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	if stall > 0 {
+		timer = time.AfterFunc(stall, cancel)
+	}
+
+	start := s.now()
+	res, err := client.Do(req.WithContext(ctx))
+	if timer != nil && !timer.Stop() && err == nil {
+		// The timer fired as the response came in.
+		res.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err == nil && res.StatusCode >= 500 {
+		s.Observe(node, s.now().Sub(start), statusError(res.StatusCode))
+	} else {
+		s.Observe(node, s.now().Sub(start), err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelingBody{res.Body, cancel}
+	return res, nil
+}
@@ -0,0 +1,112 @@
+package cbfsnodescore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRank(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New("east")
+	s.now = func() time.Time { return now }
+
+	s.Observe("fast", 10*time.Millisecond, nil)
+	s.Observe("slow", 80*time.Millisecond, nil)
+	s.Observe("far", 5*time.Millisecond, nil)
+	s.Observe("broken", time.Millisecond, nil)
+	s.Observe("broken", time.Millisecond, errors.New("oops"))
+
+	cands := []Candidate{
+		{"broken", "east"},
+		{"far", "west"},
+		{"slow", "east"},
+		{"unknown", "east"},
+		{"fast", "east"},
+	}
+
+	exp := []string{"fast", "unknown", "slow", "far", "broken"}
+	for i := 0; i < 10; i++ {
+		got := s.Rank(cands)
+		for j := range exp {
+			if got[j].Name != exp[j] {
+				t.Fatalf("Expected %v, got %v", exp, got)
+			}
+		}
+	}
+
+	// Once the failure is old news, only the error rate counts.
+	now = now.Add(time.Minute)
+	if got := s.Rank(cands); got[0].Name != "broken" {
+		t.Errorf("Expected broken to recover, got %v", got)
+	}
+}
+
+func TestObserve(t *testing.T) {
+	s := New("")
+	s.Observe("a", 100*time.Millisecond, nil)
+	s.Observe("a", 200*time.Millisecond, nil)
+	s.Observe("a", time.Hour, errors.New("failed"))
+
+	st := s.Stats()["a"]
+	if st.Latency != 120*time.Millisecond {
+		t.Errorf("Expected latency of 120ms, got %v", st.Latency)
+	}
+	if st.ErrorRate < 0.19 || st.ErrorRate > 0.21 {
+		t.Errorf("Expected an error rate of 0.2, got %v", st.ErrorRate)
+	}
+	if st.Samples != 3 {
+		t.Errorf("Expected 3 samples, got %v", st.Samples)
+	}
+	// A node that failed first is measured by its first success.
+	s.Observe("b", time.Hour, errors.New("failed"))
+	if st := s.Stats()["b"]; st.Latency != s.Prior {
+		t.Errorf("Expected a failed node to keep the prior, got %v", st.Latency)
+	}
+	s.Observe("b", 10*time.Millisecond, nil)
+	if st := s.Stats()["b"]; st.Latency != 10*time.Millisecond {
+		t.Errorf("Expected latency of 10ms, got %v", st.Latency)
+	}
+}
+
+func TestPick(t *testing.T) {
+	s := New("")
+	if _, ok := s.Pick(nil); ok {
+		t.Errorf("Expected nothing from an empty list")
+	}
+
+	s.Observe("bad", time.Millisecond, errors.New("nope"))
+	cands := []Candidate{{Name: "good"}, {Name: "bad"}}
+	for i := 0; i < 10; i++ {
+		if c, _ := s.Pick(cands); c.Name != "good" {
+			t.Fatalf("Expected good, got %v", c)
+		}
+	}
+}
+
+func TestDoStall(t *testing.T) {
+	release := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	s := New("")
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	_, err = s.Do("stalled", http.DefaultClient, req, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("Expected the stalled request to fail")
+	}
+	if st := s.Stats()["stalled"]; st.LastError.IsZero() {
+		t.Errorf("Expected a stall to count as an error: %+v", st)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+
+	"github.com/couchbaselabs/cbfs/trace"
+)
+
+// A node's share of the cluster's storage as seen by the rebalancer.
+type rebalanceNode struct {
+	Name        string  `json:"name"`
+	Size        int64   `json:"size"`
+	Free        int64   `json:"free"`
+	Utilization float64 `json:"utilization"`
+}
+
+func (r rebalanceNode) capacity() int64 {
+	return r.Size + r.Free
+}
+
+// A single blob we intend to copy to a new node before removing it
+// from the old one.
+type rebalanceMove struct {
+	OID    string `json:"oid"`
+	Length int64  `json:"length"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// Sorts most utilized first.
+type byUtilization []rebalanceNode
+
+func (b byUtilization) Len() int {
+	return len(b)
+}
+
+func (b byUtilization) Less(i, j int) bool {
+	return b[i].Utilization > b[j].Utilization
+}
+
+func (b byUtilization) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+type rebalancePlan struct {
+	Target float64         `json:"target"`
+	Over   []rebalanceNode `json:"over"`
+	Under  []rebalanceNode `json:"under"`
+	Moves  []rebalanceMove `json:"moves"`
+	Bytes  int64           `json:"bytes"`
+}
+
+// A blob stored on an overutilized node that might be moved.
+type rebalanceCandidate struct {
+	oid     string
+	length  int64
+	nodes   map[string]string
+	garbage bool
+}
+
+// Compute the utilization of all usable nodes along with the
+// utilization we'd like every node to have.
+func rebalanceNodes(nl NodeList) (float64, []rebalanceNode) {
+	rv := []rebalanceNode{}
+	used, capacity := int64(0), int64(0)
+	for _, n := range nl {
+		if n.isStale() {
+			continue
+		}
+		rn := rebalanceNode{
+			Name: n.name,
+			Size: n.storageSize,
+			Free: n.Free,
+		}
+		if rn.capacity() <= 0 {
+			continue
+		}
+		rn.Utilization = float64(rn.Size) / float64(rn.capacity())
+		used += rn.Size
+		capacity += rn.capacity()
+		rv = append(rv, rn)
+	}
+
+	if capacity == 0 {
+		return 0, rv
+	}
+	return float64(used) / float64(capacity), rv
+}
+
+// Build a plan moving blobs from overutilized nodes to underutilized
+// nodes until either everything is within the slack of the target or
+// we've spent our byte budget.
+func planRebalance(nl NodeList,
+	candidates func(node string) ([]rebalanceCandidate, error)) (rebalancePlan, error) {
+
+	target, nodes := rebalanceNodes(nl)
+	plan := rebalancePlan{Target: target, Moves: []rebalanceMove{}}
+
+	slack := float64(globalConfig.RebalanceSlack) / 100
+	room := map[string]int64{}
+	for _, n := range nodes {
+		switch {
+		case n.Utilization > target+slack:
+			plan.Over = append(plan.Over, n)
+		case n.Utilization < target-slack:
+			plan.Under = append(plan.Under, n)
+			room[n.Name] = int64(target*float64(n.capacity())) - n.Size
+		}
+	}
+
+	if len(plan.Over) == 0 || len(plan.Under) == 0 {
+		return plan, nil
+	}
+
+	sort.Sort(byUtilization(plan.Over))
+
+	for _, over := range plan.Over {
+		excess := over.Size - int64(target*float64(over.capacity()))
+
+		blobs, err := candidates(over.Name)
+		if err != nil {
+			return plan, err
+		}
+
+		for _, b := range blobs {
+			if excess <= 0 {
+				break
+			}
+			if plan.Bytes+b.length > globalConfig.RebalanceBytes {
+				return plan, nil
+			}
+			// Garbage is GC's problem and underreplicated
+			// blobs belong to ensureMinReplCount.
+			if b.garbage || len(b.nodes) < globalConfig.MinReplicas {
+				continue
+			}
+
+			dest := ""
+			for _, under := range plan.Under {
+				if _, has := b.nodes[under.Name]; has {
+					continue
+				}
+				if room[under.Name] < b.length {
+					continue
+				}
+				if dest == "" || room[under.Name] > room[dest] {
+					dest = under.Name
+				}
+			}
+			if dest == "" {
+				continue
+			}
+
+			room[dest] -= b.length
+			excess -= b.length
+			plan.Bytes += b.length
+			plan.Moves = append(plan.Moves, rebalanceMove{
+				OID:    b.oid,
+				Length: b.length,
+				From:   over.Name,
+				To:     dest,
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+func rebalanceCandidates(node string) ([]rebalanceCandidate, error) {
+	viewRes := struct {
+		Rows []struct {
+			Id  string
+			Doc struct {
+				Json struct {
+					Nodes   map[string]string
+					Length  int64
+					Garbage bool
+				}
+			}
+		}
+		Errors []cb.ViewError
+	}{}
+
+	err := couchbase.ViewCustom("cbfs", "node_blobs",
+		map[string]interface{}{
+			"key":          node,
+			"limit":        globalConfig.RebalanceCount,
+			"reduce":       false,
+			"include_docs": true,
+			"stale":        false,
+		}, &viewRes)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]rebalanceCandidate, 0, len(viewRes.Rows))
+	for _, r := range viewRes.Rows {
+		rv = append(rv, rebalanceCandidate{
+			oid:     r.Id[1:],
+			length:  r.Doc.Json.Length,
+			nodes:   r.Doc.Json.Nodes,
+			garbage: r.Doc.Json.Garbage,
+		})
+	}
+	return rv, nil
+}
+
+func currentRebalancePlan() (rebalancePlan, error) {
+	nl, err := findAllNodes()
+	if err != nil {
+		return rebalancePlan{}, err
+	}
+	return planRebalance(nl, rebalanceCandidates)
+}
+
+func rebalanceCluster(ctx context.Context) error {
+	if !globalConfig.RebalanceEnabled {
+		log.Printf("Rebalancing is disabled -- skipping")
+		return nil
+	}
+
+	tr := cbfstrace.FromContext(ctx)
+	sp := tr.Start("plan")
+	plan, err := currentRebalancePlan()
+	sp.End()
+	if err != nil {
+		return err
+	}
+
+	if len(plan.Moves) == 0 {
+		log.Printf("Cluster is balanced around %.2f%% utilization",
+			plan.Target*100)
+		return nil
+	}
+
+	nm, err := findNodeMap()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rebalancing %v blobs (%v bytes) toward %.2f%% utilization",
+		len(plan.Moves), plan.Bytes, plan.Target*100)
+
+	// The destination removes the source copy only after it has
+	// registered its own, so the replica count never drops.
+	progress := progressOf(ctx)
+	progress.setTotal(len(plan.Moves))
+	sp = tr.Start("queue")
+	defer sp.End()
+	queued := 0
+	for _, m := range plan.Moves {
+		if ctx.Err() != nil {
+			log.Printf("Rebalance stopped after queueing %v moves", queued)
+			return ctx.Err()
+		}
+		progress.scanned(1)
+		n, ok := nm[m.To]
+		if !ok {
+			log.Printf("No nodemap entry for %v", m.To)
+			continue
+		}
+		if !queueTaskBlobAcquire(ctx, n, m.OID, m.From, false) {
+			log.Printf("Queue is full during rebalance")
+			break
+		}
+		queued++
+		progress.acted(1)
+		progress.moved(m.Length)
+
+		if queued%1000 == 0 && !relockTask("rebalance") {
+			log.Printf("We lost the lock for rebalancing.")
+			return errors.New("Lost lock")
+		}
+	}
+
+	log.Printf("Queued %v of %v rebalance moves", queued, len(plan.Moves))
+	progress.summarize("Queued %v of %v moves (%v bytes)",
+		queued, len(plan.Moves), plan.Bytes)
+	return nil
+}
+
+func doRebalancePlan(w http.ResponseWriter, req *http.Request) {
+	plan, err := currentRebalancePlan()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	sendJson(w, req, plan)
+}
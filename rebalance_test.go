@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	now := time.Now()
+	nl := NodeList{
+		StorageNode{name: "full", Time: now, storageSize: 900, Free: 100},
+		StorageNode{name: "mid", Time: now, storageSize: 500, Free: 500},
+		StorageNode{name: "empty", Time: now, storageSize: 100, Free: 900},
+		StorageNode{name: "dead", Time: now.Add(-24 * time.Hour),
+			storageSize: 1000, Free: 0},
+	}
+
+	reps := map[string]string{"full": "", "mid": "", "x": ""}
+	blobs := []rebalanceCandidate{
+		{oid: "garbage", length: 100, nodes: reps, garbage: true},
+		{oid: "lonely", length: 100, nodes: map[string]string{"full": ""}},
+		{oid: "a", length: 150, nodes: reps},
+		{oid: "b", length: 150, nodes: reps},
+		{oid: "c", length: 150, nodes: reps},
+		{oid: "d", length: 150, nodes: reps},
+	}
+
+	plan, err := planRebalance(nl, func(node string) ([]rebalanceCandidate, error) {
+		if node != "full" {
+			t.Errorf("Unexpected candidate request for %v", node)
+		}
+		return blobs, nil
+	})
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+
+	if plan.Target != 0.5 {
+		t.Errorf("Expected target of 0.5, got %v", plan.Target)
+	}
+	if len(plan.Over) != 1 || len(plan.Under) != 1 {
+		t.Fatalf("Expected one over and one under, got %v/%v",
+			plan.Over, plan.Under)
+	}
+
+	// "c" would overfill the destination.
+	exp := []string{"a", "b"}
+	if len(plan.Moves) != len(exp) {
+		t.Fatalf("Expected %v moves, got %v", exp, plan.Moves)
+	}
+	for i, m := range plan.Moves {
+		if m.OID != exp[i] || m.From != "full" || m.To != "empty" {
+			t.Errorf("Unexpected move at %v: %+v", i, m)
+		}
+	}
+	if plan.Bytes != 300 {
+		t.Errorf("Expected 300 bytes moved, got %v", plan.Bytes)
+	}
+}
+
+func TestPlanRebalanceBudget(t *testing.T) {
+	defer func(b int64) { globalConfig.RebalanceBytes = b }(globalConfig.RebalanceBytes)
+	globalConfig.RebalanceBytes = 200
+
+	now := time.Now()
+	nl := NodeList{
+		StorageNode{name: "full", Time: now, storageSize: 900, Free: 100},
+		StorageNode{name: "empty", Time: now, storageSize: 100, Free: 900},
+	}
+	reps := map[string]string{"full": "", "x": "", "y": ""}
+
+	plan, err := planRebalance(nl, func(node string) ([]rebalanceCandidate, error) {
+		return []rebalanceCandidate{
+			{oid: "a", length: 150, nodes: reps},
+			{oid: "b", length: 150, nodes: reps},
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	if len(plan.Moves) != 1 || plan.Bytes != 150 {
+		t.Fatalf("Expected the budget to allow one move, got %+v", plan)
+	}
+}
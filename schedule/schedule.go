@@ -0,0 +1,298 @@
+// Schedules and maintenance windows for periodic tasks.
+//
+// A schedule is either a duration ("8h"), meaning run that often, or
+// a five field cron expression ("30 2 * * 1-5") of minute, hour, day
+// of month, month and day of week.  Cron expressions and windows are
+// evaluated in UTC so every node agrees on them.
+package cbfsschedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When something should next happen.
+type Schedule interface {
+	// The first time after t.
+	Next(t time.Time) time.Time
+	String() string
+}
+
+type every time.Duration
+
+// Run every d.
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e every) String() string {
+	return time.Duration(e).String()
+}
+
+// Parse a duration or cron expression.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d < time.Second {
+			return nil, fmt.Errorf("period too short: %v", d)
+		}
+		return Every(d), nil
+	}
+	s, err := parseCron(spec)
+	if err == nil && s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never fires", spec)
+	}
+	return s, err
+}
+
+// The time between the next two runs after t.
+func Interval(s Schedule, t time.Time) time.Duration {
+	n := s.Next(t)
+	return s.Next(n).Sub(n)
+}
+
+// True if s fires at the same moments wherever it's evaluated, as
+// cron schedules do.
+func Aligned(s Schedule) bool {
+	_, isEvery := s.(every)
+	return !isEvery
+}
+
+var descriptors = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+type cron struct {
+	spec                         string
+	minute, hour, dom, month     uint64
+	dow                          uint64
+	domRestricted, dowRestricted bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(spec string) (Schedule, error) {
+	expanded := spec
+	if d, ok := descriptors[spec]; ok {
+		expanded = d
+	}
+	parts := strings.Fields(expanded)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: expected a duration "+
+			"or %v cron fields", spec, len(cronFields))
+	}
+
+	bits := make([]uint64, len(parts))
+	for i, p := range parts {
+		b, err := parseCronField(p, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		bits[i] = b
+	}
+
+	c := &cron{
+		spec:          spec,
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}
+	// Sunday is both 0 and 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// Parse a comma separated list of values, ranges and steps.
+func parseCronField(s string, f cronField) (uint64, error) {
+	rv := uint64(0)
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %v: %q",
+					f.name, part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			if lo, err = cronValue(part[:i], f); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(part[i+1:], f); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range in %v: %q",
+					f.name, part)
+			}
+		default:
+			v, err := cronValue(part, f)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			rv |= 1 << uint(v)
+		}
+	}
+	return rv, nil
+}
+
+func cronValue(s string, f cronField) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %v: %q", f.name, s)
+	}
+	return v, nil
+}
+
+func (c *cron) String() string {
+	return c.spec
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// As in cron, when both are restricted either one will do.
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	// Impossible dates (e.g. February 30th) never match.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// A daily span of time during which something may happen.
+type Window struct {
+	// Minutes after midnight UTC.  The window may wrap past
+	// midnight.
+	start, end int
+	always     bool
+}
+
+// Parse a window of the form "22:00-06:00".  An empty window is
+// always open.
+func ParseWindow(s string) (Window, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Window{always: true}, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return Window{}, err
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("empty window %q", s)
+	}
+	return Window{start: start, end: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil ||
+		h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// True if the window is open at t.
+func (w Window) Contains(t time.Time) bool {
+	if w.always {
+		return true
+	}
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// The first time at or after t that the window is open.
+func (w Window) NextOpen(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	t = t.UTC()
+	open := time.Date(t.Year(), t.Month(), t.Day(), 0, w.start, 0, 0, time.UTC)
+	if open.Before(t) {
+		open = open.AddDate(0, 0, 1)
+	}
+	return open
+}
+
+func (w Window) String() string {
+	if w.always {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d",
+		w.start/60, w.start%60, w.end/60, w.end%60)
+}
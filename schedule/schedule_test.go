@@ -0,0 +1,132 @@
+package cbfsschedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(t *testing.T, s string) time.Time {
+	rv, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatalf("Error parsing %v: %v", s, err)
+	}
+	return rv
+}
+
+func TestNext(t *testing.T) {
+	// A Wednesday.
+	const from = "2026-01-07T10:17:30Z"
+	tests := []struct {
+		spec string
+		exp  string
+	}{
+		{"8h", "2026-01-07T18:17:30Z"},
+		{"* * * * *", "2026-01-07T10:18:00Z"},
+		{"30 2 * * *", "2026-01-08T02:30:00Z"},
+		{"*/15 * * * *", "2026-01-07T10:30:00Z"},
+		{"0 9-17/4 * * *", "2026-01-07T13:00:00Z"},
+		{"0 3 * * 6,7", "2026-01-10T03:00:00Z"},
+		{"0 3 * * 0", "2026-01-11T03:00:00Z"},
+		{"0 0 1 * *", "2026-02-01T00:00:00Z"},
+		{"0 0 29 2 *", "2028-02-29T00:00:00Z"},
+		// Either day restriction matches when both are given.
+		{"0 0 15 * 5", "2026-01-09T00:00:00Z"},
+		{"@weekly", "2026-01-11T00:00:00Z"},
+	}
+	for _, test := range tests {
+		s, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.spec, err)
+			continue
+		}
+		got := s.Next(mustTime(t, from))
+		if !got.Equal(mustTime(t, test.exp)) {
+			t.Errorf("Next for %q = %v, want %v", test.spec, got, test.exp)
+		}
+		if _, isEvery := s.(every); !isEvery && s.String() != test.spec {
+			t.Errorf("Expected %q to describe itself, got %q", test.spec, s)
+		}
+	}
+}
+
+func TestNextImpossible(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if got := s.Next(time.Now()); !got.IsZero() {
+		t.Errorf("Expected February 30th never to come, got %v", got)
+	}
+	if s, err := Parse("0 0 30 2 *"); err == nil {
+		t.Errorf("Expected an error parsing a schedule that never fires, got %v", s)
+	}
+	if _, err := Parse("0 0 29 2 *"); err != nil {
+		t.Errorf("Expected leap days to be possible: %v", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"", "10ms", "* * * *", "60 * * * *", "* 24 * * *",
+		"* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *",
+		"*/0 * * * *", "a * * * *", "@sometimes",
+	} {
+		if s, err := Parse(spec); err == nil {
+			t.Errorf("Expected error parsing %q, got %v", spec, s)
+		}
+	}
+}
+
+func TestInterval(t *testing.T) {
+	s, err := Parse("0 2 * * *")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if got := Interval(s, time.Now()); got != 24*time.Hour {
+		t.Errorf("Expected a daily interval, got %v", got)
+	}
+	if got := Interval(Every(time.Hour), time.Now()); got != time.Hour {
+		t.Errorf("Expected an hourly interval, got %v", got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		at     string
+		open   bool
+		next   string
+	}{
+		{"", "2026-01-07T12:00:00Z", true, "2026-01-07T12:00:00Z"},
+		{"01:00-05:00", "2026-01-07T03:00:00Z", true, "2026-01-07T03:00:00Z"},
+		{"01:00-05:00", "2026-01-07T05:00:00Z", false, "2026-01-08T01:00:00Z"},
+		{"01:00-05:00", "2026-01-07T00:30:00Z", false, "2026-01-07T01:00:00Z"},
+		{"22:00-06:00", "2026-01-07T23:00:00Z", true, "2026-01-07T23:00:00Z"},
+		{"22:00-06:00", "2026-01-07T02:00:00Z", true, "2026-01-07T02:00:00Z"},
+		{"22:00-06:00", "2026-01-07T12:00:00Z", false, "2026-01-07T22:00:00Z"},
+	}
+	for _, test := range tests {
+		w, err := ParseWindow(test.window)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.window, err)
+			continue
+		}
+		at := mustTime(t, test.at)
+		if w.Contains(at) != test.open {
+			t.Errorf("Expected %q open=%v at %v", test.window, test.open, at)
+		}
+		if got := w.NextOpen(at); !got.Equal(mustTime(t, test.next)) {
+			t.Errorf("Next opening of %q after %v = %v, want %v",
+				test.window, at, got, test.next)
+		}
+		if w.String() != test.window {
+			t.Errorf("Expected %q to describe itself, got %q", test.window, w)
+		}
+	}
+
+	for _, s := range []string{"1-5", "01:00", "05:00-05:00", "25:00-01:00"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("Expected error parsing window %q", s)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second,
+	"How long to let in-flight work finish when shutting down")
+
+var (
+	httpServers   []*http.Server
+	httpServersMu sync.Mutex
+
+	shutdownOnce sync.Once
+)
+
+// Register a server to be drained on shutdown.
+func addHTTPServer(s *http.Server) {
+	httpServersMu.Lock()
+	defer httpServersMu.Unlock()
+	httpServers = append(httpServers, s)
+}
+
+// Serve until the server is shut down.  A graceful shutdown exits the
+// process, so this only returns on other errors.
+func serveUntilShutdown(s *http.Server, serve func() error) {
+	addHTTPServer(s)
+	err := serve()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	select {}
+}
+
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	go gracefulShutdown(sig.String())
+	// A second signal means the operator is tired of waiting.
+	sig = <-ch
+	log.Fatalf("Exiting immediately on second %v", sig)
+}
+
+// Stop taking work, let what's running finish, tell everyone we're
+// going, and exit.
+func gracefulShutdown(why string) {
+	shutdownOnce.Do(func() {
+		log.Printf("Shutting down (%v), waiting up to %v for in-flight work",
+			why, *shutdownTimeout)
+		deadline := time.Now().Add(*shutdownTimeout)
+
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+
+		httpServersMu.Lock()
+		servers := append([]*http.Server{}, httpServers...)
+		httpServersMu.Unlock()
+
+		wg := sync.WaitGroup{}
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *http.Server) {
+				defer wg.Done()
+				if err := s.Shutdown(ctx); err != nil {
+					log.Printf("Error draining web requests: %v", err)
+				}
+			}(s)
+		}
+		wg.Wait()
+
+		if internodeTaskQueue != nil {
+			if err := internodeTaskQueue.close(deadline); err != nil {
+				log.Printf("Error closing internode task queue: %v", err)
+			}
+		}
+
+		releaseTaskLocks()
+		finalHeartbeat()
+
+		log.Printf("Shutdown complete")
+		os.Exit(0)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// One run of a task.
+type TaskRun struct {
+	Task     string       `json:"task"`
+	Node     string       `json:"node"`
+	Started  time.Time    `json:"started"`
+	Ended    time.Time    `json:"ended"`
+	Outcome  string       `json:"outcome"`
+	Error    string       `json:"error,omitempty"`
+	Summary  string       `json:"summary,omitempty"`
+	Progress TaskProgress `json:"progress"`
+}
+
+type taskHistory struct {
+	Type string    `json:"type"`
+	Runs []TaskRun `json:"runs"`
+}
+
+// Local task names are prefixed with the node running them.
+func splitTaskName(name string) (node, task string) {
+	if strings.HasPrefix(name, serverId+"/") {
+		return serverId, name[len(serverId)+1:]
+	}
+	return "", name
+}
+
+func taskHistoryKey(node, task string) string {
+	if node == "" {
+		return "/@history/" + task
+	}
+	return "/@history/" + node + "/" + task
+}
+
+func taskOutcome(err error) string {
+	switch err {
+	case nil:
+		return "success"
+	case context.Canceled:
+		return "canceled"
+	}
+	return "error"
+}
+
+// Keep the most recent runs, newest first.
+func appendTaskRun(runs []TaskRun, r TaskRun, keep int) []TaskRun {
+	rv := append([]TaskRun{r}, runs...)
+	if keep > 0 && len(rv) > keep {
+		rv = rv[:keep]
+	}
+	return rv
+}
+
+func recordTaskRun(name string, started time.Time, err error, p *taskProgress) {
+	node, task := splitTaskName(name)
+
+	now := time.Now().UTC()
+	snap := p.snapshot(now)
+	snap.ETA = nil
+	r := TaskRun{
+		Task:     task,
+		Node:     serverId,
+		Started:  started.UTC(),
+		Ended:    now,
+		Outcome:  taskOutcome(err),
+		Summary:  p.summary(),
+		Progress: snap,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	recordTaskMetrics(task, r.Outcome, now.Sub(started))
+
+	k := taskHistoryKey(node, task)
+	err = couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		h := taskHistory{}
+		json.Unmarshal(in, &h)
+		h.Type = "taskhistory"
+		h.Runs = appendTaskRun(h.Runs, r, globalConfig.TaskHistoryCount)
+		return json.Marshal(h)
+	})
+	if err != nil {
+		log.Printf("Error recording history of %v: %v", name, err)
+	}
+}
+
+type byStarted []TaskRun
+
+func (b byStarted) Len() int           { return len(b) }
+func (b byStarted) Less(i, j int) bool { return b[i].Started.After(b[j].Started) }
+func (b byStarted) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Find recorded runs, newest first.  Empty task or node match
+// everything.
+func taskRunHistory(task, node string) ([]TaskRun, error) {
+	keys := []string{}
+	for name := range globalPeriodicJobRecipes {
+		if task == "" || task == name {
+			keys = append(keys, taskHistoryKey("", name))
+		}
+	}
+
+	nl, err := findAllNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nl {
+		if node != "" && node != n.name {
+			continue
+		}
+		for name := range localPeriodicJobRecipes {
+			if task == "" || task == name {
+				keys = append(keys, taskHistoryKey(n.name, name))
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return []TaskRun{}, nil
+	}
+
+	res, err := couchbase.GetBulk(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []TaskRun{}
+	for k, r := range res {
+		if r.Status != gomemcached.SUCCESS {
+			continue
+		}
+		h := taskHistory{}
+		if err := json.Unmarshal(r.Body, &h); err != nil {
+			log.Printf("Error decoding task history %v: %v", k, err)
+			continue
+		}
+		for _, run := range h.Runs {
+			if node == "" || run.Node == node {
+				rv = append(rv, run)
+			}
+		}
+	}
+
+	sort.Sort(byStarted(rv))
+	return rv, nil
+}
+
+func doTaskHistory(w http.ResponseWriter, req *http.Request) {
+	task, node := req.FormValue("task"), req.FormValue("node")
+	if task != "" && globalPeriodicJobRecipes[task] == nil &&
+		localPeriodicJobRecipes[task] == nil {
+		http.Error(w, fmt.Sprintf("No such task: %q", task), 404)
+		return
+	}
+
+	runs, err := taskRunHistory(task, node)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if l := req.FormValue("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil {
+			http.Error(w, "Invalid limit: "+err.Error(), 400)
+			return
+		}
+		if limit >= 0 && limit < len(runs) {
+			runs = runs[:limit]
+		}
+	}
+
+	sendJson(w, req, runs)
+}
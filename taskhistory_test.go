@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAppendTaskRun(t *testing.T) {
+	runs := []TaskRun{}
+	for _, task := range []string{"a", "b", "c", "d"} {
+		runs = appendTaskRun(runs, TaskRun{Task: task}, 3)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("Expected 3 runs to be kept, got %v", len(runs))
+	}
+	for i, exp := range []string{"d", "c", "b"} {
+		if runs[i].Task != exp {
+			t.Errorf("Expected %v at %v, got %v", exp, i, runs[i].Task)
+		}
+	}
+
+	if got := appendTaskRun(runs, TaskRun{Task: "e"}, 0); len(got) != 4 {
+		t.Errorf("Expected no limit to keep everything, got %v", len(got))
+	}
+}
+
+func TestTaskOutcome(t *testing.T) {
+	tests := []struct {
+		err error
+		exp string
+	}{
+		{nil, "success"},
+		{context.Canceled, "canceled"},
+		{errors.New("broken"), "error"},
+	}
+	for _, test := range tests {
+		if got := taskOutcome(test.err); got != test.exp {
+			t.Errorf("Outcome of %v = %v, want %v", test.err, got, test.exp)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cb "github.com/couchbaselabs/go-couchbase"
+)
+
+// How often a running task's progress is written out.
+const taskProgressFreq = 5 * time.Second
+
+// How far along a running task is.
+type TaskProgress struct {
+	Scanned int64      `json:"scanned"`
+	Acted   int64      `json:"acted"`
+	Bytes   int64      `json:"bytes"`
+	Total   int64      `json:"total,omitempty"`
+	Started time.Time  `json:"started"`
+	ETA     *time.Time `json:"eta,omitempty"`
+}
+
+type taskProgress struct {
+	mu  sync.Mutex
+	p   TaskProgress
+	sum string
+}
+
+func newTaskProgress(started time.Time) *taskProgress {
+	return &taskProgress{p: TaskProgress{Started: started}}
+}
+
+// Count items looked at.
+func (t *taskProgress) scanned(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Scanned += int64(n)
+}
+
+// Count items something was done to.
+func (t *taskProgress) acted(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Acted += int64(n)
+}
+
+// Count bytes moved, removed or verified.
+func (t *taskProgress) moved(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Bytes += n
+}
+
+// Set the number of items expected to be scanned, if known.
+func (t *taskProgress) setTotal(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.Total = int64(n)
+}
+
+// Describe what the task did, for its run history.
+func (t *taskProgress) summarize(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sum = fmt.Sprintf(format, args...)
+}
+
+func (t *taskProgress) summary() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sum
+}
+
+func (t *taskProgress) snapshot(now time.Time) TaskProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rv := t.p
+	if rv.Total > 0 && rv.Scanned > 0 && rv.Scanned < rv.Total {
+		elapsed := now.Sub(rv.Started)
+		left := time.Duration(float64(elapsed) *
+			float64(rv.Total-rv.Scanned) / float64(rv.Scanned))
+		eta := now.Add(left)
+		rv.ETA = &eta
+	}
+	return rv
+}
+
+type taskProgressKey struct{}
+
+// The progress tracker of the task running under ctx.  Work done
+// outside a task is tracked and thrown away.
+func progressOf(ctx context.Context) *taskProgress {
+	if p, ok := ctx.Value(taskProgressKey{}).(*taskProgress); ok {
+		return p
+	}
+	return newTaskProgress(time.Now())
+}
+
+type runningTask struct {
+	cancel   context.CancelFunc
+	progress *taskProgress
+}
+
+var (
+	runningTasks   = map[string]*runningTask{}
+	runningTasksMu sync.Mutex
+)
+
+// Set up the context a task runs in.  The returned function must be
+// called when the task is finished.
+func startTaskContext(name string) (context.Context, *runningTask, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := &runningTask{cancel, newTaskProgress(time.Now().UTC())}
+	ctx = context.WithValue(ctx, taskProgressKey{}, rt.progress)
+
+	runningTasksMu.Lock()
+	runningTasks[name] = rt
+	runningTasksMu.Unlock()
+
+	go reportTaskProgress(ctx, name, rt.progress)
+
+	return ctx, rt, func() {
+		runningTasksMu.Lock()
+		if runningTasks[name] == rt {
+			delete(runningTasks, name)
+		}
+		runningTasksMu.Unlock()
+		cancel()
+	}
+}
+
+func reportTaskProgress(ctx context.Context, name string, p *taskProgress) {
+	t := time.NewTicker(taskProgressFreq)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := setTaskProgress(name, p.snapshot(time.Now())); err != nil {
+				log.Printf("Error recording progress of %v: %v", name, err)
+			}
+		}
+	}
+}
+
+// Record progress on a task already marked as running.
+func setTaskProgress(task string, p TaskProgress) error {
+	k := "/@" + serverId + "/tasks"
+	err := couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+		ob := TaskList{Tasks: map[string]TaskState{}}
+		json.Unmarshal(in, &ob)
+		ts, ok := ob.Tasks[task]
+		if !ok {
+			return nil, cb.UpdateCancel
+		}
+		ts.Progress = &p
+		ob.Tasks[task] = ts
+		return json.Marshal(ob)
+	})
+	if err == cb.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+// Cancel a task running on this node.  Returns false if it's not
+// running here.
+func cancelTask(name string) bool {
+	runningTasksMu.Lock()
+	defer runningTasksMu.Unlock()
+	for _, n := range []string{name, serverId + "/" + name} {
+		if rt, ok := runningTasks[n]; ok {
+			log.Printf("Canceling task %v", n)
+			rt.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// Ask whichever node is running a global task to cancel it.
+func cancelRemoteTask(name string) (bool, error) {
+	if globalPeriodicJobRecipes[name] == nil || taskLeases == nil {
+		return false, nil
+	}
+	rec, held, err := taskLeases.holder(taskLeaseKey(name))
+	if err != nil || !held || rec.Node == serverId {
+		return false, err
+	}
+	n, err := findNode(rec.Node)
+	if err != nil {
+		return false, err
+	}
+
+	u := fmt.Sprintf("http://%s%s%s", n.Address(), taskCancelPrefix, name)
+	res, err := http.Post(u, "application/x-www-form-urlencoded", nil)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	return res.StatusCode == 202, nil
+}
+
+func doCancelTask(w http.ResponseWriter, req *http.Request, name string) {
+	name = strings.Trim(name, "/")
+	if globalPeriodicJobRecipes[name] == nil &&
+		localPeriodicJobRecipes[name] == nil {
+		http.Error(w, fmt.Sprintf("No such task: %q", name), 404)
+		return
+	}
+
+	if cancelTask(name) {
+		w.WriteHeader(202)
+		return
+	}
+
+	ok, err := cancelRemoteTask(name)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), 500)
+	case ok:
+		w.WriteHeader(202)
+	default:
+		http.Error(w, fmt.Sprintf("Task %q is not running", name), 404)
+	}
+}
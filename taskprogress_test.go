@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTaskProgress(t *testing.T) {
+	start := time.Unix(1000, 0)
+	p := newTaskProgress(start)
+	p.setTotal(100)
+	p.scanned(25)
+	p.acted(3)
+	p.moved(1024)
+
+	snap := p.snapshot(start.Add(time.Minute))
+	if snap.Scanned != 25 || snap.Acted != 3 || snap.Bytes != 1024 {
+		t.Errorf("Unexpected counts: %+v", snap)
+	}
+	if snap.ETA == nil || !snap.ETA.Equal(start.Add(4*time.Minute)) {
+		t.Errorf("Expected ETA three minutes out, got %v", snap.ETA)
+	}
+
+	p.scanned(75)
+	if snap := p.snapshot(start.Add(2 * time.Minute)); snap.ETA != nil {
+		t.Errorf("Expected no ETA when finished, got %v", snap.ETA)
+	}
+}
+
+func TestProgressOf(t *testing.T) {
+	p := newTaskProgress(time.Now())
+	ctx := context.WithValue(context.Background(), taskProgressKey{}, p)
+	progressOf(ctx).acted(2)
+	if got := p.snapshot(time.Now()).Acted; got != 2 {
+		t.Errorf("Expected progress to be recorded, got %v", got)
+	}
+
+	// Outside a task, progress goes nowhere but doesn't break.
+	progressOf(context.Background()).acted(1)
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxTaskAttempts = 8
+	maxTaskBackoff  = 10 * time.Minute
+	taskFailureKeep = 100
+)
+
+func (c internodeCommand) String() string {
+	switch c {
+	case removeObjectCmd:
+		return "remove"
+	case acquireObjectCmd:
+		return "acquire"
+	case fetchObjectCmd:
+		return "fetch"
+	}
+	return fmt.Sprintf("cmd-%d", uint8(c))
+}
+
+// Queued tasks are deduplicated on this.
+type taskKey struct {
+	node string
+	cmd  internodeCommand
+	oid  string
+}
+
+func (t internodeTask) key() taskKey {
+	return taskKey{t.node.name, t.cmd, t.oid}
+}
+
+type queuedTask struct {
+	internodeTask
+	// A newer lease that queued this while it was in flight
+	refence   *lease
+	attempts  int
+	queued    time.Time
+	notBefore time.Time
+	lastErr   error
+}
+
+// What a queued task looks like from the outside.
+type taskQueueItem struct {
+	Node      string    `json:"node,omitempty"`
+	Cmd       string    `json:"cmd"`
+	OID       string    `json:"oid"`
+	Prev      string    `json:"prev,omitempty"`
+	RequestID string    `json:"requestID,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Queued    time.Time `json:"queued"`
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (qt *queuedTask) item() taskQueueItem {
+	rv := taskQueueItem{
+		Node:      qt.node.name,
+		Cmd:       qt.cmd.String(),
+		OID:       qt.oid,
+		Prev:      qt.prevNode,
+		RequestID: qt.reqID,
+		Attempts:  qt.attempts,
+		Queued:    qt.queued,
+	}
+	if qt.attempts > 0 {
+		rv.NotBefore = qt.notBefore
+	}
+	if qt.lastErr != nil {
+		rv.Error = qt.lastErr.Error()
+	}
+	return rv
+}
+
+type taskFailure struct {
+	taskQueueItem
+	Failed time.Time `json:"failed"`
+}
+
+// One line in the queue journal.  "+" adds a task (or updates one
+// already added), "-" removes it.
+type taskJournalRecord struct {
+	Op       string           `json:"op"`
+	Node     string           `json:"node,omitempty"`
+	Cmd      internodeCommand `json:"cmd"`
+	OID      string           `json:"oid"`
+	Prev     string           `json:"prev,omitempty"`
+	Req      string           `json:"req,omitempty"`
+	Queued   time.Time        `json:"queued,omitempty"`
+	Attempts int              `json:"attempts,omitempty"`
+}
+
+// A persistent queue of internode work.  Every change is appended to
+// a journal so queued work survives a restart.  Failed tasks are
+// retried with exponential backoff.
+type taskQueue struct {
+	path     string
+	capacity int
+	now      func() time.Time
+
+	mu       sync.Mutex
+	changed  chan struct{}
+	pending  []*queuedTask
+	tasks    map[taskKey]*queuedTask
+	inflight map[taskKey]*queuedTask
+	failures []taskFailure
+	rejected int64
+	journal  *os.File
+	jrecs    int
+	closed   bool
+}
+
+// Open (or create) a task queue journaled at the given path.
+//
+// Nodes named in the journal are looked up with resolve.  Tasks for
+// nodes that can't be resolved are dropped.
+func openTaskQueue(path string, capacity int,
+	resolve func(name string) (StorageNode, error)) (*taskQueue, error) {
+
+	q := &taskQueue{
+		path:     path,
+		capacity: capacity,
+		now:      time.Now,
+		changed:  make(chan struct{}),
+		tasks:    map[taskKey]*queuedTask{},
+		inflight: map[taskKey]*queuedTask{},
+	}
+
+	recs, err := readTaskJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range recs {
+		t := internodeTask{cmd: r.Cmd, oid: r.OID, prevNode: r.Prev,
+			reqID: r.Req}
+		if r.Node != "" {
+			t.node, err = resolve(r.Node)
+			if err != nil {
+				queueLog.Warnf("Dropping queued %v of %v for %v: %v",
+					r.Cmd, r.OID, r.Node, err)
+				continue
+			}
+			t.node.name = r.Node
+		}
+		qt := &queuedTask{internodeTask: t, queued: r.Queued,
+			attempts: r.Attempts}
+		if qt.queued.IsZero() {
+			qt.queued = q.now()
+		}
+		q.tasks[t.key()] = qt
+		q.pending = append(q.pending, qt)
+	}
+
+	if len(q.pending) > 0 {
+		queueLog.Infof("Recovered %v queued internode tasks", len(q.pending))
+	}
+
+	return q, q.compactLocked()
+}
+
+// Replay a journal into the list of tasks that were still queued.
+func readTaskJournal(path string) ([]taskJournalRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	live := map[taskKey]int{}
+	recs := []taskJournalRecord{}
+
+	d := json.NewDecoder(bufio.NewReader(f))
+	for {
+		r := taskJournalRecord{}
+		err := d.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Probably a torn final write.  Keep what we have.
+			queueLog.Errorf("Error reading task journal %v: %v", path, err)
+			break
+		}
+		k := taskKey{r.Node, r.Cmd, r.OID}
+		switch r.Op {
+		case "+":
+			if i, ok := live[k]; ok {
+				recs[i] = r
+			} else {
+				live[k] = len(recs)
+				recs = append(recs, r)
+			}
+		case "-":
+			if i, ok := live[k]; ok {
+				recs[i].Op = "-"
+				delete(live, k)
+			}
+		}
+	}
+
+	rv := make([]taskJournalRecord, 0, len(live))
+	for _, r := range recs {
+		if r.Op == "+" {
+			rv = append(rv, r)
+		}
+	}
+	return rv, nil
+}
+
+func journalRecord(op string, qt *queuedTask) taskJournalRecord {
+	return taskJournalRecord{
+		Op:       op,
+		Node:     qt.node.name,
+		Cmd:      qt.cmd,
+		OID:      qt.oid,
+		Prev:     qt.prevNode,
+		Req:      qt.reqID,
+		Queued:   qt.queued,
+		Attempts: qt.attempts,
+	}
+}
+
+func (q *taskQueue) writeJournalLocked(op string, qt *queuedTask) {
+	if q.journal == nil {
+		return
+	}
+	err := json.NewEncoder(q.journal).Encode(journalRecord(op, qt))
+	if err != nil {
+		queueLog.Errorf("Error writing task journal: %v", err)
+	}
+	q.jrecs++
+	if q.jrecs > 2*q.capacity && q.jrecs > 4*len(q.tasks) {
+		if err := q.compactLocked(); err != nil {
+			queueLog.Errorf("Error compacting task journal: %v", err)
+		}
+	}
+}
+
+// The tasks we still have, in flight first and then in the order
+// they'll run.
+func (q *taskQueue) orderedLocked() []*queuedTask {
+	pending := map[*queuedTask]bool{}
+	for _, qt := range q.pending {
+		pending[qt] = true
+	}
+	rv := make([]*queuedTask, 0, len(q.tasks))
+	for _, qt := range q.tasks {
+		if !pending[qt] {
+			rv = append(rv, qt)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].queued.Before(rv[j].queued)
+	})
+	for _, qt := range q.pending {
+		if q.tasks[qt.key()] == qt {
+			rv = append(rv, qt)
+		}
+	}
+	return rv
+}
+
+// Rewrite the journal with only the tasks we still have.
+func (q *taskQueue) compactLocked() error {
+	tmp := q.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(f)
+	for _, qt := range q.orderedLocked() {
+		if err := e.Encode(journalRecord("+", qt)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	// Make sure the new journal is on disk before it replaces the old.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+
+	if q.journal != nil {
+		q.journal.Close()
+	}
+	q.journal, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0666)
+	q.jrecs = len(q.tasks)
+	return err
+}
+
+// Wake up anything waiting for the queue to change.
+func (q *taskQueue) signalLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *taskQueue) recordFailureLocked(qt *queuedTask) {
+	q.failures = append(q.failures, taskFailure{qt.item(), q.now()})
+	if len(q.failures) > taskFailureKeep {
+		q.failures = q.failures[len(q.failures)-taskFailureKeep:]
+	}
+}
+
+// Queue a task.  If block is false and the queue is full, the task is
+// rejected and false is returned.  Queueing a task that's already
+// queued or in flight succeeds without adding it again.
+func (q *taskQueue) add(t internodeTask, block bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := t.key()
+	for {
+		if q.closed {
+			queueLog.Infof("Not queueing %v of %v, shutting down",
+				t.cmd, t.oid)
+			return false
+		}
+		if qt, exists := q.tasks[k]; exists {
+			q.refenceLocked(qt, t.fence)
+			return true
+		}
+		if len(q.tasks) < q.capacity {
+			break
+		}
+		if !block {
+			q.rejected++
+			qt := &queuedTask{internodeTask: t, queued: q.now(),
+				lastErr: notQueued}
+			q.recordFailureLocked(qt)
+			return false
+		}
+		ch := q.changed
+		q.mu.Unlock()
+		<-ch
+		q.mu.Lock()
+	}
+
+	qt := &queuedTask{internodeTask: t, queued: q.now()}
+	q.tasks[k] = qt
+	q.pending = append(q.pending, qt)
+	q.writeJournalLocked("+", qt)
+	q.signalLocked()
+	return true
+}
+
+// Move a queued task to a newer lease that asked for the same work,
+// so it isn't dropped as superseded.  A task in flight takes the new
+// lease when it's done.
+func (q *taskQueue) refenceLocked(qt *queuedTask, l *lease) {
+	if qt.fence == nil || l == nil || l.token() <= qt.fence.token() {
+		return
+	}
+	if q.inflight[qt.key()] == qt {
+		if qt.refence == nil || l.token() > qt.refence.token() {
+			qt.refence = l
+		}
+		return
+	}
+	qt.fence = l
+}
+
+// Block until a task is ready to run and mark it in flight.  Returns
+// nil once the queue is closed.
+func (q *taskQueue) next() *queuedTask {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+		now := q.now()
+		earliest := time.Time{}
+		for i, qt := range q.pending {
+			if !qt.notBefore.After(now) {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.inflight[qt.key()] = qt
+				q.mu.Unlock()
+				return qt
+			}
+			if earliest.IsZero() || qt.notBefore.Before(earliest) {
+				earliest = qt.notBefore
+			}
+		}
+		ch := q.changed
+		q.mu.Unlock()
+
+		if earliest.IsZero() {
+			<-ch
+		} else {
+			select {
+			case <-ch:
+			case <-time.After(earliest.Sub(now)):
+			}
+		}
+	}
+}
+
+func taskBackoff(attempts int) time.Duration {
+	d := 5 * time.Second
+	for i := 1; i < attempts && d < maxTaskBackoff; i++ {
+		d *= 2
+	}
+	if d > maxTaskBackoff {
+		d = maxTaskBackoff
+	}
+	return d
+}
+
+// Report the outcome of a task returned from next.  Failed tasks are
+// retried with backoff until they've used up their attempts.
+func (q *taskQueue) done(qt *queuedTask, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	k := qt.key()
+	delete(q.inflight, k)
+
+	refence := qt.refence
+	qt.refence = nil
+	if refence != nil {
+		qt.fence = refence
+	}
+	if err == errLeaseFenced {
+		if refence != nil && q.tasks[k] == qt {
+			// Run it again for whoever asked for it since.
+			q.pending = append(q.pending, qt)
+			q.signalLocked()
+			return
+		}
+		// Superseded rather than failed.
+		err = nil
+	}
+	if err != nil {
+		qt.attempts++
+		qt.lastErr = err
+		if q.tasks[k] == qt && qt.attempts < maxTaskAttempts {
+			qt.notBefore = q.now().Add(taskBackoff(qt.attempts))
+			q.pending = append(q.pending, qt)
+			q.writeJournalLocked("+", qt)
+			q.signalLocked()
+			return
+		}
+		reqLog(queueLog, qt.reqID).Errorf("Giving up on %v of %v after %v attempts: %v",
+			qt.cmd, qt.oid, qt.attempts, err)
+		q.recordFailureLocked(qt)
+	}
+
+	if q.tasks[k] == qt {
+		delete(q.tasks, k)
+		q.writeJournalLocked("-", qt)
+	}
+	q.signalLocked()
+}
+
+// Stop handing out work and wait (until the deadline) for in-flight
+// tasks to finish.  Whatever is still pending stays in the journal for
+// the next start.
+func (q *taskQueue) close(deadline time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.signalLocked()
+
+	for len(q.inflight) > 0 && time.Now().Before(deadline) {
+		ch := q.changed
+		q.mu.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(deadline.Sub(time.Now())):
+		}
+		q.mu.Lock()
+	}
+	if len(q.inflight) > 0 {
+		queueLog.Warnf("Abandoning %v in-flight internode tasks",
+			len(q.inflight))
+	}
+
+	if q.journal == nil {
+		return nil
+	}
+	err := q.journal.Sync()
+	if cerr := q.journal.Close(); err == nil {
+		err = cerr
+	}
+	q.journal = nil
+	return err
+}
+
+// Remove pending (not in flight) tasks matching the given filter.
+func (q *taskQueue) purge(match func(taskQueueItem) bool) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := q.pending[:0]
+	purged := 0
+	for _, qt := range q.pending {
+		if match(qt.item()) {
+			delete(q.tasks, qt.key())
+			q.writeJournalLocked("-", qt)
+			purged++
+		} else {
+			kept = append(kept, qt)
+		}
+	}
+	q.pending = kept
+	q.signalLocked()
+	return purged
+}
+
+func (q *taskQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+type taskQueueState struct {
+	Depth    int             `json:"depth"`
+	Capacity int             `json:"capacity"`
+	Rejected int64           `json:"rejected"`
+	InFlight []taskQueueItem `json:"inflight"`
+	Pending  []taskQueueItem `json:"pending"`
+	Failures []taskFailure   `json:"failures"`
+}
+
+// Describe the queue, including at most limit pending items.
+func (q *taskQueue) state(limit int) taskQueueState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	rv := taskQueueState{
+		Depth:    len(q.tasks),
+		Capacity: q.capacity,
+		Rejected: q.rejected,
+		InFlight: []taskQueueItem{},
+		Pending:  []taskQueueItem{},
+		Failures: append([]taskFailure{}, q.failures...),
+	}
+	for _, qt := range q.inflight {
+		rv.InFlight = append(rv.InFlight, qt.item())
+	}
+	for _, qt := range q.pending {
+		if len(rv.Pending) >= limit {
+			break
+		}
+		rv.Pending = append(rv.Pending, qt.item())
+	}
+	return rv
+}
+
+func init() {
+	expvar.Publish("taskqueue", expvar.Func(func() interface{} {
+		if internodeTaskQueue == nil {
+			return nil
+		}
+		st := internodeTaskQueue.state(0)
+		return map[string]interface{}{
+			"depth":    st.Depth,
+			"inflight": len(st.InFlight),
+			"rejected": st.Rejected,
+		}
+	}))
+}
+
+func doGetTaskQueue(w http.ResponseWriter, req *http.Request) {
+	limit := 1000
+	if l := req.FormValue("limit"); l != "" {
+		fmt.Sscanf(l, "%d", &limit)
+	}
+	sendJson(w, req, internodeTaskQueue.state(limit))
+}
+
+func doPurgeTaskQueue(w http.ResponseWriter, req *http.Request) {
+	node, cmd, oid := req.FormValue("node"), req.FormValue("cmd"),
+		req.FormValue("oid")
+	n := internodeTaskQueue.purge(func(i taskQueueItem) bool {
+		return (node == "" || i.Node == node) &&
+			(cmd == "" || i.Cmd == cmd) &&
+			(oid == "" || i.OID == oid)
+	})
+	queueLog.Infof("Purged %v queued internode tasks per request from %v",
+		n, req.RemoteAddr)
+	sendJson(w, req, map[string]int{"purged": n})
+}
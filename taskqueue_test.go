@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTaskQueue(t *testing.T, path string) *taskQueue {
+	q, err := openTaskQueue(path, 3, func(name string) (StorageNode, error) {
+		if name == "gone" {
+			return StorageNode{}, errors.New("no such node")
+		}
+		return StorageNode{Addr: name + ":8484"}, nil
+	})
+	if err != nil {
+		t.Fatalf("Error opening queue: %v", err)
+	}
+	return q
+}
+
+func TestTaskQueue(t *testing.T) {
+	d, err := ioutil.TempDir("", "taskqueue")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, ".taskqueue")
+
+	q := testTaskQueue(t, path)
+	now := time.Unix(1000, 0)
+	q.now = func() time.Time { return now }
+
+	a := internodeTask{node: StorageNode{name: "n1"}, cmd: acquireObjectCmd,
+		oid: "a", prevNode: "n2"}
+	b := internodeTask{node: StorageNode{name: "gone"}, cmd: removeObjectCmd,
+		oid: "b"}
+	c := internodeTask{cmd: fetchObjectCmd, oid: "c"}
+
+	for _, task := range []internodeTask{a, a, b, c} {
+		if !q.add(task, false) {
+			t.Fatalf("Failed to queue %v", task)
+		}
+	}
+	if q.depth() != 3 {
+		t.Fatalf("Expected duplicates to be dropped, depth=%v", q.depth())
+	}
+	if q.add(internodeTask{cmd: fetchObjectCmd, oid: "d"}, false) {
+		t.Fatalf("Expected a full queue to reject work")
+	}
+
+	// A failed task goes to the back with a backoff.
+	qt := q.next()
+	if qt.oid != "a" {
+		t.Fatalf("Expected a first, got %v", qt.oid)
+	}
+	q.done(qt, errors.New("nope"))
+	if qt.attempts != 1 || qt.notBefore != now.Add(taskBackoff(1)) {
+		t.Errorf("Expected a retry in %v, got %v at %v",
+			taskBackoff(1), qt.attempts, qt.notBefore)
+	}
+
+	qt = q.next()
+	if qt.oid != "b" {
+		t.Fatalf("Expected b while a backs off, got %v", qt.oid)
+	}
+	q.done(qt, nil)
+
+	st := q.state(10)
+	if st.Depth != 2 || len(st.Pending) != 2 || len(st.Failures) != 1 {
+		t.Errorf("Unexpected state: %+v", st)
+	}
+
+	// Reopening recovers what wasn't finished.
+	q2 := testTaskQueue(t, path)
+	st = q2.state(10)
+	if len(st.Pending) != 2 || st.Pending[0].OID != "a" ||
+		st.Pending[0].Node != "n1" || st.Pending[0].Prev != "n2" ||
+		st.Pending[1].OID != "c" {
+		t.Fatalf("Unexpected recovered state: %+v", st.Pending)
+	}
+
+	if n := q2.purge(func(i taskQueueItem) bool { return i.Cmd == "fetch" }); n != 1 {
+		t.Errorf("Expected to purge one task, purged %v", n)
+	}
+
+	q3 := testTaskQueue(t, path)
+	if q3.depth() != 1 {
+		t.Errorf("Expected purge to persist, depth=%v", q3.depth())
+	}
+}
+
+func TestTaskQueueCompaction(t *testing.T) {
+	d, err := ioutil.TempDir("", "taskqueue")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, ".taskqueue")
+
+	q := testTaskQueue(t, path)
+	now := time.Unix(1000, 0).UTC()
+	q.now = func() time.Time { return now }
+	for _, oid := range []string{"a", "b", "c"} {
+		q.add(internodeTask{cmd: fetchObjectCmd, oid: oid}, false)
+		now = now.Add(time.Second)
+	}
+	q.done(q.next(), errors.New("nope"))
+
+	q.mu.Lock()
+	err = q.compactLocked()
+	q.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	// Reopening keeps the order, queue times and attempts.
+	q2 := testTaskQueue(t, path)
+	got := []string{}
+	for _, i := range q2.state(10).Pending {
+		got = append(got, i.OID)
+		exp := 0
+		if i.OID == "a" {
+			exp = 1
+		}
+		if i.Attempts != exp {
+			t.Errorf("Expected %v attempts at %v, got %v", exp, i.OID, i.Attempts)
+		}
+		if i.OID == "c" && !i.Queued.Equal(time.Unix(1002, 0)) {
+			t.Errorf("Expected c to keep its queue time, got %v", i.Queued)
+		}
+	}
+	if strings.Join(got, "") != "bca" {
+		t.Errorf("Expected tasks in the order b, c, a, got %v", got)
+	}
+}
+
+func TestTaskQueueRefence(t *testing.T) {
+	d, err := ioutil.TempDir("", "taskqueue")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	q := testTaskQueue(t, filepath.Join(d, ".taskqueue"))
+
+	c, _, a, b := testLeases(t)
+	la, err := a.acquire("gc")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	la.stopOnce.Do(func() { close(la.stop) })
+
+	waiting := internodeTask{node: StorageNode{name: "n1"},
+		cmd: removeObjectCmd, oid: "x", fence: la}
+	running := internodeTask{node: StorageNode{name: "n1"},
+		cmd: removeObjectCmd, oid: "y", fence: la}
+	q.add(running, false)
+	q.add(waiting, false)
+	inflight := q.next()
+
+	// The next run of the task asks for the same work under a newer
+	// lease.
+	c.advance(31 * time.Second)
+	lb, err := b.acquire("gc")
+	if err != nil {
+		t.Fatalf("Error acquiring: %v", err)
+	}
+	defer lb.release()
+	for _, task := range []internodeTask{running, waiting} {
+		task.fence = lb
+		if !q.add(task, false) {
+			t.Fatalf("Failed to queue %v", task.oid)
+		}
+	}
+	if q.depth() != 2 {
+		t.Fatalf("Expected duplicates to be merged, depth=%v", q.depth())
+	}
+
+	// The old run's attempt is refused, but the work still happens.
+	if err := inflight.fence.check(); err != errLeaseFenced {
+		t.Fatalf("Expected the old lease to be fenced, got %v", err)
+	}
+	q.done(inflight, errLeaseFenced)
+
+	ran := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		qt := q.next()
+		if err := qt.fence.check(); err != nil {
+			t.Errorf("Expected %v to run under the new lease, got %v",
+				qt.oid, err)
+		}
+		ran[qt.oid] = true
+		q.done(qt, nil)
+	}
+	if !ran["x"] || !ran["y"] || q.depth() != 0 {
+		t.Errorf("Expected both tasks to run, ran %v, depth=%v", ran, q.depth())
+	}
+}
+
+func TestTaskQueueDropsUnknownNodes(t *testing.T) {
+	d, err := ioutil.TempDir("", "taskqueue")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, ".taskqueue")
+
+	q := testTaskQueue(t, path)
+	q.add(internodeTask{node: StorageNode{name: "gone"},
+		cmd: removeObjectCmd, oid: "x"}, false)
+
+	if q2 := testTaskQueue(t, path); q2.depth() != 0 {
+		t.Errorf("Expected task for unknown node to be dropped")
+	}
+}
+
+func TestTaskBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		exp      time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{20, maxTaskBackoff},
+	}
+	for _, test := range tests {
+		if got := taskBackoff(test.attempts); got != test.exp {
+			t.Errorf("Backoff for %v attempts = %v, want %v",
+				test.attempts, got, test.exp)
+		}
+	}
+}
+
+func TestTaskQueueClose(t *testing.T) {
+	d, err := ioutil.TempDir("", "taskqueue")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, ".taskqueue")
+
+	q := testTaskQueue(t, path)
+	q.add(internodeTask{cmd: fetchObjectCmd, oid: "a"}, false)
+	q.add(internodeTask{cmd: fetchObjectCmd, oid: "b"}, false)
+
+	qt := q.next()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.done(qt, nil)
+	}()
+
+	if err := q.close(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if len(q.state(0).InFlight) != 0 {
+		t.Errorf("Expected close to wait for in-flight work")
+	}
+	if q.next() != nil {
+		t.Errorf("Expected no more work after close")
+	}
+	if q.add(internodeTask{cmd: fetchObjectCmd, oid: "c"}, true) {
+		t.Errorf("Expected a closed queue to refuse work")
+	}
+
+	if q2 := testTaskQueue(t, path); q2.depth() != 1 {
+		t.Errorf("Expected the pending task to survive, depth=%v", q2.depth())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -11,12 +12,14 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"encoding/hex"
-
 	"github.com/couchbase/gomemcached"
 	"github.com/couchbase/gomemcached/client"
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/schedule"
 	cb "github.com/couchbaselabs/go-couchbase"
 )
 
@@ -29,16 +32,20 @@ var maxStartupRepls = flag.Int("maxStartRepls", 2,
 
 type PeriodicJob struct {
 	period       func() time.Duration
-	f            func() error
+	basePeriod   func() time.Duration
+	schedule     func() cbfsschedule.Schedule
+	f            func(context.Context) error
 	excl         []string
-	ticker       *time.Ticker
+	heavy        bool
 	configChange chan interface{}
 }
 
 type periodicJobRecipe struct {
 	period func() time.Duration
-	f      func() error
+	f      func(context.Context) error
 	excl   []string
+	// Heavy tasks only start in the maintenance window.
+	heavy bool
 }
 
 var globalPeriodicJobRecipes = map[string]*periodicJobRecipe{}
@@ -53,20 +60,24 @@ func init() {
 			},
 			checkStaleNodes,
 			nil,
+			false,
 		},
 		"garbageCollectBlobs": {
 			func() time.Duration {
 				return globalConfig.GCFreq
 			},
 			garbageCollectBlobs,
-			[]string{"ensureMinReplCount", "trimFullNodes"},
+			[]string{"ensureMinReplCount", "trimFullNodes", "rebalance",
+				"backup"},
+			true,
 		},
 		"ensureMinReplCount": {
 			func() time.Duration {
 				return globalConfig.UnderReplicaCheckFreq
 			},
 			ensureMinimumReplicaCount,
-			[]string{"garbageCollectBlobs", "trimFullNodes"},
+			[]string{"garbageCollectBlobs", "trimFullNodes", "rebalance"},
+			false,
 		},
 		"pruneExcessiveReplicas": {
 			func() time.Duration {
@@ -74,6 +85,7 @@ func init() {
 			},
 			pruneExcessiveReplicas,
 			nil,
+			false,
 		},
 		"updateNodeSizes": {
 			func() time.Duration {
@@ -81,13 +93,31 @@ func init() {
 			},
 			updateNodeSizes,
 			nil,
+			false,
 		},
 		"trimFullNodes": {
 			func() time.Duration {
 				return globalConfig.TrimFullNodesFreq
 			},
 			trimFullNodes,
-			[]string{"ensureMinReplCount", "garbageCollectBlobs"},
+			[]string{"ensureMinReplCount", "garbageCollectBlobs", "rebalance"},
+			true,
+		},
+		"rebalance": {
+			func() time.Duration {
+				return globalConfig.RebalanceFreq
+			},
+			rebalanceCluster,
+			[]string{"garbageCollectBlobs", "ensureMinReplCount", "trimFullNodes"},
+			true,
+		},
+		"backup": {
+			func() time.Duration {
+				return globalConfig.BackupFreq
+			},
+			scheduledBackup,
+			[]string{"garbageCollectBlobs"},
+			true,
 		},
 	}
 
@@ -98,6 +128,7 @@ func init() {
 			},
 			validateLocal,
 			[]string{"reconcile", "quickReconcile"},
+			true,
 		},
 		"reconcile": {
 			func() time.Duration {
@@ -105,6 +136,7 @@ func init() {
 			},
 			reconcile,
 			[]string{"validateLocal", "quickReconcile"},
+			true,
 		},
 		"quickReconcile": {
 			func() time.Duration {
@@ -112,6 +144,7 @@ func init() {
 			},
 			quickReconcile,
 			[]string{"reconcile", "validateLocal"},
+			false,
 		},
 		"cleanTmp": {
 			func() time.Duration {
@@ -119,6 +152,7 @@ func init() {
 			},
 			cleanTmpFiles,
 			nil,
+			false,
 		},
 		"checkTime": {
 			func() time.Duration {
@@ -126,6 +160,7 @@ func init() {
 			},
 			checkTime,
 			nil,
+			false,
 		},
 	}
 
@@ -139,8 +174,9 @@ type JobMarker struct {
 }
 
 type TaskState struct {
-	State     string    `json:"state"`
-	Timestamp time.Time `json:"ts"`
+	State     string        `json:"state"`
+	Timestamp time.Time     `json:"ts"`
+	Progress  *TaskProgress `json:"progress,omitempty"`
 }
 
 type TaskList struct {
@@ -162,7 +198,7 @@ func setTaskState(task, state string) error {
 				return nil, nil
 			}
 		} else {
-			ob.Tasks[task] = TaskState{state, ts}
+			ob.Tasks[task] = TaskState{state, ts, nil}
 		}
 		ob.Type = "tasks"
 		ob.Node = serverId
@@ -217,6 +253,7 @@ func runNamedTask(name string, job *PeriodicJob, force bool) error {
 		time.Sleep(time.Second)
 		return fmt.Errorf("Would've run with a 0s ttl")
 	}
+	t = markerTTL(job.schedule())
 
 	jm := JobMarker{
 		Node:    serverId,
@@ -276,7 +313,7 @@ func logErrors(from string, errs <-chan error) {
 	}
 }
 
-func validateLocal() error {
+func validateLocal(ctx context.Context) error {
 	log.Printf("Validating Local Blobs")
 
 	me := StorageNode{name: serverId}
@@ -292,14 +329,20 @@ func validateLocal() error {
 
 	nl, err := findAllNodes()
 	if err != nil {
-		log.Printf("Error getting node list for local validation: %v",
+		taskLog.Errorf("Error getting node list for local validation: %v",
 			err)
 	}
 
+	progress := progressOf(ctx)
 	start := time.Now()
 	count := 0
 	for hash := range oids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		progress.scanned(1)
 		if !hasBlob(hash) {
+			progress.acted(1)
 			log.Printf("Mistakenly registered with %v",
 				hash)
 			owners := removeBlobOwnershipRecord(hash, serverId)
@@ -330,7 +373,7 @@ func cleanupNode(node string) {
 
 	nodes, err := findAllNodes()
 	if err != nil {
-		log.Printf("Error finding node list, aborting clean: %v", err)
+		taskLog.Errorf("Error finding node list, aborting clean: %v", err)
 		return
 	}
 
@@ -358,7 +401,7 @@ func cleanupNode(node string) {
 			"stale":        false,
 		}, &viewRes)
 	if err != nil {
-		log.Printf("Error executing node_blobs view: %v", err)
+		taskLog.Errorf("Error executing node_blobs view: %v", err)
 		return
 	}
 	foundRows := 0
@@ -384,15 +427,15 @@ func cleanupNode(node string) {
 		log.Printf("Removing node record: %v", node)
 		err = couchbase.Delete("/" + node)
 		if err != nil {
-			log.Printf("Error deleting %v node record: %v", node, err)
+			taskLog.Errorf("Error deleting %v node record: %v", node, err)
 		}
 		err = couchbase.Delete("/" + node + "/r")
 		if err != nil {
-			log.Printf("Error deleting %v node counter: %v", node, err)
+			taskLog.Errorf("Error deleting %v node counter: %v", node, err)
 		}
 		err = removeFromNodeRegistry(node)
 		if err != nil {
-			log.Printf("Error deleting %v from registry: %v", node, err)
+			taskLog.Errorf("Error deleting %v from registry: %v", node, err)
 		}
 		cleanNodeTaskMarkers(node)
 	}
@@ -401,7 +444,7 @@ func cleanupNode(node string) {
 func cleanNodeTaskMarkers(node string) {
 	err := couchbase.Delete("/@" + node + "/tasks")
 	if err != nil {
-		log.Printf("Error removing %v's task list: %v", node, err)
+		taskLog.Errorf("Error removing %v's task list: %v", node, err)
 	}
 	for name := range globalPeriodicJobRecipes {
 		k := "/@" + name + "/running"
@@ -419,36 +462,153 @@ func cleanNodeTaskMarkers(node string) {
 		})
 
 		if err != nil && err != cb.UpdateCancel {
-			log.Printf("Error removing %v's %v running marker: %v",
+			taskLog.Errorf("Error removing %v's %v running marker: %v",
 				node, name, err)
 		}
 	}
 }
 
-func checkStaleNodes() error {
+// Give up the global tasks we're in the middle of so another node can
+// pick them up without waiting for the markers to expire.
+func releaseTaskLocks() {
+	releaseHeldLeases()
+	for name := range globalPeriodicJobRecipes {
+		running := map[string]interface{}{}
+		err := couchbase.Get("/@"+name+"/running", &running)
+		if err != nil || running["node"] != serverId {
+			continue
+		}
+
+		k := "/@" + name
+		err = couchbase.Update(k, 0, func(in []byte) ([]byte, error) {
+			jm := JobMarker{}
+			if json.Unmarshal(in, &jm) == nil && jm.Node == serverId {
+				return nil, nil
+			}
+			return nil, cb.UpdateCancel
+		})
+		if err != nil && err != cb.UpdateCancel {
+			taskLog.Errorf("Error releasing %v: %v", name, err)
+		} else if err == nil {
+			log.Printf("Released task lock for %v", name)
+		}
+	}
+	cleanNodeTaskMarkers(serverId)
+}
+
+func checkStaleNodes(ctx context.Context) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
 	}
 
+	progress := progressOf(ctx)
+	progress.setTotal(len(nl))
 	for _, node := range nl {
+		progress.scanned(1)
 		d := time.Since(node.Time)
 
-		if d > globalConfig.StaleNodeLimit {
+		if node.isStale() {
 			if node.IsLocal() {
 				log.Printf("Would've cleaned up myself after %v",
 					d)
 				continue
 			}
-			log.Printf("Node %v missed heartbeat schedule: %v",
-				node.name, d)
+			if node.Leaving {
+				log.Printf("Node %v left the cluster", node.name)
+			} else {
+				log.Printf("Node %v missed heartbeat schedule: %v",
+					node.name, d)
+			}
+			progress.acted(1)
 			go cleanupNode(node.name)
 		}
 	}
 	return nil
 }
 
+var (
+	taskLeases   *leaseService
+	heldLeases   = map[string]*lease{}
+	heldLeasesMu sync.Mutex
+)
+
+func initTaskLeases() {
+	taskLeases = newLeaseService(cbLeaseBackend{}, realClock{}, serverId,
+		func() time.Duration { return globalConfig.LeaseTTL })
+}
+
+func taskLeaseKey(taskName string) string {
+	return "/@" + taskName + "/lease"
+}
+
+// Take the lease for a global task, record it for relockTask and
+// arrange for it to be given up when done is called.
+func acquireTaskLease(taskName string) (*lease, func(), error) {
+	l, err := taskLeases.acquire(taskLeaseKey(taskName))
+	if err != nil {
+		return nil, nil, err
+	}
+	l.OnLost(func() {
+		taskLog.Warnf("Lost the lease for %v, it should stop soon", taskName)
+	})
+
+	heldLeasesMu.Lock()
+	heldLeases[taskName] = l
+	heldLeasesMu.Unlock()
+
+	return l, func() {
+		heldLeasesMu.Lock()
+		if heldLeases[taskName] == l {
+			delete(heldLeases, taskName)
+		}
+		heldLeasesMu.Unlock()
+		l.release()
+	}, nil
+}
+
+func heldTaskLease(taskName string) *lease {
+	heldLeasesMu.Lock()
+	defer heldLeasesMu.Unlock()
+	return heldLeases[taskName]
+}
+
+type taskLeaseCtxKey struct{}
+
+// The lease of the global task running under ctx, if any.
+func leaseOf(ctx context.Context) *lease {
+	l, _ := ctx.Value(taskLeaseCtxKey{}).(*lease)
+	return l
+}
+
+// Fail if the global task running under ctx has been superseded.
+// Tasks call this before anything another holder could be doing too.
+func checkFence(ctx context.Context) error {
+	return leaseOf(ctx).check()
+}
+
+func releaseHeldLeases() {
+	heldLeasesMu.Lock()
+	held := heldLeases
+	heldLeases = map[string]*lease{}
+	heldLeasesMu.Unlock()
+
+	for name, l := range held {
+		log.Printf("Releasing lease for %v", name)
+		l.release()
+	}
+}
+
 func taskRunning(taskName string) bool {
+	if _, global := globalPeriodicJobRecipes[taskName]; global && taskLeases != nil {
+		_, held, err := taskLeases.holder(taskLeaseKey(taskName))
+		if err != nil {
+			taskLog.Warnf("Error checking lease for %v: %v", taskName, err)
+		}
+		if held {
+			return true
+		}
+	}
 	into := map[string]interface{}{}
 	err := couchbase.Get("/@"+taskName+"/running", &into)
 	return err == nil
@@ -463,15 +623,18 @@ func anyTaskRunning(taskNames []string) bool {
 	return false
 }
 
+// Check that we're still entitled to run a task.  Global tasks are
+// entitled for as long as they hold their lease and nobody newer has
+// been granted it.
 func relockTask(taskName string) bool {
-	k := "/@" + taskName
-
-	task := globalPeriodicJobRecipes[taskName]
-	if task == nil {
-		task = localPeriodicJobRecipes[taskName]
-		k = "/@" + serverId + "/" + taskName
+	if globalPeriodicJobRecipes[taskName] != nil {
+		l := heldTaskLease(taskName)
+		return l != nil && l.valid() && l.check() == nil
 	}
 
+	task := localPeriodicJobRecipes[taskName]
+	k := "/@" + serverId + "/" + taskName
+
 	err := couchbase.Do(k, func(mc *memcached.Client, vb uint16) error {
 		resp, err := mc.Get(vb, k)
 		if err != nil {
@@ -496,7 +659,7 @@ func relockTask(taskName string) bool {
 			Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
 			Body:    mustEncode(&jm),
 		}
-		exp := task.period().Seconds()
+		exp := markerTTL(taskSchedule(taskName, task.period)).Seconds()
 		binary.BigEndian.PutUint64(req.Extras, uint64(exp))
 
 		_, err = mc.Send(req)
@@ -507,19 +670,40 @@ func relockTask(taskName string) bool {
 }
 
 func runMarkedTask(name string, job *PeriodicJob) error {
+	global := !strings.HasPrefix(name, serverId+"/")
+
+	var held *lease
 	start := time.Now()
-	for anyTaskRunning(job.excl) {
-		log.Printf("Execution of %v is blocked on one of %v",
-			name, job.excl)
-		time.Sleep(5 * time.Second)
-		if time.Since(start) > job.period() {
-			return fmt.Errorf("Execution blocked for too long")
+	for {
+		for anyTaskRunning(job.excl) {
+			log.Printf("Execution of %v is blocked on one of %v",
+				name, job.excl)
+			time.Sleep(5 * time.Second)
+			if time.Since(start) > job.period() {
+				return fmt.Errorf("Execution blocked for too long")
+			}
+		}
+		if !global {
+			break
 		}
-	}
 
-	if !strings.HasPrefix(name, serverId+"/") && !relockTask(name) {
-		log.Printf("We lost the lock for %v", name)
-		return nil
+		l, release, err := acquireTaskLease(name)
+		if err == errLeaseHeld {
+			log.Printf("%v is already running elsewhere", name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Something we exclude may have started while we
+		// were taking the lease.
+		if !anyTaskRunning(job.excl) {
+			defer release()
+			held = l
+			break
+		}
+		release()
 	}
 
 	taskKey := "/@" + name + "/running"
@@ -540,11 +724,25 @@ func runMarkedTask(name string, job *PeriodicJob) error {
 		return err
 	}
 
-	defer endedTask(name, time.Now())
-	return job.f()
+	ctx, rt, finished := startTaskContext(name)
+	defer finished()
+	if held != nil {
+		// Stop the job if someone else may have started it.
+		held.OnLost(rt.cancel)
+		ctx = context.WithValue(ctx, taskLeaseCtxKey{}, held)
+	}
+
+	started := time.Now()
+	defer endedTask(name, started)
+	err = traceTask(ctx, name, job.f)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	recordTaskRun(name, started, err, rt.progress)
+	return err
 }
 
-func moveSomeOffOf(n StorageNode, nl NodeList) {
+func moveSomeOffOf(ctx context.Context, n StorageNode, nl NodeList) {
 	log.Printf("Freeing up some space from %v", n)
 
 	viewRes := struct {
@@ -569,16 +767,21 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 			"stale":        false,
 		}, &viewRes)
 	if err != nil {
-		log.Printf("Error executing node_blobs view: %v", err)
+		taskLog.Errorf("Error executing node_blobs view: %v", err)
 		return
 	}
 
+	progress := progressOf(ctx)
 	removed := int64(0)
 	log.Printf("Moving %v blobs from %v", len(viewRes.Rows), n)
 	for _, row := range viewRes.Rows {
+		if ctx.Err() != nil {
+			return
+		}
 		oid := row.Id[1:]
 		candidates := NodeList{}
 
+		progress.scanned(1)
 		removed += row.Doc.Json.Length
 
 		if removed > globalConfig.TrimFullNodesSpace {
@@ -606,17 +809,19 @@ func moveSomeOffOf(n StorageNode, nl NodeList) {
 
 			log.Printf("Moving replica of %v from %v to %v",
 				oid, n, newnode)
-			queueBlobAcquire(newnode, oid, n.name)
+			queueTaskBlobAcquire(ctx, newnode, oid, n.name, true)
 		} else {
 			// There are enough, just trim it.
 			log.Printf("Just trimming %v from %v", oid, n)
-			queueBlobRemoval(n, oid)
+			queueTaskBlobRemoval(ctx, n, oid)
 		}
+		progress.acted(1)
+		progress.moved(row.Doc.Json.Length)
 	}
 
 }
 
-func trimFullNodes() error {
+func trimFullNodes(ctx context.Context) error {
 	nl, err := findAllNodes()
 	if err != nil {
 		return err
@@ -635,17 +840,13 @@ func trimFullNodes() error {
 	}
 
 	for _, n := range toRelieve {
-		moveSomeOffOf(n, hasSpace)
+		moveSomeOffOf(ctx, n, hasSpace)
 	}
 
-	return nil
+	return ctx.Err()
 }
 
-func okToClean(oid string) bool {
-	return markGarbage(oid) == nil
-}
-
-func garbageCollectBlobs() error {
+func garbageCollectBlobs(ctx context.Context) error {
 	if !globalConfig.GCEnabled {
 		log.Printf("Garbage collection is disabled -- skipping")
 		return nil
@@ -653,102 +854,54 @@ func garbageCollectBlobs() error {
 
 	log.Printf("Garbage collecting blobs without any file references")
 
-	backedup, err := loadExistingHashes()
-	if err != nil {
-		return err
-	}
-
-	viewRes := struct {
-		Rows []struct {
-			Key []string
-		}
-		Errors []cb.ViewError
-	}{}
-
 	nm, err := findNodeMap()
 	if err != nil {
 		return err
 	}
 
-	count, skipped, inBackup := 0, 0, 0
-	startKey := "g"
-	done := false
-	for !done {
-		log.Printf("  gc loop at %#v", startKey)
-		// we hit this view descending because we want file sorted
-		// before blob the fact that we walk the list backwards
-		// hopefully not too awkward
-		err := couchbase.ViewCustom("cbfs", "file_blobs",
-			map[string]interface{}{
-				"stale":      false,
-				"descending": true,
-				"limit":      globalConfig.GCLimit + 1,
-				"startkey":   []string{startKey},
-			}, &viewRes)
-		if err != nil {
-			return err
-		}
-		done = len(viewRes.Rows) < globalConfig.GCLimit
-
-		if len(viewRes.Errors) > 0 {
-			return fmt.Errorf("View errors: %v", viewRes.Errors)
-		}
-
-		lastBlob := ""
-		for _, r := range viewRes.Rows {
-			if len(r.Key) < 3 {
-				log.Printf("Malformed key in gc result: %+v", r)
-				continue
-			}
-			blobId := r.Key[0]
-			typeFlag := r.Key[1]
-			blobNode := r.Key[2]
-			startKey = blobId
-
-			switch typeFlag {
-			case "file":
-				lastBlob = blobId
-			case "blob":
-				if blobId != lastBlob {
-					n, ok := nm[blobNode]
-					switch {
-					case blobNode == "":
-						removeBlobOwnershipRecord(blobId, serverId)
-						count++
-					case ok:
-						if b, err := hex.DecodeString(blobId); err == nil &&
-							backedup.Contains(b) {
-
-							inBackup++
-						} else if okToClean(blobId) {
-							log.Printf("GC removing %v from %v", blobId, n)
-							queueBlobRemoval(n, blobId)
-							count++
-						} else {
-							log.Printf("Not cleaning %v, recently used",
-								blobId)
-							skipped++
-						}
-					default:
-						log.Printf("No nodemap entry for %v",
-							blobNode)
-					}
-				}
+	progress := progressOf(ctx)
+	count, marked, skipped, inBackup := 0, 0, 0, 0
+	err = walkGarbage(ctx, false, func(e gcEntry) {
+		switch {
+		case e.Node == "":
+			removeBlobOwnershipRecord(e.OID, serverId)
+			progress.acted(1)
+			count++
+		case e.Action == gcDeleteBlob:
+			n, ok := nm[e.Node]
+			if !ok {
+				log.Printf("No nodemap entry for %v", e.Node)
+				return
 			}
+			log.Printf("GC removing %v from %v", e.OID, n)
+			queueTaskBlobRemoval(ctx, n, e.OID)
+			progress.acted(1)
+			count++
+		case e.Action == gcMarkBlob:
+			marked++
+		case e.Reason == gcInBackup:
+			inBackup++
+		default:
+			log.Printf("Not cleaning %v: %v", e.OID, e.Reason)
+			skipped++
 		}
-
-		if !relockTask("garbageCollectBlobs") {
-			log.Printf("We lost the lock for garbage collecting.")
-			return errors.New("Lost lock")
-		}
+	})
+	if err != nil {
+		return err
 	}
 
-	log.Printf("Scheduled %d blobs for deletion, skipped %d, in backup %d",
-		count, skipped, inBackup)
+	log.Printf("Scheduled %d blobs for deletion, marked %d, skipped %d, in backup %d",
+		count, marked, skipped, inBackup)
+	progress.summarize("Scheduled %d deletions, marked %d, skipped %d, in backup %d",
+		count, marked, skipped, inBackup)
 	return nil
 }
 
-func checkTime() error {
+// How far our clock was from the database's when last checked, and
+// when that was (unix nanos).
+var clockDrift, clockChecked int64
+
+func checkTime(ctx context.Context) error {
 	m := couchbase.GetStats("")
 	post := time.Now()
 
@@ -760,13 +913,13 @@ func checkTime() error {
 			numTimes++
 			totalTimes += int64(i)
 		} else {
-			log.Printf("time error:  parsing %q from %v: %v",
+			taskLog.Warnf("time error:  parsing %q from %v: %v",
 				v["time"], k, err)
 		}
 	}
 
 	if numTimes == 0 {
-		log.Printf("time error:  no times found")
+		taskLog.Warnf("time error:  no times found")
 		return nil
 	}
 
@@ -777,8 +930,11 @@ func checkTime() error {
 		tDelta = -tDelta
 	}
 
+	atomic.StoreInt64(&clockDrift, int64(tDelta))
+	atomic.StoreInt64(&clockChecked, post.UnixNano())
+
 	if tDelta > globalConfig.DriftWarnThresh {
-		log.Printf("time error:  clock is off by %v", tDelta)
+		taskLog.Warnf("time error:  clock is off by %v", tDelta)
 	}
 	return nil
 }
@@ -807,7 +963,7 @@ func grabSomeData() {
 		&viewRes)
 
 	if err != nil {
-		log.Printf("Error finding docs to suck: %v", err)
+		taskLog.Errorf("Error finding docs to suck: %v", err)
 		return
 	}
 
@@ -815,7 +971,7 @@ func grabSomeData() {
 
 	for _, r := range viewRes.Rows {
 		if !hasBlob(r.Id[1:]) {
-			if !maybeQueueBlobFetch(r.Id[1:], "") {
+			if !maybeQueueBlobFetch(r.Id[1:], "", "") {
 				log.Printf("Fetch queue is full, giving up.")
 				return
 			}
@@ -826,50 +982,176 @@ func grabSomeData() {
 func periodicTaskGasp(name string) {
 	buf := make([]byte, 8192)
 	w := runtime.Stack(buf, false)
-	log.Fatalf("Fatal error in periodic job %v: %v\n%s",
+	taskLog.Fatalf("Fatal error in periodic job %v: %v\n%s",
 		name, recover(), buf[:w])
 }
 
+// The schedule a task runs on.  A configured schedule overrides the
+// task's usual period.
+func taskSchedule(name string, period func() time.Duration) cbfsschedule.Schedule {
+	if spec, ok := globalConfig.Schedules[name]; ok {
+		if s, err := cbfsschedule.Parse(spec); err == nil {
+			return s
+		}
+	}
+	d := period()
+	if d < time.Second {
+		d = time.Hour * 24
+	}
+	return cbfsschedule.Every(d)
+}
+
+// How long a task usually goes between runs.
+func taskPeriod(name string, period func() time.Duration) time.Duration {
+	return cbfsschedule.Interval(taskSchedule(name, period), time.Now())
+}
+
+// Make sure a config's schedules and maintenance window make sense.
+func validateSchedules(conf cbfsconfig.CBFSConfig) error {
+	for name, spec := range conf.Schedules {
+		if globalPeriodicJobRecipes[name] == nil &&
+			localPeriodicJobRecipes[name] == nil {
+			return fmt.Errorf("Schedule for unknown task %q", name)
+		}
+		if _, err := cbfsschedule.Parse(spec); err != nil {
+			return fmt.Errorf("Schedule for %v: %v", name, err)
+		}
+	}
+	for _, name := range strings.Split(conf.DisabledTasks, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && globalPeriodicJobRecipes[name] == nil &&
+			localPeriodicJobRecipes[name] == nil {
+			return fmt.Errorf("Can't disable unknown task %q", name)
+		}
+	}
+	_, err := cbfsschedule.ParseWindow(conf.MaintenanceWindow)
+	return err
+}
+
+// True if the config says not to run the task on schedule here.
+func taskDisabled(name string) bool {
+	for _, t := range strings.Split(globalConfig.DisabledTasks, ",") {
+		if strings.TrimSpace(t) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func checkSchedule(name string, sched cbfsschedule.Schedule) {
+	if spec, ok := globalConfig.Schedules[name]; ok {
+		if _, err := cbfsschedule.Parse(spec); err != nil {
+			log.Printf("Ignoring schedule for %v: %v, running every %v",
+				name, err, sched)
+		}
+	}
+}
+
+// How long a task's marker keeps others from running it.  Cron
+// schedules fire at the same moment on every node, so the marker must
+// be gone by the next firing.
+func markerTTL(s cbfsschedule.Schedule) time.Duration {
+	now := time.Now()
+	if !cbfsschedule.Aligned(s) {
+		return cbfsschedule.Interval(s, now)
+	}
+	ttl := s.Next(now).Sub(now)
+	if ttl > 2*time.Minute {
+		ttl -= time.Minute
+	} else {
+		ttl /= 2
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+func maintenanceWindow() cbfsschedule.Window {
+	w, err := cbfsschedule.ParseWindow(globalConfig.MaintenanceWindow)
+	if err != nil {
+		taskLog.Warnf("Ignoring invalid maintenance window: %v", err)
+	}
+	return w
+}
+
+func resetTimer(t *time.Timer, at time.Time) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(at.Sub(time.Now()))
+}
+
+// When the job should next run after now.  A schedule that never fires
+// falls back to the task's usual period.
+func nextRun(name string, job *PeriodicJob, sched cbfsschedule.Schedule,
+	now time.Time) time.Time {
+
+	if n := sched.Next(now); n.After(now) {
+		return n
+	}
+	d := job.basePeriod()
+	if d < time.Second {
+		d = time.Hour * 24
+	}
+	log.Printf("Schedule %v for %v never fires, running every %v", sched, name, d)
+	return now.Add(d)
+}
+
 func runPeriodicJob(name string, job *PeriodicJob, inducer chan time.Time,
 	executor func(name string, job *PeriodicJob, force bool) error) {
 
 	defer periodicTaskGasp(name)
 
 	time.Sleep(time.Second * time.Duration(5+rand.Intn(60)))
-	period := job.period()
-	if period < time.Second {
-		log.Printf("Period for %v is too short (%v), going reasonable",
-			name, period)
-		period = time.Hour * 24
-	}
-	job.ticker = time.NewTicker(period)
+	sched := job.schedule()
+	checkSchedule(name, sched)
+	timer := time.NewTimer(nextRun(name, job, sched, time.Now()).Sub(time.Now()))
+	postponed := false
 
 	for {
 		select {
 		case <-inducer:
 			err := executor(name, job, true)
 			if err != nil {
-				log.Printf("Error running induced task %v: %v", name, err)
+				taskLog.Errorf("Error running induced task %v: %v", name, err)
 			}
 
-		case <-job.ticker.C:
+		case now := <-timer.C:
+			if taskDisabled(name) {
+				log.Printf("Not running %v, it's disabled on this node", name)
+				timer.Reset(nextRun(name, job, sched, now).Sub(now))
+				continue
+			}
+			if w := maintenanceWindow(); job.heavy && !w.Contains(now) {
+				open := w.NextOpen(now)
+				log.Printf("Postponing %v until the maintenance window opens at %v",
+					name, open)
+				postponed = true
+				timer.Reset(open.Sub(now))
+				continue
+			}
+			postponed = false
 			err := executor(name, job, false)
 			if err != nil {
-				log.Printf("Error running task %v: %v", name, err)
+				taskLog.Errorf("Error running task %v: %v", name, err)
 			}
+			now = time.Now()
+			timer.Reset(nextRun(name, job, sched, now).Sub(now))
 
 		case <-job.configChange:
-			if period != job.period() {
-				period = job.period()
-				if period > 0 {
-					log.Printf("Config change for %v to %v",
-						name, period)
-					job.ticker.Stop()
-					job.ticker = time.NewTicker(period)
-				} else {
-					log.Printf("New period for %v is too short: %v",
-						name, period)
-				}
+			s := job.schedule()
+			switch {
+			case s.String() != sched.String():
+				sched = s
+				log.Printf("Config change for %v to %v", name, sched)
+				checkSchedule(name, sched)
+				resetTimer(timer, nextRun(name, job, sched, time.Now()))
+			case postponed:
+				resetTimer(timer, maintenanceWindow().NextOpen(time.Now()))
 			}
 		}
 	}
@@ -879,11 +1161,19 @@ func launchJobs(m map[string]*periodicJobRecipe,
 	executor func(string, *PeriodicJob, bool) error) {
 
 	for n, recipe := range m {
+		n, recipe := n, recipe
 		inducer := make(chan time.Time, 1)
 		j := &PeriodicJob{
-			period:       recipe.period,
+			period: func() time.Duration {
+				return taskPeriod(n, recipe.period)
+			},
+			basePeriod: recipe.period,
+			schedule: func() cbfsschedule.Schedule {
+				return taskSchedule(n, recipe.period)
+			},
 			f:            recipe.f,
 			excl:         recipe.excl,
+			heavy:        recipe.heavy,
 			configChange: make(chan interface{}),
 		}
 		if _, exists := taskInducers[n]; exists {
@@ -901,6 +1191,7 @@ func runPeriodicJobs() {
 }
 
 func startTasks() {
+	initTaskLeases()
 	cleanNodeTaskMarkers(serverId)
 	// Forget the last time we did local validation. We're
 	// restarting, so things have changed.
@@ -912,7 +1203,7 @@ func startTasks() {
 	// registered.
 	err := induceTask("quickReconcile")
 	if err != nil {
-		log.Printf("Error inducing initial reconciliation: %v", err)
+		taskLog.Errorf("Error inducing initial reconciliation: %v", err)
 	}
 }
 
@@ -933,19 +1224,23 @@ func induceTask(name string) error {
 }
 
 func updateConfig() error {
-	conf, err := RetrieveConfig()
+	cluster, err := currentStoredConfig()
 	if err != nil {
 		return err
 	}
-	confBroadcaster.Submit(configChange{globalConfig, conf})
-	globalConfig = conf
+	conf, err := nodeEffectiveConfig(serverId, cluster)
+	if err != nil {
+		taskLog.Warnf("Ignoring config overrides for this node: %v", err)
+	}
+	confBroadcaster.Submit(configChange{globalConfig, &conf})
+	globalConfig = &conf
 	return nil
 }
 
 func reloadConfig() {
 	for _ = range time.Tick(time.Minute) {
 		if err := updateConfig(); err != nil && !gomemcached.IsNotFound(err) {
-			log.Printf("Error updating config: %v", err)
+			taskLog.Errorf("Error updating config: %v", err)
 		}
 	}
 }
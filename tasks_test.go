@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/schedule"
+)
+
+func TestValidateSchedules(t *testing.T) {
+	tests := []struct {
+		schedules map[string]string
+		window    string
+		ok        bool
+	}{
+		{nil, "", true},
+		{map[string]string{"garbageCollectBlobs": "30 2 * * *",
+			"reconcile": "12h"}, "01:00-05:00", true},
+		{map[string]string{"nonexistent": "1h"}, "", false},
+		{map[string]string{"rebalance": "sometimes"}, "", false},
+		{map[string]string{"reconcile": "0 0 30 2 *"}, "", false},
+		{nil, "late", false},
+	}
+	for _, test := range tests {
+		conf := cbfsconfig.DefaultConfig()
+		conf.Schedules = test.schedules
+		conf.MaintenanceWindow = test.window
+		err := validateSchedules(conf)
+		if (err == nil) != test.ok {
+			t.Errorf("Validating %v/%q: %v", test.schedules, test.window, err)
+		}
+	}
+}
+
+func TestMarkerTTL(t *testing.T) {
+	if got := markerTTL(cbfsschedule.Every(time.Hour)); got != time.Hour {
+		t.Errorf("Expected a periodic marker to last the period, got %v", got)
+	}
+
+	s, err := cbfsschedule.Parse("@hourly")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if got := markerTTL(s); got <= 0 || got >= time.Hour {
+		t.Errorf("Expected an hourly marker gone before the next run, got %v", got)
+	}
+
+	s, err = cbfsschedule.Parse("* * * * *")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if got := markerTTL(s); got < time.Second || got >= time.Minute {
+		t.Errorf("Expected a short marker for a minutely task, got %v", got)
+	}
+}
+
+type neverSchedule struct{}
+
+func (neverSchedule) Next(t time.Time) time.Time { return time.Time{} }
+func (neverSchedule) String() string             { return "never" }
+
+func TestNextRun(t *testing.T) {
+	job := &PeriodicJob{basePeriod: func() time.Duration { return time.Hour }}
+	now := time.Now()
+	if got := nextRun("x", job, cbfsschedule.Every(time.Minute), now); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected a minute from now, got %v", got)
+	}
+	if got := nextRun("x", job, neverSchedule{}, now); !got.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the task's period for a schedule that never fires, got %v", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Internode requests carrying this header are background work
+// (replication, rebalancing, startup fetches) and are subject to
+// the background throttles.
+const backgroundHeader = "X-CBFS-Background"
+
+var (
+	bgSendThrottle = newThrottle(func() int64 {
+		return globalConfig.BackgroundSendRate
+	})
+	bgRecvThrottle = newThrottle(func() int64 {
+		return globalConfig.BackgroundRecvRate
+	})
+)
+
+func init() {
+	expvar.Publish("throttle", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"send": bgSendThrottle.state(),
+			"recv": bgRecvThrottle.state(),
+		}
+	}))
+}
+
+// A token bucket limiting bytes per second.  The rate is looked up on
+// every use so config changes apply immediately.  A rate <= 0 means
+// unlimited.
+type throttle struct {
+	rate  func() int64
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	bytes  int64
+	waited time.Duration
+}
+
+func newThrottle(rate func() int64) *throttle {
+	return &throttle{rate: rate, now: time.Now, sleep: time.Sleep}
+}
+
+// Account for n bytes, blocking until the bucket allows them.
+func (t *throttle) wait(n int) {
+	rate := t.rate()
+
+	t.mu.Lock()
+	t.bytes += int64(n)
+	if rate <= 0 {
+		t.last = time.Time{}
+		t.mu.Unlock()
+		return
+	}
+
+	now := t.now()
+	if !t.last.IsZero() {
+		t.tokens += now.Sub(t.last).Seconds() * float64(rate)
+	}
+	t.last = now
+
+	// Allow at most a second's worth of burst.
+	if t.tokens > float64(rate) {
+		t.tokens = float64(rate)
+	}
+
+	// Going into debt makes later callers wait their turn.
+	t.tokens -= float64(n)
+	d := time.Duration(0)
+	if t.tokens < 0 {
+		d = time.Duration(-t.tokens / float64(rate) * float64(time.Second))
+		t.waited += d
+	}
+	t.mu.Unlock()
+
+	if d > 0 {
+		t.sleep(d)
+	}
+}
+
+func (t *throttle) state() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return map[string]interface{}{
+		"rate":      t.rate(),
+		"bytes":     t.bytes,
+		"waited_ms": int64(t.waited / time.Millisecond),
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.t.wait(n)
+	}
+	return n, err
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	t *throttle
+}
+
+func (w *throttledResponseWriter) Write(b []byte) (int, error) {
+	w.t.wait(len(b))
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	rate := int64(0)
+	now := time.Unix(1000, 0)
+	slept := time.Duration(0)
+
+	th := newThrottle(func() int64 { return rate })
+	th.now = func() time.Time { return now }
+	th.sleep = func(d time.Duration) { slept += d }
+
+	th.wait(1 << 20)
+	if slept != 0 {
+		t.Fatalf("Expected no waiting while unlimited, slept %v", slept)
+	}
+
+	rate = 1000
+
+	th.wait(500)
+	if slept != 500*time.Millisecond {
+		t.Fatalf("Expected to sleep 500ms, slept %v", slept)
+	}
+
+	// Still in debt, the next caller waits behind the first.
+	th.wait(500)
+	if slept != 1500*time.Millisecond {
+		t.Fatalf("Expected to sleep 1.5s total, slept %v", slept)
+	}
+
+	// Plenty of idle time refills no more than a second's worth.
+	slept = 0
+	now = now.Add(time.Hour)
+	th.wait(1000)
+	if slept != 0 {
+		t.Fatalf("Expected burst to be free, slept %v", slept)
+	}
+	th.wait(1000)
+	if slept != time.Second {
+		t.Fatalf("Expected to sleep 1s after burst, slept %v", slept)
+	}
+
+	st := th.state()
+	if st["bytes"].(int64) != 1<<20+3000 {
+		t.Errorf("Expected byte count to include everything: %v", st)
+	}
+}
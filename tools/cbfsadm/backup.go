@@ -17,12 +17,19 @@ import (
 
 var backupFlags = flag.NewFlagSet("backup", flag.ExitOnError)
 var backupWait = backupFlags.Bool("w", false, "Wait for backup to complete")
+var backupIncr = backupFlags.Bool("i", false,
+	"Only back up changes since the latest backup")
+var backupBase = backupFlags.String("base", "",
+	"Only back up changes since this backup")
+var backupTarget = backupFlags.String("target", "",
+	"Also copy file contents to this directory or cbfs URL")
 
 type Backup struct {
 	Filename string
 	OID      string
 	When     time.Time
 	Conf     cbfsconfig.CBFSConfig
+	Base     string
 }
 
 func backupCommand(ustr string, args []string) {
@@ -33,8 +40,11 @@ func backupCommand(ustr string, args []string) {
 	u.Path = "/.cbfs/backup/"
 
 	form := url.Values{
-		"fn": []string{fn},
-		"bg": []string{strconv.FormatBool(*backupWait == false)},
+		"fn":          []string{fn},
+		"bg":          []string{strconv.FormatBool(*backupWait == false)},
+		"incremental": []string{strconv.FormatBool(*backupIncr)},
+		"base":        []string{*backupBase},
+		"target":      []string{*backupTarget},
 	}
 
 	start := time.Now()
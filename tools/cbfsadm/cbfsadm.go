@@ -7,13 +7,22 @@ import (
 func main() {
 	cbfstool.ToolMain(
 		map[string]cbfstool.Command{
-			"getconf": {0, getConfCommand, "", nil},
-			"setconf": {2, setConfCommand, "prop value", nil},
-			"fsck":    {0, fsckCommand, "", fsckFlags},
-			"backup":  {1, backupCommand, "filename", backupFlags},
-			"rmbak":   {0, rmBakCommand, "", rmbakFlags},
-			"restore": {1, restoreCommand, "filename", restoreFlags},
-			"induce":  {0, induceCommand, "taskname", induceFlags},
-			"lsbak":   {0, lsBakCommand, "", nil},
+			"config": {-1, configCommand,
+				"history|rollback version|schema|node name [set param value|unset param]",
+				configFlags},
+			"getconf":   {0, getConfCommand, "", nil},
+			"health":    {0, healthCommand, "", healthFlags},
+			"setconf":   {2, setConfCommand, "prop value", nil},
+			"fsck":      {0, fsckCommand, "", fsckFlags},
+			"gc":        {0, gcCommand, "", gcFlags},
+			"backup":    {1, backupCommand, "filename", backupFlags},
+			"rmbak":     {0, rmBakCommand, "", rmbakFlags},
+			"restore":   {-1, restoreCommand, "filename [increment...]", restoreFlags},
+			"induce":    {0, induceCommand, "taskname", induceFlags},
+			"lsbak":     {0, lsBakCommand, "", nil},
+			"verifybak": {1, verifyBakCommand, "filename", verifybakFlags},
+			"queue":     {0, queueCommand, "", queueFlags},
+			"task":      {-1, taskCommand, "cancel taskname|history [taskname]", taskFlags},
+			"tasks":     {-1, taskCommand, "cancel taskname|history [taskname]", taskFlags},
 		})
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/config"
 	"github.com/couchbaselabs/cbfs/tools"
 )
 
@@ -24,3 +32,190 @@ func setConfCommand(u string, args []string) {
 	err := getClient(u).SetConfigParam(key, val)
 	cbfstool.MaybeFatal(err, "Error setting config: %v", err)
 }
+
+var configFlags = flag.NewFlagSet("config", flag.ExitOnError)
+var configLimit = configFlags.Int("limit", 20, "config changes to show")
+
+type configRevision struct {
+	Version int       `json:"version"`
+	When    time.Time `json:"when"`
+	Who     string    `json:"who"`
+	From    string    `json:"from"`
+	Note    string    `json:"note"`
+	Changes []struct {
+		Field string      `json:"field"`
+		Old   interface{} `json:"old"`
+		New   interface{} `json:"new"`
+	} `json:"changes"`
+	Config    *cbfsconfig.CBFSConfig `json:"config"`
+	Node      string                 `json:"node"`
+	Overrides map[string]interface{} `json:"overrides"`
+}
+
+func getConfigHistory(ustr string) []configRevision {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/config/history"
+
+	h := struct {
+		Revisions []configRevision `json:"revisions"`
+	}{}
+	err := cbfstool.GetJsonData(u.String(), &h)
+	cbfstool.MaybeFatal(err, "Error getting config history: %v", err)
+	return h.Revisions
+}
+
+func showConfigHistory(ustr string) {
+	revs := getConfigHistory(ustr)
+	if len(revs) > *configLimit {
+		revs = revs[len(revs)-*configLimit:]
+	}
+	for i := len(revs) - 1; i >= 0; i-- {
+		r := revs[i]
+		fmt.Printf("#%v %v by %v from %v", r.Version,
+			r.When.Local().Format(time.Stamp), r.Who, r.From)
+		if r.Node != "" {
+			fmt.Printf(" for node %v", r.Node)
+		}
+		if r.Note != "" {
+			fmt.Printf(" (%v)", r.Note)
+		}
+		fmt.Printf("\n")
+		for _, c := range r.Changes {
+			fmt.Printf("    %v: %v -> %v\n", c.Field, c.Old, c.New)
+		}
+	}
+}
+
+func rollbackConfig(ustr, vstr string) {
+	v, err := strconv.Atoi(vstr)
+	cbfstool.MaybeFatal(err, "Invalid version %q", vstr)
+
+	for _, r := range getConfigHistory(ustr) {
+		if r.Version != v {
+			continue
+		}
+		note := fmt.Sprintf("rollback to #%v", v)
+		switch {
+		case r.Node != "":
+			if r.Overrides == nil {
+				// Back to no overrides at all.
+				r.Overrides = map[string]interface{}{}
+			}
+			err = getClient(ustr).SetNodeConfig(r.Node, r.Overrides, note)
+		case r.Config != nil:
+			err = getClient(ustr).SetConfig(*r.Config, note)
+		default:
+			log.Fatalf("Config version %v can't be rolled back to", v)
+		}
+		cbfstool.MaybeFatal(err, "Error rolling back config: %v", err)
+		return
+	}
+	log.Fatalf("No config version %v in the history", v)
+}
+
+func showConfigSchema(ustr string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/config/schema"
+
+	fields := []struct {
+		Name    string      `json:"name"`
+		Type    string      `json:"type"`
+		Default interface{} `json:"default"`
+		Doc     string      `json:"doc"`
+	}{}
+	err := cbfstool.GetJsonData(u.String(), &fields)
+	cbfstool.MaybeFatal(err, "Error getting config schema: %v", err)
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, f := range fields {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", f.Name, f.Type, f.Default, f.Doc)
+	}
+	tw.Flush()
+}
+
+func showNodeConfig(ustr, node string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/config/effective"
+	u.RawQuery = url.Values{"node": {node}}.Encode()
+	// Ask the node itself, if it's up, so its flags are included.
+	if nodes, err := getClient(ustr).Nodes(); err == nil {
+		if n, ok := nodes[node]; ok {
+			u = cbfstool.ParseURL(n.URLFor("/.cbfs/config/effective"))
+		}
+	}
+
+	res := struct {
+		Params []struct {
+			Name   string      `json:"name"`
+			Value  interface{} `json:"value"`
+			Source string      `json:"source"`
+		} `json:"params"`
+		Flags []struct {
+			Name   string      `json:"name"`
+			Value  interface{} `json:"value"`
+			Source string      `json:"source"`
+		} `json:"flags"`
+		Error string `json:"error"`
+	}{}
+	err := cbfstool.GetJsonData(u.String(), &res)
+	cbfstool.MaybeFatal(err, "Error getting config of %v: %v", node, err)
+
+	if res.Error != "" {
+		fmt.Printf("Overrides are being ignored: %v\n\n", res.Error)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, p := range res.Params {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", p.Name, p.Value, p.Source)
+	}
+	for _, f := range res.Flags {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", f.Name, f.Value, f.Source)
+	}
+	tw.Flush()
+}
+
+func setNodeConfig(ustr, node string, args []string) {
+	c := getClient(ustr)
+	overrides, err := c.GetNodeConfig(node)
+	cbfstool.MaybeFatal(err, "Error getting overrides of %v: %v", node, err)
+	if overrides == nil {
+		overrides = map[string]interface{}{}
+	}
+
+	switch {
+	case len(args) == 3 && args[0] == "set":
+		overrides[args[1]] = args[2]
+	case len(args) == 2 && args[0] == "unset":
+		delete(overrides, args[1])
+	default:
+		log.Fatalf("Expected set param value or unset param, got %q", args)
+	}
+
+	err = c.SetNodeConfig(node, overrides, "")
+	cbfstool.MaybeFatal(err, "Error setting overrides of %v: %v", node, err)
+}
+
+func configCommand(ustr string, args []string) {
+	switch configFlags.Arg(0) {
+	case "history":
+		showConfigHistory(ustr)
+	case "rollback":
+		if configFlags.NArg() < 2 {
+			log.Fatalf("Which version should the config go back to?")
+		}
+		rollbackConfig(ustr, configFlags.Arg(1))
+	case "schema":
+		showConfigSchema(ustr)
+	case "node":
+		if configFlags.NArg() < 2 {
+			log.Fatalf("Which node?")
+		}
+		node := configFlags.Arg(1)
+		if configFlags.NArg() == 2 {
+			showNodeConfig(ustr, node)
+		} else {
+			setNodeConfig(ustr, node, configFlags.Args()[2:])
+		}
+	default:
+		log.Fatalf("Unknown config subcommand: %q", configFlags.Arg(0))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+)
+
+var gcFlags = flag.NewFlagSet("gc", flag.ExitOnError)
+var gcOut = gcFlags.String("o", "", "write the report here instead of stdout")
+
+// Download what garbage collection would do without doing it.
+func gcCommand(ustr string, args []string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/gc/report/"
+
+	res, err := http.Get(u.String())
+	cbfstool.MaybeFatal(err, "Error getting gc report: %v", err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		cbfstool.MaybeFatal(httputil.HTTPError(res),
+			"Error getting gc report: %v", res.Status)
+	}
+
+	var out io.Writer = os.Stdout
+	if *gcOut != "" {
+		f, err := os.Create(*gcOut)
+		cbfstool.MaybeFatal(err, "Error creating %v: %v", *gcOut, err)
+		defer f.Close()
+		out = f
+	}
+
+	counts := map[string]int{}
+	bytes := int64(0)
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		_, err := out.Write(append(s.Bytes(), '\n'))
+		cbfstool.MaybeFatal(err, "Error writing report: %v", err)
+
+		e := struct {
+			Length int64
+			Action string
+			Error  string
+		}{}
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			log.Fatalf("Error decoding report: %v", err)
+		}
+		if e.Error != "" {
+			log.Fatalf("Report is incomplete: %v", e.Error)
+		}
+		counts[e.Action]++
+		if e.Action == "delete" {
+			bytes += e.Length
+		}
+	}
+	cbfstool.MaybeFatal(s.Err(), "Error reading report: %v", s.Err())
+
+	log.Printf("Would delete %v blob copies (%v), mark %v, keep %v",
+		counts["delete"], humanize.Bytes(uint64(bytes)),
+		counts["mark"], counts["keep"])
+}
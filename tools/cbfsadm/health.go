@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var healthFlags = flag.NewFlagSet("health", flag.ExitOnError)
+var healthJSON = healthFlags.Bool("json", false, "print the raw report")
+
+type clusterHealth struct {
+	Verdict string   `json:"verdict"`
+	Reasons []string `json:"reasons"`
+	Nodes   []struct {
+		Name       string        `json:"name"`
+		Addr       string        `json:"addr"`
+		Alive      bool          `json:"alive"`
+		Leaving    bool          `json:"leaving"`
+		HBAge      time.Duration `json:"hbage"`
+		ClockDrift time.Duration `json:"clockDrift"`
+		Free       int64         `json:"free"`
+	} `json:"nodes"`
+	Replicas struct {
+		Lost  int64 `json:"lost"`
+		Under int64 `json:"under"`
+		Over  int64 `json:"over"`
+		Total int64 `json:"total"`
+	} `json:"replicas"`
+	Garbage struct {
+		Blobs int64 `json:"blobs"`
+		Bytes int64 `json:"bytes"`
+	} `json:"garbage"`
+	StaleLocks []struct {
+		Task   string    `json:"task"`
+		Node   string    `json:"node"`
+		Since  time.Time `json:"since"`
+		Reason string    `json:"reason"`
+	} `json:"staleLocks"`
+	Backup struct {
+		Latest     string    `json:"latest"`
+		When       time.Time `json:"when"`
+		AgeSeconds int64     `json:"ageSeconds"`
+		Stale      bool      `json:"stale"`
+	} `json:"backup"`
+	Errors []string `json:"errors"`
+}
+
+// Summarize cluster health.  Exits non-zero when the cluster is red.
+func healthCommand(ustr string, args []string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/health/"
+
+	h := clusterHealth{}
+	err := cbfstool.GetJsonData(u.String(), &h)
+	cbfstool.MaybeFatal(err, "Error getting cluster health: %v", err)
+
+	if *healthJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(h)
+	} else {
+		printHealth(h)
+	}
+
+	if h.Verdict == "red" {
+		os.Exit(1)
+	}
+}
+
+func printHealth(h clusterHealth) {
+	fmt.Printf("Cluster is %v\n", h.Verdict)
+	for _, r := range h.Reasons {
+		fmt.Printf("  * %v\n", r)
+	}
+
+	fmt.Printf("\nNodes:\n")
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, n := range h.Nodes {
+		state := "up"
+		switch {
+		case n.Leaving:
+			state = "leaving"
+		case !n.Alive:
+			state = "down"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\theartbeat %v ago\t%s free\tclock off %v\n",
+			n.Name, n.Addr, state, n.HBAge.Truncate(time.Second),
+			humanize.Bytes(uint64(n.Free)), n.ClockDrift)
+	}
+	tw.Flush()
+
+	r := h.Replicas
+	fmt.Printf("\nBlobs: %v total, %v under-replicated (%v with no copies), "+
+		"%v over-replicated\n", humanize.Comma(r.Total), humanize.Comma(r.Under),
+		humanize.Comma(r.Lost), humanize.Comma(r.Over))
+	fmt.Printf("Garbage: %v blobs, %v\n", humanize.Comma(h.Garbage.Blobs),
+		humanize.Bytes(uint64(h.Garbage.Bytes)))
+
+	if h.Backup.Latest == "" {
+		fmt.Printf("Backup: none\n")
+	} else {
+		fmt.Printf("Backup: %v, %v old\n", h.Backup.Latest,
+			time.Duration(h.Backup.AgeSeconds)*time.Second)
+	}
+
+	if len(h.StaleLocks) > 0 {
+		fmt.Printf("\nStale task locks:\n")
+		for _, l := range h.StaleLocks {
+			fmt.Fprintf(tw, "  %s\t%s\t%v\t%s\n", l.Task, l.Node, l.Since, l.Reason)
+		}
+		tw.Flush()
+	}
+
+	if len(h.Errors) > 0 {
+		fmt.Printf("\nCouldn't check:\n")
+		for _, e := range h.Errors {
+			fmt.Printf("  * %v\n", e)
+		}
+	}
+}
@@ -15,12 +15,13 @@ import (
 const tasksTmplText = `Which task would you like to induce?
 
 Global Tasks:
-{{range $k, $v := .Global}}   - {{$k}}
+{{range $k, $v := .Global}}   - {{$k}} ({{$v.Schedule}}{{if $v.Heavy}}, heavy{{end}})
 {{end}}
 Local Tasks:
-{{range $k, $v := .Local}}   - {{$k}}
-{{end}}
-`
+{{range $k, $v := .Local}}   - {{$k}} ({{$v.Schedule}}{{if $v.Heavy}}, heavy{{end}})
+{{end}}{{if .MaintenanceWindow}}
+Heavy tasks start between {{.MaintenanceWindow}} UTC.
+{{end}}`
 
 var tasksTmpl = template.Must(template.New("").Parse(tasksTmplText))
 
@@ -66,10 +67,15 @@ func listTasks(ustr string) {
 	u := cbfstool.ParseURL(ustr)
 	u.Path = "/.cbfs/tasks/info/"
 
+	type taskInfo struct {
+		Schedule string `json:"schedule"`
+		Heavy    bool   `json:"heavy"`
+	}
 	d := struct {
-		Global map[string][]string `json:"global"`
-		Local  map[string][]string `json:"local"`
-	}{make(map[string][]string), make(map[string][]string)}
+		Global            map[string]taskInfo `json:"global"`
+		Local             map[string]taskInfo `json:"local"`
+		MaintenanceWindow string              `json:"maintenanceWindow"`
+	}{}
 
 	err := cbfstool.GetJsonData(u.String(), &d)
 	cbfstool.MaybeFatal(err, "Error getting task info: %v", err)
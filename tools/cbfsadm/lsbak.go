@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"text/tabwriter"
+	"time"
 
 	"github.com/couchbaselabs/cbfs/tools"
 )
@@ -13,14 +15,26 @@ func lsBakCommand(ustr string, args []string) {
 	u.Path = "/.cbfs/backup/"
 
 	backups := struct {
-		Previous []Backup `json:"backups"`
+		Previous   []Backup `json:"backups"`
+		AgeSeconds int64    `json:"latestAgeSeconds"`
+		Stale      bool     `json:"stale"`
 	}{}
 	err := cbfstool.GetJsonData(u.String(), &backups)
 	cbfstool.MaybeFatal(err, "Error getting backup info: %v", err)
 
 	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
 	for _, b := range backups.Previous {
-		fmt.Fprintf(tw, "%s\t%v\n", b.Filename, b.When)
+		if b.Base == "" {
+			fmt.Fprintf(tw, "%s\t%v\tfull\n", b.Filename, b.When)
+		} else {
+			fmt.Fprintf(tw, "%s\t%v\tincrement of %s\n",
+				b.Filename, b.When, b.Base)
+		}
 	}
 	tw.Flush()
+
+	if backups.Stale {
+		log.Printf("Warning: the latest backup is %v old",
+			time.Duration(backups.AgeSeconds)*time.Second)
+	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var queueFlags = flag.NewFlagSet("queue", flag.ExitOnError)
+var queuePurge = queueFlags.Bool("purge", false, "purge pending tasks")
+var queueNode = queueFlags.String("node", "", "only purge tasks for this node")
+var queueCmd = queueFlags.String("cmd", "",
+	"only purge this kind of task (remove, acquire, fetch)")
+var queueOID = queueFlags.String("oid", "", "only purge tasks for this blob")
+var queueLimit = queueFlags.Int("limit", 20, "pending tasks to show")
+
+type queueItem struct {
+	Node      string    `json:"node"`
+	Cmd       string    `json:"cmd"`
+	OID       string    `json:"oid"`
+	Prev      string    `json:"prev"`
+	Attempts  int       `json:"attempts"`
+	Queued    time.Time `json:"queued"`
+	NotBefore time.Time `json:"notBefore"`
+	Error     string    `json:"error"`
+	Failed    time.Time `json:"failed"`
+}
+
+func printQueueItems(title string, items []queueItem) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Printf("\n%v:\n", title)
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, i := range items {
+		node := i.Node
+		if node == "" {
+			node = "(local)"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%d\t%s\n",
+			i.Cmd, i.OID, node, i.Attempts, i.Error)
+	}
+	tw.Flush()
+}
+
+func showQueue(ustr string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/queue/"
+	u.RawQuery = url.Values{"limit": {fmt.Sprint(*queueLimit)}}.Encode()
+
+	st := struct {
+		Depth    int
+		Capacity int
+		Rejected int64
+		InFlight []queueItem
+		Pending  []queueItem
+		Failures []queueItem
+	}{}
+
+	err := cbfstool.GetJsonData(u.String(), &st)
+	cbfstool.MaybeFatal(err, "Error getting task queue: %v", err)
+
+	fmt.Printf("Depth: %v/%v, in flight: %v, rejected: %v\n",
+		st.Depth, st.Capacity, len(st.InFlight), st.Rejected)
+	printQueueItems("In flight", st.InFlight)
+	printQueueItems("Pending", st.Pending)
+	printQueueItems("Recent failures", st.Failures)
+}
+
+func purgeQueue(ustr string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/queue/"
+	u.RawQuery = url.Values{
+		"node": {*queueNode},
+		"cmd":  {*queueCmd},
+		"oid":  {*queueOID},
+	}.Encode()
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	cbfstool.MaybeFatal(err, "Error creating request: %v", err)
+
+	res, err := http.DefaultClient.Do(req)
+	cbfstool.MaybeFatal(err, "Error purging task queue: %v", err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		cbfstool.MaybeFatal(httputil.HTTPError(res),
+			"Error purging task queue: %v", res.Status)
+	}
+
+	rv := struct{ Purged int }{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	cbfstool.MaybeFatal(err, "Error decoding response: %v", err)
+	fmt.Printf("Purged %v tasks\n", rv.Purged)
+}
+
+func queueCommand(ustr string, args []string) {
+	if *queuePurge {
+		purgeQueue(ustr)
+	} else {
+		showQueue(ustr)
+	}
+}
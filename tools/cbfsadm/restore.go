@@ -9,8 +9,10 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,13 +30,99 @@ var restorePat = restoreFlags.String("match", ".*", "Regex for paths to match")
 var restoreWorkers = restoreFlags.Int("workers", 4, "Number of restore workers")
 var restoreExpire = restoreFlags.Int("expire", -1,
 	"Override expiration time (in seconds, or abs unix time)")
+var restoreRemote = restoreFlags.Bool("remote", false,
+	"Restore a backup stored in the cluster along with the backups it builds on")
+var restoreTarget = restoreFlags.String("target", "",
+	"Restore a data backup (contents included) from this directory or cbfs URL")
+var restorePrefix = restoreFlags.String("prefix", "",
+	"Restore under this path prefix instead of the original paths")
+var restoreBefore = restoreFlags.String("before", "",
+	"Only restore files modified before this time (RFC3339)")
+var restoreAfter = restoreFlags.String("after", "",
+	"Only restore files modified after this time (RFC3339)")
+var restoreRevno = restoreFlags.Int("revno", 0,
+	"Make this revision of each file current (0 for the latest)")
+var restoreConflict = restoreFlags.String("conflict", "skip",
+	"What to do with files that already exist: skip, overwrite or rename"+
+		" (increments replace older files either way)")
+
+// Parsed -before and -after
+var restoreBeforeT, restoreAfterT time.Time
 
 type restoreWorkItem struct {
-	Path string
-	Meta *json.RawMessage
+	Path    string
+	Meta    *json.RawMessage
+	Deleted string
+	// Increments replace older files
+	Newer bool
+}
+
+// Where a backed up path is restored to.
+func restoreDest(path string) string {
+	if *restorePrefix == "" {
+		return path
+	}
+	return strings.TrimSuffix(*restorePrefix, "/") + "/" +
+		strings.TrimLeft(path, "/")
+}
+
+// Whether an item changed within -before and -after.
+func restoreInRange(ob restoreWorkItem) (bool, error) {
+	if restoreBeforeT.IsZero() && restoreAfterT.IsZero() {
+		return true, nil
+	}
+	var t time.Time
+	if ob.Deleted != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, ob.Deleted)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		m := struct{ Modified time.Time }{}
+		if ob.Meta != nil {
+			if err := json.Unmarshal(*ob.Meta, &m); err != nil {
+				return false, err
+			}
+		}
+		t = m.Modified
+	}
+	return (restoreBeforeT.IsZero() || t.Before(restoreBeforeT)) &&
+		(restoreAfterT.IsZero() || t.After(restoreAfterT)), nil
+}
+
+func restoreDeletion(base, path, when string) error {
+	if *restoreNoop {
+		log.Printf("NOOP would delete %v", path)
+		return nil
+	}
+
+	u := cbfstool.ParseURL(base)
+	u.Path = fmt.Sprintf("/.cbfs/backup/restore/%v", path)
+	u.RawQuery = url.Values{"deleted": {when}}.Encode()
+
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case 204:
+		cbfstool.Verbose(*restoreVerbose, "Deleted %v", path)
+	case 409:
+		// Recreated since
+	default:
+		return httputil.HTTPErrorf(res, "restore error deleting %v - %S\n%B", path)
+	}
+	return nil
 }
 
-func restoreFile(base, path string, data interface{}) error {
+func restoreFile(base, path string, data interface{}, newer bool) error {
 	if *restoreNoop {
 		log.Printf("NOOP would restore %v", path)
 		return nil
@@ -47,6 +135,14 @@ func restoreFile(base, path string, data interface{}) error {
 
 	u := cbfstool.ParseURL(base)
 	u.Path = fmt.Sprintf("/.cbfs/backup/restore/%v", path)
+	params := url.Values{"conflict": {*restoreConflict}}
+	if newer {
+		params.Set("newer", "true")
+	}
+	if *restoreRevno > 0 {
+		params.Set("revno", strconv.Itoa(*restoreRevno))
+	}
+	u.RawQuery = params.Encode()
 
 	req, err := http.NewRequest("POST", u.String(),
 		bytes.NewReader(fileMetaBytes))
@@ -63,10 +159,13 @@ func restoreFile(base, path string, data interface{}) error {
 	defer res.Body.Close()
 	switch {
 	case res.StatusCode == 201:
-		log.Printf("Restored %v", path)
-		// OK
-	case res.StatusCode == 409 && !*restoreForce:
-		// OK
+		if as := res.Header.Get("X-CBFS-Restored-As"); as != "" {
+			log.Printf("Restored %v as %v", path, as)
+		} else {
+			log.Printf("Restored %v", path)
+		}
+	case res.StatusCode == 409:
+		cbfstool.Verbose(*restoreVerbose, "Skipped existing %v", path)
 	default:
 		return httputil.HTTPErrorf(res, "restore error on %v - %Sv\n%B", path)
 	}
@@ -77,7 +176,12 @@ func restoreFile(base, path string, data interface{}) error {
 func restoreWorker(wg *sync.WaitGroup, base string, ch <-chan restoreWorkItem) {
 	defer wg.Done()
 	for ob := range ch {
-		err := restoreFile(base, ob.Path, ob.Meta)
+		var err error
+		if ob.Deleted != "" {
+			err = restoreDeletion(base, restoreDest(ob.Path), ob.Deleted)
+		} else {
+			err = restoreFile(base, restoreDest(ob.Path), ob.Meta, ob.Newer)
+		}
 		if err != nil {
 			log.Printf("Error restoring %v: %v",
 				ob.Path, err)
@@ -85,17 +189,56 @@ func restoreWorker(wg *sync.WaitGroup, base string, ch <-chan restoreWorkItem) {
 	}
 }
 
-func restoreCommand(ustr string, args []string) {
-	regex, err := regexp.Compile(*restorePat)
-	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+// Find the backups the named one builds on, oldest first.
+func backupChain(ustr, fn string) []string {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/"
 
-	fn := restoreFlags.Arg(0)
+	data := struct{ Backups []Backup }{}
+	err := cbfstool.GetJsonData(u.String(), &data)
+	cbfstool.MaybeFatal(err, "Error getting backup data: %v", err)
 
-	start := time.Now()
+	byName := map[string]Backup{}
+	for _, b := range data.Backups {
+		byName[b.Filename] = b
+	}
+
+	chain := []string{}
+	for fn != "" {
+		b, ok := byName[fn]
+		if !ok {
+			log.Fatalf("Backup %v is not known to the cluster", fn)
+		}
+		for _, seen := range chain {
+			if seen == fn {
+				log.Fatalf("Backup %v builds on itself", fn)
+			}
+		}
+		chain = append([]string{fn}, chain...)
+		fn = b.Base
+	}
+	return chain
+}
 
-	f, err := os.Open(fn)
-	cbfstool.MaybeFatal(err, "Error opening restore file: %v", err)
+func openBackup(ustr, fn string) io.ReadCloser {
+	if !*restoreRemote {
+		f, err := os.Open(fn)
+		cbfstool.MaybeFatal(err, "Error opening restore file: %v", err)
+		return f
+	}
 
+	res, err := http.Get(relativeUrl(ustr, fn))
+	cbfstool.MaybeFatal(err, "Error fetching %v: %v", fn, err)
+	if res.StatusCode != 200 {
+		log.Fatalf("Error fetching %v: %v", fn, res.Status)
+	}
+	return res.Body
+}
+
+// Restore one backup file.  Increments replace older files and
+// apply deletions.
+func restoreOne(ustr, fn string, increment bool, regex *regexp.Regexp) int {
+	f := openBackup(ustr, fn)
 	defer f.Close()
 	gz, err := gzip.NewReader(f)
 	cbfstool.MaybeFatal(err, "Error uncompressing restore file: %v", err)
@@ -117,8 +260,14 @@ func restoreCommand(ustr string, args []string) {
 		err := d.Decode(&ob)
 		switch err {
 		case nil:
-			if regex.MatchString(ob.Path) {
+			in, err := restoreInRange(ob)
+			if err != nil {
+				log.Printf("Error reading time of %v: %v", ob.Path, err)
+				continue
+			}
+			if in && regex.MatchString(ob.Path) {
 				nfiles++
+				ob.Newer = increment
 				ch <- ob
 			}
 		case io.EOF:
@@ -131,5 +280,95 @@ func restoreCommand(ustr string, args []string) {
 	close(ch)
 	wg.Wait()
 
+	return nfiles
+}
+
+// Have the cluster bring back a data backup, blobs first.
+func restoreData(ustr, fn string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/data/restore/"
+
+	form := url.Values{
+		"fn":     {fn},
+		"target": {*restoreTarget},
+	}
+
+	start := time.Now()
+	res, err := http.PostForm(u.String(), form)
+	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		log.Fatalf("%v", httputil.HTTPErrorf(res, "restore error - %S\n%B"))
+	}
+
+	result := struct {
+		Backups       []string
+		BlobsRestored int
+		Files         int
+		Deletions     int
+		Skipped       int
+		Errors        int
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	cbfstool.MaybeFatal(err, "Error decoding restore result: %v", err)
+
+	log.Printf("Restored %v blobs, %v files and %v deletions from %v in %v",
+		result.BlobsRestored, result.Files, result.Deletions,
+		result.Backups, time.Since(start))
+	if result.Skipped > 0 || result.Errors > 0 {
+		log.Printf("Skipped %v existing files, %v errors",
+			result.Skipped, result.Errors)
+	}
+}
+
+func restoreCommand(ustr string, args []string) {
+	regex, err := regexp.Compile(*restorePat)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	if *restoreForce {
+		*restoreConflict = "overwrite"
+	}
+	switch *restoreConflict {
+	case "skip", "overwrite", "rename":
+	default:
+		log.Fatalf("Unknown conflict policy: %v", *restoreConflict)
+	}
+	if *restoreBefore != "" {
+		restoreBeforeT, err = time.Parse(time.RFC3339, *restoreBefore)
+		cbfstool.MaybeFatal(err, "Error parsing -before: %v", err)
+	}
+	if *restoreAfter != "" {
+		restoreAfterT, err = time.Parse(time.RFC3339, *restoreAfter)
+		cbfstool.MaybeFatal(err, "Error parsing -after: %v", err)
+	}
+
+	files := restoreFlags.Args()
+	if *restoreTarget != "" {
+		if len(files) != 1 {
+			log.Fatalf("Which backup should be restored?")
+		}
+		if *restorePrefix != "" || *restoreRevno > 0 ||
+			*restoreBefore != "" || *restoreAfter != "" {
+			log.Fatalf("-target restores everything as it was backed up")
+		}
+		restoreData(ustr, files[0])
+		return
+	}
+	if *restoreRemote {
+		if len(files) != 1 {
+			log.Fatalf("Which backup should be restored?")
+		}
+		files = backupChain(ustr, files[0])
+	}
+
+	start := time.Now()
+
+	nfiles := 0
+	for i, fn := range files {
+		n := restoreOne(ustr, fn, i > 0, regex)
+		log.Printf("Restored %v entries from %v", n, fn)
+		nfiles += n
+	}
+
 	log.Printf("Restored %v files in %v", nfiles, time.Since(start))
 }
@@ -74,6 +74,31 @@ func rmBakWorker() {
 	}
 }
 
+// Drop anything a kept backup builds on from the removal list.
+func keepBases(torm, kept backups) backups {
+	needed := map[string]bool{}
+	byName := map[string]Backup{}
+	for _, b := range torm {
+		byName[b.Filename] = b
+	}
+	for _, b := range kept {
+		for base := b.Base; base != "" && !needed[base]; base = byName[base].Base {
+			needed[base] = true
+		}
+	}
+
+	rv := backups{}
+	for _, b := range torm {
+		if needed[b.Filename] {
+			cbfstool.Verbose(*rmbakVerbose, "Keeping %v, a later backup needs it",
+				b.Filename)
+		} else {
+			rv = append(rv, b)
+		}
+	}
+	return rv
+}
+
 func rmBakCommand(ustr string, args []string) {
 	u := cbfstool.ParseURL(ustr)
 	u.Path = "/.cbfs/backup/"
@@ -90,7 +115,8 @@ func rmBakCommand(ustr string, args []string) {
 		return
 	}
 
-	torm := data.Backups[:len(data.Backups)-*rmbakKeep]
+	torm := keepBases(data.Backups[:len(data.Backups)-*rmbakKeep],
+		data.Backups[len(data.Backups)-*rmbakKeep:])
 	cbfstool.Verbose(*rmbakVerbose, "Removing %v backups, keeping %v",
 		len(torm), len(data.Backups)-len(torm))
 
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var taskFlags = flag.NewFlagSet("task", flag.ExitOnError)
+var taskAll = taskFlags.Bool("all", false, "cancel on all nodes")
+var taskNode = taskFlags.String("node", "", "only show history from this node")
+var taskLimit = taskFlags.Int("limit", 20, "task runs to show")
+
+type taskRun struct {
+	Task    string    `json:"task"`
+	Node    string    `json:"node"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error"`
+	Summary string    `json:"summary"`
+}
+
+func cancelTask(ustr, taskname string) error {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/cancel/" + taskname
+
+	res, err := http.PostForm(u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return httputil.HTTPError(res)
+	}
+	return nil
+}
+
+func cancelTaskAll(base, taskname string) {
+	c, err := cbfsclient.New(base)
+	cbfstool.MaybeFatal(err, "Error getting client: %v", err)
+
+	nodes, err := c.Nodes()
+	cbfstool.MaybeFatal(err, "Error getting nodes: %v", err)
+
+	canceled := 0
+	for name, n := range nodes {
+		if err := cancelTask(n.URLFor("/"), taskname); err != nil {
+			log.Printf("Not canceled on %v: %v", name, err)
+		} else {
+			canceled++
+		}
+	}
+	log.Printf("Canceled %v on %v nodes", taskname, canceled)
+}
+
+func showTaskHistory(ustr, taskname string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/tasks/history/"
+	u.RawQuery = url.Values{
+		"task":  {taskname},
+		"node":  {*taskNode},
+		"limit": {fmt.Sprint(*taskLimit)},
+	}.Encode()
+
+	runs := []taskRun{}
+	err := cbfstool.GetJsonData(u.String(), &runs)
+	cbfstool.MaybeFatal(err, "Error getting task history: %v", err)
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	for _, r := range runs {
+		detail := r.Summary
+		if r.Error != "" {
+			detail = r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\t%s\n",
+			r.Started.Local().Format(time.Stamp), r.Task, r.Node,
+			r.Ended.Sub(r.Started), r.Outcome, detail)
+	}
+	tw.Flush()
+}
+
+func taskCommand(ustr string, args []string) {
+	switch taskFlags.Arg(0) {
+	case "cancel":
+		if taskFlags.NArg() < 2 {
+			log.Fatalf("Which task should be canceled?")
+		}
+		taskname := taskFlags.Arg(1)
+		if *taskAll {
+			cancelTaskAll(ustr, taskname)
+		} else {
+			err := cancelTask(ustr, taskname)
+			cbfstool.MaybeFatal(err, "Error canceling %v: %v", taskname, err)
+		}
+	case "history":
+		showTaskHistory(ustr, taskFlags.Arg(1))
+	default:
+		log.Fatalf("Unknown task subcommand: %q", taskFlags.Arg(0))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var verifybakFlags = flag.NewFlagSet("verifybak", flag.ExitOnError)
+var verifybakReplicas = verifybakFlags.Int("replicas", 0,
+	"Replicas each blob needs (0 for the cluster minimum)")
+var verifybakSample = verifybakFlags.Float64("sample", 0,
+	"Fraction of blobs to read back and rehash")
+var verifybakOut = verifybakFlags.String("o", "",
+	"write problems here instead of stdout")
+
+// Check that a backup could be restored.
+func verifyBakCommand(ustr string, args []string) {
+	u := cbfstool.ParseURL(ustr)
+	u.Path = "/.cbfs/backup/verify/"
+	params := url.Values{
+		"fn":     {verifybakFlags.Arg(0)},
+		"sample": {strconv.FormatFloat(*verifybakSample, 'g', -1, 64)},
+	}
+	if *verifybakReplicas > 0 {
+		params.Set("replicas", strconv.Itoa(*verifybakReplicas))
+	}
+	u.RawQuery = params.Encode()
+
+	res, err := http.Get(u.String())
+	cbfstool.MaybeFatal(err, "Error verifying backup: %v", err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		cbfstool.MaybeFatal(httputil.HTTPError(res),
+			"Error verifying backup: %v", res.Status)
+	}
+
+	var out io.Writer = os.Stdout
+	if *verifybakOut != "" {
+		f, err := os.Create(*verifybakOut)
+		cbfstool.MaybeFatal(err, "Error creating %v: %v", *verifybakOut, err)
+		defer f.Close()
+		out = f
+	}
+
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		line := struct {
+			Error   string
+			Summary *struct {
+				Records, Files, Deletions int
+				Blobs, Hashed, Problems   int
+				OK                        bool
+			}
+		}{}
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			log.Fatalf("Error decoding verification: %v", err)
+		}
+		switch {
+		case line.Error != "":
+			log.Fatalf("Verification is incomplete: %v", line.Error)
+		case line.Summary != nil:
+			sum := line.Summary
+			log.Printf("Checked %v records (%v files, %v deletions), "+
+				"%v blobs, rehashed %v",
+				sum.Records, sum.Files, sum.Deletions, sum.Blobs, sum.Hashed)
+			if !sum.OK {
+				log.Fatalf("Found %v problems", sum.Problems)
+			}
+			log.Printf("Backup is OK")
+			return
+		default:
+			_, err := out.Write(append(s.Bytes(), '\n'))
+			cbfstool.MaybeFatal(err, "Error writing problems: %v", err)
+		}
+	}
+	cbfstool.MaybeFatal(s.Err(), "Error reading verification: %v", s.Err())
+	log.Fatalf("Verification ended without a summary")
+}
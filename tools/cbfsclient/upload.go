@@ -41,6 +41,8 @@ var uploadIgnore = uploadFlags.String("ignore", "",
 	"Path to ignore file")
 var uploadUnsafe = uploadFlags.Bool("unsafe", false,
 	"Unsafe (not synchronously replicated) uploads.")
+var uploadQuorum = uploadFlags.Int("quorum", 0,
+	"Copies to confirm before an upload succeeds (0 == cluster default)")
 var uploadNoHash = uploadFlags.Bool("nohash", false,
 	"Don't include the hash in the upload request")
 var uploadExpiration = uploadFlags.Int("expire", 0,
@@ -182,6 +184,7 @@ func uploadStream(client *cbfsclient.Client, r io.Reader,
 
 	opts := cbfsclient.PutOptions{
 		Unsafe:           *uploadUnsafe,
+		WriteQuorum:      *uploadQuorum,
 		Expiration:       *uploadExpiration,
 		Hash:             localHash,
 		ContentTransform: maybeCrypt,
@@ -0,0 +1,140 @@
+// Periodically copy the expvar numbers of every cbfs node into a
+// time-series database.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tsexport"
+	"github.com/dustin/httputil"
+)
+
+var cbfsUrl = flag.String("cbfs", "http://cbfs:8484/", "URL to cbfs base")
+var output = flag.String("output", "influxdb",
+	"Where to send metrics: influxdb, graphite or opentsdb")
+var dest = flag.String("dest", "http://influxdb:8086/?db=cbfs",
+	"URL (influxdb, opentsdb) or host:port (graphite) of the output")
+var prefix = flag.String("prefix", "cbfs", "Prefix for metric names")
+var pollFreq = flag.Duration("freq", 10*time.Second, "How often to poll cbfs")
+var include = flag.String("metrics", "",
+	"Comma separated patterns of metrics to send (default all)")
+var exclude = flag.String("exclude", "",
+	"Comma separated patterns of metrics not to send")
+
+var nodeLock sync.Mutex
+var nodes map[string]cbfsclient.StorageNode
+
+func updateNodes() {
+	nodeLock.Lock()
+	defer nodeLock.Unlock()
+
+	// A fresh client, since one remembers the nodes it first saw.
+	client, err := cbfsclient.New(*cbfsUrl)
+	if err == nil {
+		var n map[string]cbfsclient.StorageNode
+		if n, err = client.Nodes(); err == nil {
+			nodes = n
+			return
+		}
+	}
+	if nodes == nil {
+		log.Fatalf("Couldn't find cbfs nodes: %v", err)
+	}
+	log.Printf("Couldn't update cbfs nodes: %v", err)
+}
+
+func updateNodesLoop() {
+	for range time.Tick(time.Minute) {
+		updateNodes()
+	}
+}
+
+func pollNode(name string, node cbfsclient.StorageNode, sel *cbfstsexport.Selector,
+	t time.Time) ([]cbfstsexport.Point, error) {
+
+	res, err := http.Get(node.URLFor("/.cbfs/debug/"))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPErrorf(res, "error polling %v: %S\n%B", name)
+	}
+
+	var doc interface{}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	points := []cbfstsexport.Point{}
+	cbfstsexport.Flatten("", doc, func(n string, v float64) {
+		if sel.Match(n) {
+			points = append(points, cbfstsexport.Point{
+				Node: name, Name: n, Value: v, Time: t})
+		}
+	})
+	return points, nil
+}
+
+func poll(out cbfstsexport.Output, sel *cbfstsexport.Selector, t time.Time) {
+	nodeLock.Lock()
+	current := nodes
+	nodeLock.Unlock()
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	points := []cbfstsexport.Point{}
+	for k, v := range current {
+		wg.Add(1)
+		go func(name string, node cbfsclient.StorageNode) {
+			defer wg.Done()
+			ps, err := pollNode(name, node, sel, t)
+			if err != nil {
+				log.Printf("Error polling %v: %v", name, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			points = append(points, ps...)
+		}(k, v)
+	}
+	wg.Wait()
+
+	if len(points) == 0 {
+		return
+	}
+	if err := out.Write(points); err != nil {
+		log.Printf("Error sending %v points to %v: %v", len(points), *output, err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	http.DefaultClient = &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   *pollFreq,
+	}
+
+	sel, err := cbfstsexport.NewSelector(*include, *exclude)
+	if err != nil {
+		log.Fatalf("Error parsing metric patterns: %v", err)
+	}
+	out, err := cbfstsexport.Open(*output, *dest, *prefix)
+	if err != nil {
+		log.Fatalf("Error opening %v output: %v", *output, err)
+	}
+	defer out.Close()
+
+	updateNodes()
+	go updateNodesLoop()
+
+	for t := range time.Tick(*pollFreq) {
+		poll(out, sel, t)
+	}
+}
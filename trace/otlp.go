@@ -0,0 +1,188 @@
+package cbfstrace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Somewhere to send finished traces.
+type Exporter interface {
+	Export(t *Trace) error
+	Close() error
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+// OTLP span kinds and status codes.
+const (
+	kindInternal = 1
+	kindServer   = 2
+	statusError  = 2
+)
+
+func otlpAttrs(m map[string]string) []otlpAttr {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rv := make([]otlpAttr, 0, len(keys))
+	for _, k := range keys {
+		rv = append(rv, otlpAttr{k, otlpValue{m[k]}})
+	}
+	return rv
+}
+
+// Encode traces as an OTLP/JSON ExportTraceServiceRequest.  Every span
+// is attributed to a resource with the given attributes
+// (e.g. service.name).
+func MarshalOTLP(resource map[string]string, traces ...*Trace) ([]byte, error) {
+	spans := []otlpSpan{}
+	for _, t := range traces {
+		for i, s := range t.Spans() {
+			o := otlpSpan{
+				TraceID:      t.ID,
+				SpanID:       s.ID,
+				ParentSpanID: s.Parent,
+				Name:         s.Name,
+				Kind:         kindInternal,
+				Start:        strconv.FormatInt(s.Began.UnixNano(), 10),
+				End:          strconv.FormatInt(s.Ended.UnixNano(), 10),
+				Attributes:   otlpAttrs(s.Attrs),
+			}
+			if i == 0 && s.Attrs["http.method"] != "" {
+				o.Kind = kindServer
+			}
+			if s.Ended.IsZero() {
+				o.End = o.Start
+			}
+			if s.Err != "" {
+				o.Status = &otlpStatus{statusError, s.Err}
+			}
+			spans = append(spans, o)
+		}
+	}
+
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{{scope{"cbfs"}, spans}}}
+	rs.Resource.Attributes = otlpAttrs(resource)
+	return json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{rs}})
+}
+
+// Writes each trace as a line of OTLP/JSON, as read by the
+// OpenTelemetry collector's otlpjsonfile receiver.
+type FileExporter struct {
+	resource map[string]string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// Append traces to the file at path.
+func NewFileExporter(path string, resource map[string]string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{resource: resource, w: f}, nil
+}
+
+func (e *FileExporter) Export(t *Trace) error {
+	b, err := MarshalOTLP(e.resource, t)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.w.Close()
+}
+
+// The most recent of some traces.
+type Recent struct {
+	mu     sync.Mutex
+	traces []*Trace
+	next   int
+	full   bool
+}
+
+// Remember up to n traces.
+func NewRecent(n int) *Recent {
+	return &Recent{traces: make([]*Trace, n)}
+}
+
+func (r *Recent) Add(t *Trace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.traces) == 0 {
+		return
+	}
+	r.traces[r.next] = t
+	r.next = (r.next + 1) % len(r.traces)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// The remembered traces, newest first.
+func (r *Recent) List() []*Trace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.traces)
+	}
+	rv := make([]*Trace, 0, n)
+	for i := 1; i <= n; i++ {
+		rv = append(rv, r.traces[(r.next-i+len(r.traces))%len(r.traces)])
+	}
+	return rv
+}
@@ -0,0 +1,242 @@
+// Lightweight span tracing.
+//
+// A Trace is a tree of timed Spans rooted at one request or task.
+// Everything is safe to call on a nil Trace or Span, so code can trace
+// unconditionally whether or not its caller started a trace.
+package cbfstrace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One timed operation within a trace.
+type Span struct {
+	Name   string            `json:"name"`
+	ID     string            `json:"id"`
+	Parent string            `json:"parent,omitempty"`
+	Began  time.Time         `json:"began"`
+	Ended  time.Time         `json:"ended"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+	Err    string            `json:"error,omitempty"`
+
+	t *Trace
+}
+
+// The spans of one request or task.  The first span is the root.
+type Trace struct {
+	ID string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	for {
+		rand.Read(b)
+		for _, c := range b {
+			if c != 0 {
+				return fmt.Sprintf("%x", b)
+			}
+		}
+	}
+}
+
+// Start a trace whose root span has the given name and attributes
+// (as key, value pairs).
+func New(name string, attrs ...string) *Trace {
+	t := &Trace{ID: newID(16)}
+	t.add(name, "", attrs)
+	return t
+}
+
+func (t *Trace) add(name, parent string, attrs []string) *Span {
+	s := &Span{Name: name, ID: newID(8), Parent: parent,
+		Began: time.Now(), t: t}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.setAttr(attrs[i], attrs[i+1])
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// The root span.
+func (t *Trace) Root() *Span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.spans[0]
+}
+
+// Start a phase: a child of the root span.
+func (t *Trace) Start(name string, attrs ...string) *Span {
+	return t.Root().Start(name, attrs...)
+}
+
+// End the root span, returning how long the trace took.
+func (t *Trace) Finish() time.Duration {
+	r := t.Root()
+	r.End()
+	return t.Duration()
+}
+
+// How long the root span took (or has taken so far).
+func (t *Trace) Duration() time.Duration {
+	r := t.Root()
+	if r == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if r.Ended.IsZero() {
+		return time.Since(r.Began)
+	}
+	return r.Ended.Sub(r.Began)
+}
+
+// Copies of all spans, root first.
+func (t *Trace) Spans() []Span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rv := make([]Span, 0, len(t.spans))
+	for _, s := range t.spans {
+		c := *s
+		c.t = nil
+		c.Attrs = map[string]string{}
+		for k, v := range s.Attrs {
+			c.Attrs[k] = v
+		}
+		rv = append(rv, c)
+	}
+	return rv
+}
+
+// A direct child of the root span and the time spent in it.
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Time spent in each finished phase, in the order phases were first
+// started.  Phases with the same name are added together.
+func (t *Trace) Phases() []Phase {
+	spans := t.Spans()
+	if len(spans) == 0 {
+		return nil
+	}
+	rv := []Phase{}
+	seen := map[string]int{}
+	for _, s := range spans[1:] {
+		if s.Parent != spans[0].ID || s.Ended.IsZero() {
+			continue
+		}
+		i, ok := seen[s.Name]
+		if !ok {
+			i = len(rv)
+			seen[s.Name] = i
+			rv = append(rv, Phase{Name: s.Name})
+		}
+		rv[i].Duration += s.Ended.Sub(s.Began)
+	}
+	return rv
+}
+
+// The phases as "name=duration ..." for logging.
+func (t *Trace) Breakdown() string {
+	parts := []string{}
+	for _, p := range t.Phases() {
+		parts = append(parts, fmt.Sprintf("%v=%v", p.Name, p.Duration))
+	}
+	if len(parts) == 0 {
+		return "no phases"
+	}
+	return strings.Join(parts, " ")
+}
+
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	spans := t.Spans()
+	if len(spans) == 0 {
+		return []byte("null"), nil
+	}
+	return json.Marshal(struct {
+		ID       string        `json:"id"`
+		Name     string        `json:"name"`
+		Start    time.Time     `json:"start"`
+		Duration time.Duration `json:"duration"`
+		Phases   []Phase       `json:"phases"`
+		Spans    []Span        `json:"spans"`
+	}{t.ID, spans[0].Name, spans[0].Began, t.Duration(), t.Phases(), spans})
+}
+
+// Start a child of this span.
+func (s *Span) Start(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.t.add(name, s.ID, attrs)
+}
+
+// End the span.  Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	if s.Ended.IsZero() {
+		s.Ended = time.Now()
+	}
+}
+
+func (s *Span) setAttr(k, v string) {
+	if s.Attrs == nil {
+		s.Attrs = map[string]string{}
+	}
+	s.Attrs[k] = v
+}
+
+// Set an attribute on the span.
+func (s *Span) SetAttr(k string, v interface{}) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.setAttr(k, fmt.Sprint(v))
+}
+
+// Mark the span failed if err isn't nil.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.Err = err.Error()
+}
+
+type contextKey struct{}
+
+// A context carrying t.
+func NewContext(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// The trace in ctx, or nil.
+func FromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(contextKey{}).(*Trace)
+	return t
+}
@@ -0,0 +1,139 @@
+package cbfstrace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNilSafe(t *testing.T) {
+	var tr *Trace
+	s := tr.Start("x", "a", "b")
+	s.SetAttr("k", 1)
+	s.Fail(errors.New("oops"))
+	s.Start("y").End()
+	s.End()
+	if d := tr.Finish(); d != 0 {
+		t.Errorf("Expected no duration from a nil trace, got %v", d)
+	}
+	if tr.Breakdown() != "no phases" {
+		t.Errorf("Expected no phases, got %q", tr.Breakdown())
+	}
+	if FromContext(context.Background()) != nil {
+		t.Errorf("Expected no trace in an empty context")
+	}
+}
+
+func TestPhases(t *testing.T) {
+	tr := New("PUT /x", "http.method", "PUT")
+	if FromContext(NewContext(context.Background(), tr)) != tr {
+		t.Fatalf("Expected the trace back from its context")
+	}
+
+	root := tr.Root()
+	spans := []*Span{tr.Start("write"), tr.Start("meta"), tr.Start("write")}
+	child := spans[0].Start("disk")
+	unfinished := tr.Start("never")
+	for i, s := range spans {
+		s.Began = root.Began.Add(time.Duration(i) * time.Second)
+		s.Ended = s.Began.Add(time.Duration(i+1) * time.Second)
+	}
+	child.End()
+	tr.Finish()
+
+	exp := []Phase{{"write", 4 * time.Second}, {"meta", 2 * time.Second}}
+	got := tr.Phases()
+	if len(got) != len(exp) || got[0] != exp[0] || got[1] != exp[1] {
+		t.Errorf("Expected phases %v, got %v", exp, got)
+	}
+	if b := tr.Breakdown(); b != "write=4s meta=2s" {
+		t.Errorf("Expected a breakdown of write=4s meta=2s, got %q", b)
+	}
+	if len(tr.Spans()) != 6 || unfinished.Parent != root.ID ||
+		child.Parent != spans[0].ID {
+		t.Errorf("Unexpected span tree: %+v", tr.Spans())
+	}
+}
+
+func TestExport(t *testing.T) {
+	tr := New("GET /x", "http.method", "GET")
+	s := tr.Start("meta", "key", "/x")
+	s.Fail(errors.New("oops"))
+	s.End()
+	tr.Finish()
+
+	d, err := ioutil.TempDir("", "tracetest")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "traces.json")
+	e, err := NewFileExporter(fn, map[string]string{"service.name": "cbfs"})
+	if err != nil {
+		t.Fatalf("Error opening exporter: %v", err)
+	}
+	e.Export(tr)
+	e.Export(tr)
+	e.Close()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading traces: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two lines, got %v", len(lines))
+	}
+
+	doc := struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttr
+			}
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}{}
+	if err := json.Unmarshal([]byte(lines[0]), &doc); err != nil {
+		t.Fatalf("Error parsing %s: %v", lines[0], err)
+	}
+	rs := doc.ResourceSpans[0]
+	if rs.Resource.Attributes[0].Value.StringValue != "cbfs" {
+		t.Errorf("Expected a cbfs service, got %v", rs.Resource.Attributes)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected two spans, got %v", spans)
+	}
+	if spans[0].Kind != kindServer || spans[1].Kind != kindInternal ||
+		spans[1].ParentSpanID != spans[0].SpanID ||
+		spans[0].TraceID != tr.ID || len(tr.ID) != 32 {
+		t.Errorf("Unexpected spans: %+v", spans)
+	}
+	if spans[1].Status == nil || spans[1].Status.Message != "oops" {
+		t.Errorf("Expected an error status, got %+v", spans[1].Status)
+	}
+}
+
+func TestRecent(t *testing.T) {
+	r := NewRecent(3)
+	if len(r.List()) != 0 {
+		t.Errorf("Expected nothing yet")
+	}
+	traces := []*Trace{}
+	for i := 0; i < 5; i++ {
+		traces = append(traces, New("x"))
+		r.Add(traces[i])
+	}
+	got := r.List()
+	if len(got) != 3 || got[0] != traces[4] || got[2] != traces[2] {
+		t.Errorf("Expected the last three newest first, got %v", got)
+	}
+}
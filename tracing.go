@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/trace"
+)
+
+var traceFile = flag.String("traceFile", "",
+	"Append traces to this file as OTLP/JSON")
+var traceAll = flag.Bool("traceAll", false,
+	"Export every request and task trace, not just slow ones")
+
+const (
+	slowPrefix = "/.cbfs/debug/slow"
+	slowKeep   = 100
+)
+
+var (
+	traceExporter cbfstrace.Exporter
+	slowTraces    = cbfstrace.NewRecent(slowKeep)
+)
+
+func initTracing() error {
+	if *traceFile == "" {
+		return nil
+	}
+	e, err := cbfstrace.NewFileExporter(*traceFile, map[string]string{
+		"service.name":        "cbfs",
+		"service.instance.id": serverId,
+	})
+	if err == nil {
+		traceExporter = e
+	}
+	return err
+}
+
+func exportTrace(t *cbfstrace.Trace) {
+	if traceExporter == nil {
+		return
+	}
+	if err := traceExporter.Export(t); err != nil {
+		mainLog.Warnf("Error exporting trace %v: %v", t.ID, err)
+	}
+}
+
+func startRequestTrace(req *http.Request) *http.Request {
+	t := cbfstrace.New(req.Method+" "+metricEndpoint(req.URL.Path),
+		"http.method", req.Method, "http.target", req.URL.RequestURI(),
+		"cbfs.request_id", requestID(req))
+	return req.WithContext(cbfstrace.NewContext(req.Context(), t))
+}
+
+// Finish the request's trace, logging and keeping it if it was slow.
+func finishRequestTrace(req *http.Request, status int) {
+	t := cbfstrace.FromContext(req.Context())
+	t.Root().SetAttr("http.status_code", status)
+	took := t.Finish()
+
+	thresh := globalConfig.SlowRequestThresh
+	slow := thresh > 0 && took > thresh
+	if slow {
+		slowTraces.Add(t)
+		reqLog(httpLog, requestID(req)).Warnf("Slow %v %v took %v: %v",
+			req.Method, req.URL.Path, took, t.Breakdown())
+	}
+	if slow || *traceAll {
+		exportTrace(t)
+	}
+}
+
+// Trace a task run, logging and keeping it if it was slow; f may add
+// phases through the context.
+func traceTask(ctx context.Context, name string,
+	f func(context.Context) error) error {
+
+	t := cbfstrace.New("task "+name, "cbfs.task", name)
+	err := f(cbfstrace.NewContext(ctx, t))
+	t.Root().Fail(err)
+	took := t.Finish()
+
+	thresh := globalConfig.SlowTaskThresh
+	slow := thresh > 0 && took > thresh
+	if slow {
+		slowTraces.Add(t)
+		taskLog.Warnf("Slow task %v took %v: %v", name, took, t.Breakdown())
+	}
+	if slow || *traceAll {
+		exportTrace(t)
+	}
+	return err
+}
+
+// Couchbase connection waits over the threshold are traced on their
+// own, as they aren't tied to any one request.
+func noteCouchbaseWait(host, source string, start time.Time, err error) {
+	thresh := globalConfig.SlowCouchbaseThresh
+	took := time.Since(start)
+	if thresh <= 0 || took <= thresh {
+		return
+	}
+	t := cbfstrace.New("couchbase connection", "net.peer.name", host,
+		"cbfs.source", source)
+	r := t.Root()
+	r.Began = start
+	r.Fail(err)
+	t.Finish()
+
+	slowTraces.Add(t)
+	mainLog.Warnf("Slow couchbase connection to %v for %v: %v", host, source, took)
+	exportTrace(t)
+}
+
+func doSlowTraces(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(map[string]interface{}{
+		"threshold":          globalConfig.SlowRequestThresh,
+		"couchbaseThreshold": globalConfig.SlowCouchbaseThresh,
+		"taskThreshold":      globalConfig.SlowTaskThresh,
+		"traces":             slowTraces.List(),
+	})
+}
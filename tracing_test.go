@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/trace"
+)
+
+func TestSlowRequestTrace(t *testing.T) {
+	defer func(d time.Duration) { globalConfig.SlowRequestThresh = d }(
+		globalConfig.SlowRequestThresh)
+	slowTraces = cbfstrace.NewRecent(slowKeep)
+
+	tests := []struct {
+		thresh time.Duration
+		kept   int
+	}{
+		{0, 0},
+		{time.Hour, 0},
+		{time.Nanosecond, 1},
+	}
+	for _, test := range tests {
+		globalConfig.SlowRequestThresh = test.thresh
+		req := startRequestTrace(httptest.NewRequest("PUT", "/x", nil))
+		sp := cbfstrace.FromContext(req.Context()).Start("write")
+		time.Sleep(time.Millisecond)
+		sp.End()
+		finishRequestTrace(req, 201)
+		if n := len(slowTraces.List()); n != test.kept {
+			t.Errorf("At %v, expected %v slow traces, got %v", test.thresh,
+				test.kept, n)
+		}
+	}
+
+	tr := slowTraces.List()[0]
+	if p := tr.Phases(); len(p) != 1 || p[0].Name != "write" {
+		t.Errorf("Expected a write phase, got %v", p)
+	}
+	if s := tr.Root().Attrs["http.status_code"]; s != "201" {
+		t.Errorf("Expected a 201 status, got %q", s)
+	}
+}
+
+func TestSlowTaskTrace(t *testing.T) {
+	defer func(d time.Duration) { globalConfig.SlowTaskThresh = d }(
+		globalConfig.SlowTaskThresh)
+	slowTraces = cbfstrace.NewRecent(slowKeep)
+
+	task := func(ctx context.Context) error {
+		sp := cbfstrace.FromContext(ctx).Start("sweep")
+		time.Sleep(time.Millisecond)
+		sp.End()
+		return nil
+	}
+	for _, thresh := range []time.Duration{0, time.Hour, time.Nanosecond} {
+		globalConfig.SlowTaskThresh = thresh
+		if err := traceTask(context.Background(), "gc", task); err != nil {
+			t.Fatalf("Error running task: %v", err)
+		}
+	}
+
+	kept := slowTraces.List()
+	if len(kept) != 1 {
+		t.Fatalf("Expected one slow task trace, got %v", len(kept))
+	}
+	if p := kept[0].Phases(); len(p) != 1 || p[0].Name != "sweep" {
+		t.Errorf("Expected a sweep phase, got %v", p)
+	}
+	if n := kept[0].Root().Attrs["cbfs.task"]; n != "gc" {
+		t.Errorf("Expected the task name, got %q", n)
+	}
+}
@@ -0,0 +1,134 @@
+// Package cbfstsexport sends numbers scraped from cbfs nodes to a
+// time-series database.
+package cbfstsexport
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// One value of one metric from one node.
+type Point struct {
+	Node  string
+	Name  string
+	Value float64
+	Time  time.Time
+}
+
+// Somewhere to send points.
+type Output interface {
+	// Send a batch of points.
+	Write(points []Point) error
+	Close() error
+}
+
+// Open an output.  influxdb and opentsdb take an http:// URL (with a
+// db parameter for influxdb), graphite takes a host:port.  Metric
+// names are sent under prefix, if it isn't empty.
+func Open(kind, dest, prefix string) (Output, error) {
+	switch kind {
+	case "influxdb":
+		return NewInflux(dest, prefix)
+	case "graphite":
+		return NewGraphite(dest, prefix)
+	case "opentsdb":
+		return NewOpenTSDB(dest, prefix)
+	}
+	return nil, fmt.Errorf("unknown output %q (want influxdb, graphite "+
+		"or opentsdb)", kind)
+}
+
+// Call f with the dotted name of every number in a decoded JSON
+// document.  Booleans count as 0 or 1; strings and arrays are skipped.
+func Flatten(prefix string, v interface{}, f func(name string, val float64)) {
+	switch x := v.(type) {
+	case float64:
+		f(prefix, x)
+	case bool:
+		if x {
+			f(prefix, 1)
+		} else {
+			f(prefix, 0)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			name := k
+			if prefix != "" {
+				name = prefix + "." + k
+			}
+			Flatten(name, x[k], f)
+		}
+	}
+}
+
+// Picks metrics by name with shell patterns, where * doesn't cross a
+// dot.
+type Selector struct {
+	include, exclude []string
+}
+
+// Build a selector from comma separated patterns.  An empty include
+// list takes everything.
+func NewSelector(include, exclude string) (*Selector, error) {
+	s := &Selector{split(include), split(exclude)}
+	for _, p := range append(append([]string{}, s.include...), s.exclude...) {
+		if _, err := path.Match(dotsToSlashes(p), ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", p, err)
+		}
+	}
+	return s, nil
+}
+
+func split(s string) []string {
+	rv := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+func join(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func dotsToSlashes(s string) string {
+	return strings.Replace(s, ".", "/", -1)
+}
+
+func matchAny(patterns []string, name string) bool {
+	name = dotsToSlashes(name)
+	for _, p := range patterns {
+		p = dotsToSlashes(p)
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		// A pattern also takes everything under what it matches.
+		parts := strings.Split(name, "/")
+		for i := 1; i < len(parts); i++ {
+			if ok, _ := path.Match(p, strings.Join(parts[:i], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Selector) Match(name string) bool {
+	if len(s.include) > 0 && !matchAny(s.include, name) {
+		return false
+	}
+	return !matchAny(s.exclude, name)
+}
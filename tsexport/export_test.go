@@ -0,0 +1,172 @@
+package cbfstsexport
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPoints = []Point{
+	{"node.a", "tasks.gc count", 3, time.Unix(1700000000, 5)},
+	{"b", "memstats.Alloc", 1.5e6, time.Unix(1700000001, 0)},
+}
+
+func TestFlatten(t *testing.T) {
+	doc := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{"a": 1, "b": {"c": 2.5, "d": "x",
+		"e": [1, 2], "f": true}}`), &doc)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	got := map[string]float64{}
+	Flatten("", doc, func(n string, v float64) { got[n] = v })
+	exp := map[string]float64{"a": 1, "b.c": 2.5, "b.f": 1}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	s, err := NewSelector("memstats.*Alloc,tasks", "tasks.*.p99")
+	if err != nil {
+		t.Fatalf("Error making selector: %v", err)
+	}
+	tests := map[string]bool{
+		"memstats.Alloc":       true,
+		"memstats.HeapAlloc":   true,
+		"memstats.NumGC":       false,
+		"tasks.gc.count":       true,
+		"tasks.gc.p99":         false,
+		"tasksets.gc.count":    false,
+		"httpclients.inflight": false,
+	}
+	for name, exp := range tests {
+		if s.Match(name) != exp {
+			t.Errorf("Expected match of %v = %v", name, exp)
+		}
+	}
+
+	all, _ := NewSelector("", "")
+	if !all.Match("anything.at.all") {
+		t.Errorf("Expected an empty selector to take everything")
+	}
+	if _, err := NewSelector("[", ""); err == nil {
+		t.Errorf("Expected an error for a bad pattern")
+	}
+}
+
+// An HTTP sink remembering what was posted where.
+func httpSink(status int) (*httptest.Server, chan *http.Request,
+	chan string) {
+
+	reqs, bodies := make(chan *http.Request, 1), make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			reqs <- req
+			bodies <- string(b)
+			w.WriteHeader(status)
+		}))
+	return s, reqs, bodies
+}
+
+func TestInflux(t *testing.T) {
+	s, reqs, bodies := httpSink(204)
+	defer s.Close()
+
+	if _, err := Open("influxdb", s.URL, "cbfs"); err == nil {
+		t.Errorf("Expected an error without a db")
+	}
+	o, err := Open("influxdb", s.URL+"/?db=stats", "cbfs")
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if err := o.Write(testPoints); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	req := <-reqs
+	if req.URL.Path != "/write" || req.URL.Query().Get("db") != "stats" {
+		t.Errorf("Expected a post to /write?db=stats, got %v", req.URL)
+	}
+	exp := `cbfs.tasks.gc\ count,node=node.a value=3 1700000000000000005
+cbfs.memstats.Alloc,node=b value=1.5e+06 1700000001000000000
+`
+	if got := <-bodies; got != exp {
+		t.Errorf("Expected\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func TestOpenTSDB(t *testing.T) {
+	s, reqs, bodies := httpSink(204)
+	defer s.Close()
+
+	o, err := Open("opentsdb", s.URL, "")
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if err := o.Write(testPoints[1:]); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if req := <-reqs; req.URL.Path != "/api/put" {
+		t.Errorf("Expected a post to /api/put, got %v", req.URL)
+	}
+	exp := `[{"metric":"memstats.Alloc","timestamp":1700000001,"value":1500000,"tags":{"node":"b"}}]`
+	if got := <-bodies; got != exp {
+		t.Errorf("Expected\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	s, _, _ := httpSink(400)
+	defer s.Close()
+
+	o, _ := Open("opentsdb", s.URL, "")
+	if err := o.Write(testPoints); err == nil {
+		t.Errorf("Expected an error from a 400")
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(c)
+		got <- string(b)
+	}()
+
+	o, err := Open("graphite", l.Addr().String(), "cbfs")
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if err := o.Write(testPoints); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	exp := "cbfs.node_a.tasks.gc_count 3 1700000000\n" +
+		"cbfs.b.memstats.Alloc 1.5e+06 1700000001\n"
+	if g := <-got; g != exp {
+		t.Errorf("Expected\n%v\ngot\n%v", exp, g)
+	}
+
+	if _, err := Open("graphite", "nowhere", ""); err == nil {
+		t.Errorf("Expected an error for an address without a port")
+	}
+	if _, err := Open("seriesly", "x", ""); err == nil ||
+		!strings.Contains(err.Error(), "unknown output") {
+		t.Errorf("Expected an unknown output error, got %v", err)
+	}
+}
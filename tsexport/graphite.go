@@ -0,0 +1,53 @@
+package cbfstsexport
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes Graphite's plaintext protocol over TCP, connecting for each
+// batch so a restarted carbon is picked up again.
+type graphiteOutput struct {
+	addr   string
+	prefix string
+}
+
+// Send to a carbon listener at host:port.
+func NewGraphite(dest, prefix string) (Output, error) {
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		return nil, err
+	}
+	return &graphiteOutput{dest, prefix}, nil
+}
+
+// Nodes become a path component, so they can't have dots.
+var graphiteNodeEscaper = strings.NewReplacer(".", "_", " ", "_")
+
+func graphiteLine(prefix string, p Point) string {
+	return fmt.Sprintf("%v %v %v",
+		join(prefix, graphiteNodeEscaper.Replace(p.Node)+"."+
+			strings.Replace(p.Name, " ", "_", -1)),
+		strconv.FormatFloat(p.Value, 'g', -1, 64), p.Time.Unix())
+}
+
+func (o *graphiteOutput) Write(points []Point) error {
+	c, err := net.DialTimeout("tcp", o.addr, httpTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(httpTimeout))
+	w := bufio.NewWriter(c)
+	for _, p := range points {
+		fmt.Fprintln(w, graphiteLine(o.prefix, p))
+	}
+	return w.Flush()
+}
+
+func (o *graphiteOutput) Close() error {
+	return nil
+}
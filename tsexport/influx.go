@@ -0,0 +1,77 @@
+package cbfstsexport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const httpTimeout = 10 * time.Second
+
+// Writes InfluxDB line protocol to its HTTP write endpoint.
+type influxOutput struct {
+	u      string
+	prefix string
+	client *http.Client
+}
+
+// Send to an InfluxDB server, e.g. http://influx:8086/?db=cbfs
+func NewInflux(dest, prefix string) (Output, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if u.Query().Get("db") == "" {
+		return nil, fmt.Errorf("no db given in %v", dest)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/write"
+	}
+	return &influxOutput{u.String(), prefix,
+		&http.Client{Timeout: httpTimeout}}, nil
+}
+
+var (
+	influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper  = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+func influxLine(prefix string, p Point) string {
+	return fmt.Sprintf("%v,node=%v value=%v %v",
+		influxNameEscaper.Replace(join(prefix, p.Name)),
+		influxTagEscaper.Replace(p.Node),
+		strconv.FormatFloat(p.Value, 'g', -1, 64), p.Time.UnixNano())
+}
+
+func (o *influxOutput) Write(points []Point) error {
+	buf := &bytes.Buffer{}
+	for _, p := range points {
+		fmt.Fprintln(buf, influxLine(o.prefix, p))
+	}
+	return post(o.client, o.u, "text/plain; charset=utf-8", buf)
+}
+
+func (o *influxOutput) Close() error {
+	return nil
+}
+
+func post(c *http.Client, u, ctype string, body io.Reader) error {
+	res, err := c.Post(u, ctype, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("HTTP error posting to %v: %v %s", u, res.Status,
+			bytes.TrimSpace(msg))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
@@ -0,0 +1,52 @@
+package cbfstsexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// Posts OpenTSDB JSON to its /api/put endpoint.
+type openTSDBOutput struct {
+	u      string
+	prefix string
+	client *http.Client
+}
+
+// Send to an OpenTSDB server, e.g. http://tsdb:4242/
+func NewOpenTSDB(dest, prefix string) (Output, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/put"
+	}
+	return &openTSDBOutput{u.String(), prefix,
+		&http.Client{Timeout: httpTimeout}}, nil
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+func (o *openTSDBOutput) Write(points []Point) error {
+	tps := make([]openTSDBPoint, 0, len(points))
+	for _, p := range points {
+		tps = append(tps, openTSDBPoint{join(o.prefix, p.Name),
+			p.Time.Unix(), p.Value, map[string]string{"node": p.Node}})
+	}
+	b, err := json.Marshal(tps)
+	if err != nil {
+		return err
+	}
+	return post(o.client, o.u, "application/json", bytes.NewReader(b))
+}
+
+func (o *openTSDBOutput) Close() error {
+	return nil
+}